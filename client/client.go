@@ -0,0 +1,503 @@
+// Package client is a memcached text protocol client that shards keys over
+// cache node servers with a hashring.HashRing, the way services consume
+// cache-ring over the network.
+//
+// Each key goes to the server that owns it on the ring. When that server
+// does not respond, the request fails over to the next owner clockwise, and
+// the failed server is skipped for a while before it is tried again.
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cache-ring/cluster"
+	"cache-ring/hashring"
+)
+
+// Defaults for the client options.
+const (
+	DefaultTimeout      = 500 * time.Millisecond
+	DefaultMaxIdleConns = 4
+	DefaultFailover     = 1
+	DefaultRetryAfter   = time.Second
+)
+
+var (
+	// ErrNoServers means the client has no server to send a key to.
+	ErrNoServers = errors.New("client: no servers")
+	// ErrMalformedKey means a key is empty, longer than 250 bytes or
+	// contains spaces or control characters.
+	ErrMalformedKey = errors.New("client: malformed key")
+)
+
+// Item is a value stored in the cache.
+type Item struct {
+	Key   string
+	Value []byte
+	// Flags are opaque to the cache and returned with the value.
+	Flags uint32
+	// TTL is how long the item lives, rounded up to whole seconds; 0 means
+	// it never expires.
+	TTL time.Duration
+	// CAS is the version returned by Get, used by CompareAndSwap.
+	CAS uint64
+}
+
+// Client routes keys to cache node servers. It is safe for concurrent use.
+type Client struct {
+	timeout    time.Duration
+	maxIdle    int
+	failover   int
+	retryAfter time.Duration
+
+	mu    sync.RWMutex
+	ring  *hashring.HashRing
+	pools map[string]*pool
+	// server -> when it last failed to respond
+	down map[string]time.Time
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithTimeout bounds dialing and every round trip to a server.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithMaxIdleConns keeps up to n idle connections per server for reuse.
+func WithMaxIdleConns(n int) Option {
+	return func(c *Client) {
+		c.maxIdle = max(n, 0)
+	}
+}
+
+// WithFailover tries up to n further owners of a key when the servers before
+// them do not respond. 0 disables failover.
+func WithFailover(n int) Option {
+	return func(c *Client) {
+		c.failover = max(n, 0)
+	}
+}
+
+// WithRetryAfter skips a server that did not respond for d before trying it
+// again first. Until then it is tried only after the other owners.
+func WithRetryAfter(d time.Duration) Option {
+	return func(c *Client) {
+		c.retryAfter = d
+	}
+}
+
+// New returns a client without servers. numReplicas is the number of virtual
+// nodes per server on the ring.
+func New(numReplicas int, opts ...Option) *Client {
+	c := &Client{
+		timeout:    DefaultTimeout,
+		maxIdle:    DefaultMaxIdleConns,
+		failover:   DefaultFailover,
+		retryAfter: DefaultRetryAfter,
+		ring:       hashring.New(numReplicas),
+		pools:      make(map[string]*pool),
+		down:       make(map[string]time.Time),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// AddServer adds the server at the TCP address addr to the ring.
+func (c *Client) AddServer(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.pools[addr]; exists {
+		return
+	}
+	c.ring.AddNode(addr)
+	c.pools[addr] = newPool(addr, c.maxIdle)
+}
+
+// RemoveServer removes a server from the ring and closes its idle
+// connections.
+func (c *Client) RemoveServer(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, exists := c.pools[addr]
+	if !exists {
+		return
+	}
+	c.ring.RemoveNode(addr)
+	p.close()
+	delete(c.pools, addr)
+	delete(c.down, addr)
+}
+
+// Servers returns the server addresses in stable order.
+func (c *Client) Servers() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ring.Nodes()
+}
+
+// Snapshot returns the layout of the client's ring, to hand to other clients.
+func (c *Client) Snapshot() *hashring.Snapshot {
+	return c.ring.Snapshot()
+}
+
+// Restore loads the ring layout in s, taken from a client or ring with the
+// same number of replicas, in place of the current servers. Servers missing
+// from s are dropped and their idle connections closed. It returns
+// hashring.ErrStaleSnapshot if s is older than the current layout.
+func (c *Client) Restore(s *hashring.Snapshot) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.ring.Restore(s); err != nil {
+		return err
+	}
+	keep := make(map[string]bool, len(s.Nodes))
+	for _, n := range s.Nodes {
+		keep[n.ID] = true
+		if _, exists := c.pools[n.ID]; !exists {
+			c.pools[n.ID] = newPool(n.ID, c.maxIdle)
+		}
+	}
+	for addr, p := range c.pools {
+		if !keep[addr] {
+			p.close()
+			delete(c.pools, addr)
+			delete(c.down, addr)
+		}
+	}
+	return nil
+}
+
+// Close closes all idle connections. The client must not be used after.
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range c.pools {
+		p.close()
+	}
+}
+
+// owners returns the servers to try for key in order: its owner and the
+// failover servers clockwise from it, with servers that recently failed
+// moved to the end.
+func (c *Client) owners(key string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ids := c.ring.GetNodes(key, c.failover+1)
+	now := time.Now()
+	live := make([]string, 0, len(ids))
+	var down []string
+	for _, id := range ids {
+		if failed, ok := c.down[id]; ok && now.Sub(failed) < c.retryAfter {
+			down = append(down, id)
+		} else {
+			live = append(live, id)
+		}
+	}
+	return append(live, down...)
+}
+
+// markDown records whether addr failed to respond.
+func (c *Client) markDown(addr string, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.pools[addr]; !exists {
+		return
+	}
+	if failed {
+		c.down[addr] = time.Now()
+	} else {
+		delete(c.down, addr)
+	}
+}
+
+// withConn runs fn on a connection to addr. The connection goes back to the
+// pool unless fn left it in an unknown state or the server replied with an
+// error.
+func (c *Client) withConn(addr string, fn func(*conn) error) error {
+	c.mu.RLock()
+	p := c.pools[addr]
+	c.mu.RUnlock()
+	if p == nil {
+		return &ioError{fmt.Errorf("server %s removed", addr)}
+	}
+	cn, err := p.get(c.timeout)
+	if err != nil {
+		return err
+	}
+	cn.nc.SetDeadline(time.Now().Add(c.timeout))
+	err = fn(cn)
+	var reply *replyError
+	if isIOError(err) || errors.Is(err, errMalformed) || errors.As(err, &reply) {
+		cn.nc.Close()
+	} else {
+		p.put(cn)
+	}
+	return err
+}
+
+// do runs fn against the owners of key in turn until one of them responds.
+func (c *Client) do(key string, fn func(*conn) error) error {
+	if !legalKey(key) {
+		return ErrMalformedKey
+	}
+	owners := c.owners(key)
+	if len(owners) == 0 {
+		return ErrNoServers
+	}
+	var err error
+	for _, addr := range owners {
+		err = c.withConn(addr, fn)
+		failed := isIOError(err)
+		c.markDown(addr, failed)
+		if !failed {
+			return err
+		}
+	}
+	return err
+}
+
+// Get returns the item stored under key, with its CAS version, or
+// cluster.ErrNotFound.
+func (c *Client) Get(key string) (*Item, error) {
+	var item *Item
+	err := c.do(key, func(cn *conn) error {
+		if err := cn.send("gets "+key, nil); err != nil {
+			return err
+		}
+		return cn.readValues(func(it *Item) { item = it })
+	})
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, cluster.ErrNotFound
+	}
+	return item, nil
+}
+
+// GetMulti returns the items of the keys that are present. Keys are split
+// into one pipelined batch per owning server, and the batches run
+// concurrently. A batch too long for one command line is sent as several
+// gets commands on the same connection. The keys of a server that does not respond fail over to
+// their next owners. The error reports the last batch that failed on every
+// owner; the items from the other batches are returned regardless.
+func (c *Client) GetMulti(keys []string) (map[string]*Item, error) {
+	for _, key := range keys {
+		if !legalKey(key) {
+			return nil, ErrMalformedKey
+		}
+	}
+	// remaining owners to try per key
+	pending := make(map[string][]string, len(keys))
+	for _, key := range keys {
+		if owners := c.owners(key); len(owners) > 0 {
+			pending[key] = owners
+		}
+	}
+	if len(pending) == 0 && len(keys) > 0 {
+		return nil, ErrNoServers
+	}
+
+	items := make(map[string]*Item, len(keys))
+	var lastErr error
+	for len(pending) > 0 {
+		batches := make(map[string][]string)
+		for key, owners := range pending {
+			batches[owners[0]] = append(batches[owners[0]], key)
+		}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for addr, batch := range batches {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := c.withConn(addr, func(cn *conn) error {
+					for _, line := range getsLines(batch) {
+						if err := cn.send(line, nil); err != nil {
+							return err
+						}
+						err := cn.readValues(func(it *Item) {
+							mu.Lock()
+							items[it.Key] = it
+							mu.Unlock()
+						})
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				failed := isIOError(err)
+				c.markDown(addr, failed)
+				mu.Lock()
+				defer mu.Unlock()
+				for _, key := range batch {
+					if failed && len(pending[key]) > 1 {
+						pending[key] = pending[key][1:]
+						continue
+					}
+					delete(pending, key)
+					if err != nil {
+						lastErr = err
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	return items, lastErr
+}
+
+// maxLineLength bounds the gets lines of GetMulti, so that a large batch
+// stays within the command line limit of servers that cap it.
+const maxLineLength = 8 << 10
+
+// getsLines splits keys into gets commands of at most maxLineLength bytes.
+func getsLines(keys []string) []string {
+	var lines []string
+	var line strings.Builder
+	for _, key := range keys {
+		if line.Len() > 0 && line.Len()+1+len(key) > maxLineLength {
+			lines = append(lines, line.String())
+			line.Reset()
+		}
+		if line.Len() == 0 {
+			line.WriteString("gets")
+		}
+		line.WriteString(" ")
+		line.WriteString(key)
+	}
+	if line.Len() > 0 {
+		lines = append(lines, line.String())
+	}
+	return lines
+}
+
+// Set stores item unconditionally.
+func (c *Client) Set(item *Item) error {
+	return c.store("set", item)
+}
+
+// Add stores item only if its key is absent, and returns
+// cluster.ErrNotStored otherwise.
+func (c *Client) Add(item *Item) error {
+	return c.store("add", item)
+}
+
+// Replace stores item only if its key is present, and returns
+// cluster.ErrNotStored otherwise.
+func (c *Client) Replace(item *Item) error {
+	return c.store("replace", item)
+}
+
+// CompareAndSwap stores item only if its key has not been written since
+// item.CAS was read by Get. It returns cluster.ErrExists if it has and
+// cluster.ErrNotFound if the key is gone.
+func (c *Client) CompareAndSwap(item *Item) error {
+	return c.store("cas", item)
+}
+
+func (c *Client) store(cmd string, item *Item) error {
+	line := fmt.Sprintf("%s %s %d %d %d", cmd, item.Key, item.Flags, exptime(item.TTL), len(item.Value))
+	if cmd == "cas" {
+		line += " " + strconv.FormatUint(item.CAS, 10)
+	}
+	return c.do(item.Key, func(cn *conn) error {
+		if err := cn.send(line, item.Value); err != nil {
+			return err
+		}
+		reply, err := cn.readLine()
+		if err != nil {
+			return err
+		}
+		if reply == "STORED" {
+			return nil
+		}
+		return responseError(reply)
+	})
+}
+
+// Delete removes key and returns cluster.ErrNotFound if it was absent.
+func (c *Client) Delete(key string) error {
+	return c.do(key, func(cn *conn) error {
+		if err := cn.send("delete "+key, nil); err != nil {
+			return err
+		}
+		reply, err := cn.readLine()
+		if err != nil {
+			return err
+		}
+		if reply == "DELETED" {
+			return nil
+		}
+		return responseError(reply)
+	})
+}
+
+// Incr adds delta to the decimal value of key and returns the result.
+func (c *Client) Incr(key string, delta uint64) (uint64, error) {
+	return c.delta("incr", key, delta)
+}
+
+// Decr subtracts delta from the decimal value of key, stopping at 0, and
+// returns the result.
+func (c *Client) Decr(key string, delta uint64) (uint64, error) {
+	return c.delta("decr", key, delta)
+}
+
+func (c *Client) delta(cmd, key string, delta uint64) (uint64, error) {
+	var n uint64
+	err := c.do(key, func(cn *conn) error {
+		if err := cn.send(fmt.Sprintf("%s %s %d", cmd, key, delta), nil); err != nil {
+			return err
+		}
+		reply, err := cn.readLine()
+		if err != nil {
+			return err
+		}
+		if v, perr := strconv.ParseUint(reply, 10, 64); perr == nil {
+			n = v
+			return nil
+		}
+		return responseError(reply)
+	})
+	return n, err
+}
+
+// exptime converts a TTL to a memcached exptime: seconds from now, rounded
+// up so a short positive TTL does not mean "never expires", or a unix time
+// for TTLs over 30 days, which the protocol cannot express as relative.
+func exptime(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	secs := int64((ttl + time.Second - 1) / time.Second)
+	if secs > 60*60*24*30 {
+		return time.Now().Add(ttl).Unix()
+	}
+	return secs
+}
+
+// legalKey reports whether key can be sent over the text protocol.
+func legalKey(key string) bool {
+	if len(key) == 0 || len(key) > 250 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
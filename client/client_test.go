@@ -0,0 +1,354 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cache-ring/cluster"
+	"cache-ring/hashring"
+	"cache-ring/server"
+)
+
+// startServers runs n cache node servers on local ports.
+func startServers(t *testing.T, n int) (addrs []string, servers map[string]*server.Server, nodes map[string]*cluster.CacheNode) {
+	t.Helper()
+	servers = make(map[string]*server.Server)
+	nodes = make(map[string]*cluster.CacheNode)
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		addr := l.Addr().String()
+		node := cluster.NewCacheNode(addr, cluster.Capacity{})
+		srv := server.New(node)
+		go srv.Serve(l)
+		t.Cleanup(func() { srv.Close() })
+		addrs = append(addrs, addr)
+		servers[addr] = srv
+		nodes[addr] = node
+	}
+	return addrs, servers, nodes
+}
+
+func newClient(addrs []string, opts ...Option) *Client {
+	c := New(50, opts...)
+	for _, addr := range addrs {
+		c.AddServer(addr)
+	}
+	return c
+}
+
+func TestClientOperations(t *testing.T) {
+	addrs, _, nodes := startServers(t, 3)
+	c := newClient(addrs)
+	defer c.Close()
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if err := c.Set(&Item{Key: key, Value: []byte("val-" + key), Flags: 3}); err != nil {
+			t.Fatalf("Set(%s): %v", key, err)
+		}
+	}
+	total := 0
+	for addr, node := range nodes {
+		if node.Len() == 0 {
+			t.Fatalf("server %s holds no keys", addr)
+		}
+		total += node.Len()
+	}
+	if total != 100 {
+		t.Fatalf("servers hold %d keys; want 100", total)
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owner := c.owners(key)[0]
+		if _, ok := nodes[owner].Get(key); !ok {
+			t.Fatalf("key %s is not on its owner %s", key, owner)
+		}
+		item, err := c.Get(key)
+		if err != nil || string(item.Value) != "val-"+key || item.Flags != 3 {
+			t.Fatalf("Get(%s) = %+v, %v", key, item, err)
+		}
+	}
+
+	t.Run("conditional writes", func(t *testing.T) {
+		if err := c.Add(&Item{Key: "key-1", Value: []byte("x")}); !errors.Is(err, cluster.ErrNotStored) {
+			t.Fatalf("Add of a present key returned %v; want ErrNotStored", err)
+		}
+		if err := c.Replace(&Item{Key: "nope", Value: []byte("x")}); !errors.Is(err, cluster.ErrNotStored) {
+			t.Fatalf("Replace of a missing key returned %v; want ErrNotStored", err)
+		}
+		item, _ := c.Get("key-1")
+		item.Value = []byte("swapped")
+		if err := c.CompareAndSwap(item); err != nil {
+			t.Fatalf("CompareAndSwap returned %v", err)
+		}
+		if err := c.CompareAndSwap(item); !errors.Is(err, cluster.ErrExists) {
+			t.Fatalf("CompareAndSwap with a stale CAS returned %v; want ErrExists", err)
+		}
+		if err := c.Delete("key-1"); err != nil {
+			t.Fatalf("Delete returned %v", err)
+		}
+		if _, err := c.Get("key-1"); !errors.Is(err, cluster.ErrNotFound) {
+			t.Fatalf("Get of a deleted key returned %v; want ErrNotFound", err)
+		}
+		if err := c.Delete("key-1"); !errors.Is(err, cluster.ErrNotFound) {
+			t.Fatalf("Delete of a missing key returned %v; want ErrNotFound", err)
+		}
+	})
+
+	t.Run("counters", func(t *testing.T) {
+		c.Set(&Item{Key: "n", Value: []byte("5")})
+		if n, err := c.Incr("n", 10); err != nil || n != 15 {
+			t.Fatalf("Incr returned %d, %v; want 15", n, err)
+		}
+		if n, err := c.Decr("n", 20); err != nil || n != 0 {
+			t.Fatalf("Decr returned %d, %v; want 0", n, err)
+		}
+		if _, err := c.Incr("key-2", 1); !errors.Is(err, cluster.ErrNotNumber) {
+			t.Fatalf("Incr of a non-number returned %v; want ErrNotNumber", err)
+		}
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		if exptime(1500*time.Millisecond) != 2 || exptime(0) != 0 {
+			t.Fatalf("TTLs must round up to whole seconds")
+		}
+		if abs := exptime(60 * 24 * time.Hour); abs < time.Now().Unix() {
+			t.Fatalf("TTLs over 30 days must be sent as unix times, got %d", abs)
+		}
+	})
+
+	t.Run("malformed keys", func(t *testing.T) {
+		if err := c.Set(&Item{Key: "has space"}); !errors.Is(err, ErrMalformedKey) {
+			t.Fatalf("Set returned %v; want ErrMalformedKey", err)
+		}
+	})
+}
+
+func TestGetMulti(t *testing.T) {
+	addrs, _, _ := startServers(t, 3)
+	c := newClient(addrs)
+	defer c.Close()
+
+	keys := []string{"missing"}
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		c.Set(&Item{Key: key, Value: []byte("val-" + key)})
+		keys = append(keys, key)
+	}
+	items, err := c.GetMulti(keys)
+	if err != nil {
+		t.Fatalf("GetMulti returned %v", err)
+	}
+	if len(items) != 200 {
+		t.Fatalf("GetMulti returned %d items; want 200", len(items))
+	}
+	for key, item := range items {
+		if string(item.Value) != "val-"+key {
+			t.Fatalf("GetMulti(%s) = %q", key, item.Value)
+		}
+	}
+	// more keys than fit on one command line
+	keys = keys[:0]
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("%s-%d", strings.Repeat("k", 100), i)
+		if i%10 == 0 {
+			c.Set(&Item{Key: key, Value: []byte("v")})
+		}
+		keys = append(keys, key)
+	}
+	items, err = c.GetMulti(keys)
+	if err != nil || len(items) != 300 {
+		t.Fatalf("large GetMulti returned %d items, %v; want 300", len(items), err)
+	}
+	for _, line := range getsLines(keys) {
+		if len(line) > maxLineLength {
+			t.Fatalf("gets line of %d bytes", len(line))
+		}
+	}
+
+	if _, err := New(50).GetMulti(keys); !errors.Is(err, ErrNoServers) {
+		t.Fatalf("GetMulti without servers returned %v; want ErrNoServers", err)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	addrs, servers, _ := startServers(t, 3)
+	c := newClient(addrs, WithTimeout(200*time.Millisecond))
+	defer c.Close()
+
+	// find keys owned by the server that goes away
+	dead := addrs[0]
+	var keys []string
+	for i := 0; len(keys) < 20; i++ {
+		if key := fmt.Sprintf("key-%d", i); c.owners(key)[0] == dead {
+			keys = append(keys, key)
+		}
+	}
+	servers[dead].Close()
+
+	for _, key := range keys {
+		if err := c.Set(&Item{Key: key, Value: []byte("v")}); err != nil {
+			t.Fatalf("Set(%s) did not fail over: %v", key, err)
+		}
+	}
+	if owners := c.owners(keys[0]); owners[0] == dead {
+		t.Fatalf("expected the dead server to be tried last, got %v", owners)
+	}
+	items, err := c.GetMulti(keys)
+	if err != nil || len(items) != len(keys) {
+		t.Fatalf("GetMulti returned %d items, %v; want %d", len(items), err, len(keys))
+	}
+
+	t.Run("without failover the error is returned", func(t *testing.T) {
+		c := newClient(addrs, WithFailover(0))
+		defer c.Close()
+		if err := c.Set(&Item{Key: keys[0], Value: []byte("v")}); err == nil {
+			t.Fatalf("expected Set to the dead server to fail")
+		}
+	})
+}
+
+func TestTimeout(t *testing.T) {
+	addrs, _, _ := startServers(t, 2)
+
+	// a server that accepts connections but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	stuck := l.Addr().String()
+
+	c := newClient(append(addrs, stuck), WithTimeout(50*time.Millisecond), WithFailover(2))
+	defer c.Close()
+	var key string
+	for i := 0; ; i++ {
+		if key = fmt.Sprintf("key-%d", i); c.owners(key)[0] == stuck {
+			break
+		}
+	}
+	start := time.Now()
+	if err := c.Set(&Item{Key: key, Value: []byte("v")}); err != nil {
+		t.Fatalf("Set did not fail over from the stuck server: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Set took %v; want about one timeout", elapsed)
+	}
+}
+
+func TestConnectionReuse(t *testing.T) {
+	addrs, _, _ := startServers(t, 1)
+	c := newClient(addrs, WithMaxIdleConns(2))
+	defer c.Close()
+	for i := 0; i < 10; i++ {
+		c.Set(&Item{Key: "k", Value: []byte("v")})
+	}
+	p := c.pools[addrs[0]]
+	if len(p.idle) != 1 {
+		t.Fatalf("pool holds %d idle connections; want 1 reused connection", len(p.idle))
+	}
+	c.Close()
+	if len(p.idle) != 0 {
+		t.Fatalf("Close left %d idle connections", len(p.idle))
+	}
+}
+
+func TestErrorReply(t *testing.T) {
+	// a server that rejects the first command and hangs up, as the server
+	// does after CLIENT_ERROR line too long
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for first := true; ; first = false {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					if _, err := r.ReadString('\n'); err != nil {
+						return
+					}
+					if first {
+						io.WriteString(conn, "SERVER_ERROR out of memory\r\n")
+						return
+					}
+					io.WriteString(conn, "END\r\n")
+				}
+			}()
+		}
+	}()
+	addr := l.Addr().String()
+
+	c := newClient([]string{addr}, WithMaxIdleConns(2))
+	defer c.Close()
+	if _, err := c.Get("k"); err == nil || isIOError(err) {
+		t.Fatalf("Get got %v; want the error reply", err)
+	}
+	if n := len(c.pools[addr].idle); n != 0 {
+		t.Fatalf("pool kept %d connections after an error reply", n)
+	}
+	if _, err := c.Get("k"); !errors.Is(err, cluster.ErrNotFound) {
+		t.Fatalf("Get after an error reply got %v; want ErrNotFound", err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	addrs, _, _ := startServers(t, 3)
+	src := newClient(addrs)
+	defer src.Close()
+	c := newClient(addrs[:1])
+	defer c.Close()
+
+	if err := c.Restore(src.Snapshot()); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if got := c.Servers(); !slices.Equal(got, src.Servers()) {
+		t.Fatalf("servers after Restore %v, want %v", got, src.Servers())
+	}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if err := src.Set(&Item{Key: key, Value: []byte(key)}); err != nil {
+			t.Fatalf("Set(%s): %v", key, err)
+		}
+		if it, err := c.Get(key); err != nil || string(it.Value) != key {
+			t.Fatalf("Get(%s) through restored client: %v", key, err)
+		}
+	}
+
+	old := src.Snapshot()
+	src.RemoveServer(addrs[2])
+	if err := c.Restore(src.Snapshot()); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if got := c.Servers(); !slices.Equal(got, src.Servers()) {
+		t.Fatalf("servers after Restore %v, want %v", got, src.Servers())
+	}
+	if err := c.Restore(old); !errors.Is(err, hashring.ErrStaleSnapshot) {
+		t.Fatalf("Restore of older snapshot got %v, want ErrStaleSnapshot", err)
+	}
+}
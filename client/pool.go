@@ -0,0 +1,179 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cache-ring/cluster"
+)
+
+// conn is one connection to a server.
+type conn struct {
+	nc net.Conn
+	rw *bufio.ReadWriter
+}
+
+// pool keeps idle connections to one server for reuse.
+type pool struct {
+	addr    string
+	maxIdle int
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+func newPool(addr string, maxIdle int) *pool {
+	return &pool{addr: addr, maxIdle: maxIdle}
+}
+
+// get returns an idle connection, or dials a new one within timeout.
+func (p *pool) get(timeout time.Duration) (*conn, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		cn := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return cn, nil
+	}
+	p.mu.Unlock()
+	nc, err := net.DialTimeout("tcp", p.addr, timeout)
+	if err != nil {
+		return nil, &ioError{err}
+	}
+	return &conn{nc: nc, rw: bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))}, nil
+}
+
+// put returns a healthy connection to the pool, or closes it if the pool
+// is full or closed.
+func (p *pool) put(cn *conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || len(p.idle) >= p.maxIdle {
+		cn.nc.Close()
+		return
+	}
+	p.idle = append(p.idle, cn)
+}
+
+// close closes the idle connections. Connections in use are closed when
+// they are put back.
+func (p *pool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, cn := range p.idle {
+		cn.nc.Close()
+	}
+	p.idle = nil
+}
+
+// ioError marks a failure to reach or talk to a server, as opposed to an
+// answer from it. Only these trigger failover.
+type ioError struct {
+	err error
+}
+
+func (e *ioError) Error() string { return "client: " + e.err.Error() }
+func (e *ioError) Unwrap() error { return e.err }
+
+func isIOError(err error) bool {
+	var ioErr *ioError
+	return errors.As(err, &ioErr)
+}
+
+// errMalformed is returned for responses that do not follow the protocol.
+var errMalformed = errors.New("client: malformed response")
+
+// replyError is an ERROR, CLIENT_ERROR or SERVER_ERROR reply. The server may
+// have closed the connection or skipped part of the request after it, so
+// the connection is not reused.
+type replyError struct {
+	line string
+}
+
+func (e *replyError) Error() string { return fmt.Sprintf("client: server replied %q", e.line) }
+
+// send writes a command line, followed by a data block if data is not nil,
+// and flushes it.
+func (cn *conn) send(line string, data []byte) error {
+	cn.rw.WriteString(line)
+	cn.rw.WriteString("\r\n")
+	if data != nil {
+		cn.rw.Write(data)
+		cn.rw.WriteString("\r\n")
+	}
+	if err := cn.rw.Flush(); err != nil {
+		return &ioError{err}
+	}
+	return nil
+}
+
+// readLine reads one response line without its \r\n.
+func (cn *conn) readLine() (string, error) {
+	line, err := cn.rw.ReadString('\n')
+	if err != nil {
+		return "", &ioError{err}
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// readValues reads VALUE blocks up to END and passes each item to fn.
+func (cn *conn) readValues(fn func(*Item)) error {
+	for {
+		line, err := cn.readLine()
+		if err != nil {
+			return err
+		}
+		if line == "END" {
+			return nil
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 || len(fields) > 5 || fields[0] != "VALUE" {
+			return responseError(line)
+		}
+		flags, errFlags := strconv.ParseUint(fields[2], 10, 32)
+		size, errSize := strconv.Atoi(fields[3])
+		var cas uint64
+		var errCAS error
+		if len(fields) == 5 {
+			cas, errCAS = strconv.ParseUint(fields[4], 10, 64)
+		}
+		if errFlags != nil || errSize != nil || errCAS != nil || size < 0 {
+			return errMalformed
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(cn.rw, data); err != nil {
+			return &ioError{err}
+		}
+		if string(data[size:]) != "\r\n" {
+			return errMalformed
+		}
+		fn(&Item{Key: fields[1], Value: data[:size], Flags: uint32(flags), CAS: cas})
+	}
+}
+
+// responseError turns an unexpected response line into an error, mapping
+// the memcached replies that have an equivalent in package cluster.
+func responseError(line string) error {
+	switch {
+	case line == "NOT_STORED":
+		return cluster.ErrNotStored
+	case line == "EXISTS":
+		return cluster.ErrExists
+	case line == "NOT_FOUND":
+		return cluster.ErrNotFound
+	case line == "CLIENT_ERROR cannot increment or decrement non-numeric value":
+		return cluster.ErrNotNumber
+	case line == "ERROR", strings.HasPrefix(line, "CLIENT_ERROR "), strings.HasPrefix(line, "SERVER_ERROR "):
+		return &replyError{line}
+	}
+	return errMalformed
+}
@@ -0,0 +1,191 @@
+package cluster
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+// ErrNoRanges is returned by Repair when keys are not placed by token
+// ranges, because the ring has no tokens or loads are bounded.
+var ErrNoRanges = errors.New("cluster: no token ranges to repair")
+
+// RepairStats reports what an anti-entropy pass did.
+type RepairStats struct {
+	// Ranges is the number of token ranges whose replicas were compared and
+	// Differing the number of them the replicas disagreed on.
+	Ranges, Differing int
+	// Keys is the number of keys in the Merkle leaves that differed, the
+	// only keys read and streamed between replicas.
+	Keys int
+	// Repaired is the number of replica copies written and Bytes their size.
+	Repaired, Bytes int
+}
+
+// Repair runs one anti-entropy pass. For every token range (prev, token] it
+// builds a Merkle tree of the range on each of its replicas, compares the
+// trees and streams only the keys of the leaves that differ. A replica that
+// lacks a key or holds an older version gets the newest one. Replicas that
+// hold different entries at the same version, such as a corrupted copy, get
+// the entry most replicas agree on, the first replica's on a tie. Nodes
+// marked down are left out, their writes come with hinted handoff.
+//
+// A key missing on some replicas is copied back to them: without tombstones
+// a lost write cannot be told from a delete that only reached some replicas.
+func (c *Cluster) Repair() (RepairStats, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	tr, ok := c.ring.(tokenRing)
+	if !ok || c.epsilon > 0 {
+		return RepairStats{}, ErrNoRanges
+	}
+	var stats RepairStats
+	for _, token := range c.ringTokens(tr) {
+		c.repairRange(tr, tr.Predecessor(token), token, &stats)
+	}
+	return stats, nil
+}
+
+// StartRepair runs Repair once per interval in a background goroutine. Call
+// the returned function to stop it; it waits for a running pass to finish.
+func (c *Cluster) StartRepair(interval time.Duration) (stop func()) {
+	return every(interval, func() { c.Repair() })
+}
+
+// ringTokens returns every token on the ring in ascending order. The caller
+// must hold mu.
+func (c *Cluster) ringTokens(tr tokenRing) []uint64 {
+	var tokens []uint64
+	for _, id := range c.ring.Nodes() {
+		tokens = append(tokens, tr.TokensForNode(id)...)
+	}
+	slices.Sort(tokens)
+	return slices.Compact(tokens)
+}
+
+// rangeOwners returns the replicas of the range that ends at token: the
+// first n distinct nodes clockwise from it that are not draining, as
+// lookupReplicas picks them for the keys in the range. The caller must hold
+// mu.
+func (c *Cluster) rangeOwners(tr tokenRing, token uint64) []string {
+	owners := make([]string, 0, c.n)
+	for t := token; ; {
+		if id := tr.OwnerOfToken(t); c.states[id] != StateDraining && !slices.Contains(owners, id) {
+			owners = append(owners, id)
+		}
+		if t = tr.Successor(t); len(owners) == c.n || t == token {
+			return owners
+		}
+	}
+}
+
+// repairRange compares the trees of the range (prev, token] on its healthy
+// replicas and repairs the keys of the leaves that differ. The caller must
+// hold mu.
+func (c *Cluster) repairRange(tr tokenRing, prev, token uint64, stats *RepairStats) {
+	var replicas []*CacheNode
+	for _, id := range c.rangeOwners(tr, token) {
+		if node := c.nodes[id]; node != nil && !c.isDown(id) {
+			replicas = append(replicas, node)
+		}
+	}
+	if len(replicas) < 2 {
+		return
+	}
+	stats.Ranges++
+	trees := make([]*MerkleTree, len(replicas))
+	differing := make(map[int]bool)
+	for i, node := range replicas {
+		trees[i] = node.MerkleTree(prev, token, DefaultMerkleDepth)
+		if i > 0 {
+			for _, leaf := range trees[0].Diff(trees[i]) {
+				differing[leaf] = true
+			}
+		}
+	}
+	if len(differing) == 0 {
+		return
+	}
+	stats.Differing++
+	keys := make(map[string]struct{})
+	for i, node := range replicas {
+		for _, key := range node.leafKeys(trees[i], differing) {
+			keys[key] = struct{}{}
+		}
+	}
+	for key := range keys {
+		copies, bytes := c.repairKey(key, replicas)
+		stats.Keys++
+		stats.Repaired += copies
+		stats.Bytes += bytes
+	}
+}
+
+// repairKey reads key from replicas under the key lock, so a write that
+// finished since the trees were built is not undone, and writes the winning
+// entry to the replicas that differ from it. It returns the number of
+// copies written and their size. The caller must hold mu.
+func (c *Cluster) repairKey(key string, replicas []*CacheNode) (copies, bytes int) {
+	mu := c.keyLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+	entries := make([]entry, len(replicas))
+	found := make([]bool, len(replicas))
+	for i, node := range replicas {
+		entries[i], found[i] = node.get(key)
+	}
+	best, ok := winner(entries, found)
+	if !ok {
+		return 0, 0
+	}
+	for i, node := range replicas {
+		if found[i] && entries[i].same(best) {
+			continue
+		}
+		if node.overwrite(key, best) {
+			copies++
+			bytes += best.size(key)
+		}
+	}
+	return copies, bytes
+}
+
+// winner returns the entry with the highest version among the found ones.
+// Of different entries at that version it picks the one found most often,
+// the first on a tie. ok is false if no entry was found.
+func winner(entries []entry, found []bool) (best entry, ok bool) {
+	votes := 0
+	for i, e := range entries {
+		if !found[i] || (ok && e.version < best.version) {
+			continue
+		}
+		n := 0
+		for j, other := range entries {
+			if found[j] && other.same(e) {
+				n++
+			}
+		}
+		if !ok || e.version > best.version || n > votes {
+			best, votes, ok = e, n, true
+		}
+	}
+	return best, ok
+}
+
+// same reports whether e and other are the same write.
+func (e entry) same(other entry) bool {
+	return e.version == other.version && e.value == other.value &&
+		e.flags == other.flags && e.expires.Equal(other.expires)
+}
+
+// overwrite stores e unless the node holds key at a newer version. Unlike
+// putIfNewer it replaces an entry of the same version, which repairs a copy
+// that differs from the other replicas'. It reports whether e was stored.
+func (n *CacheNode) overwrite(key string, e entry) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if old, exists := n.data[key]; exists && old.version == e.version {
+		n.remove(key)
+	}
+	return n.put(key, e)
+}
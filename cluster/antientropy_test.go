@@ -0,0 +1,146 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRepair(t *testing.T) {
+	const numKeys = 2000
+
+	t.Run("range owners", func(t *testing.T) {
+		c := newTestCluster(t, 20, []string{"A", "B", "C", "D", "E"}, numKeys, WithReplication(3, 2, 2))
+		tr := c.ring.(tokenRing)
+		tokens := c.ringTokens(tr)
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			hash := c.keyHash(key)
+			// the range (prev, token] holding the key ends at the first token
+			// not below its hash
+			token := tokens[0]
+			for _, tok := range tokens {
+				if tok >= hash {
+					token = tok
+					break
+				}
+			}
+			got, want := c.rangeOwners(tr, token), c.LookupReplicas(key)
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("range of %s owned by %v, want %v", key, got, want)
+			}
+		}
+	})
+
+	t.Run("consistent replicas", func(t *testing.T) {
+		c := newTestCluster(t, 20, []string{"A", "B", "C", "D", "E"}, numKeys, WithReplication(3, 2, 2))
+		stats, err := c.Repair()
+		if err != nil {
+			t.Fatalf("Repair: %v", err)
+		}
+		if stats.Ranges != 100 || stats.Differing != 0 || stats.Keys != 0 {
+			t.Fatalf("repair of consistent replicas %+v", stats)
+		}
+	})
+
+	t.Run("corrupt replica", func(t *testing.T) {
+		c := newTestCluster(t, 20, []string{"A", "B", "C", "D", "E"}, numKeys, WithReplication(3, 2, 2))
+		b := c.nodes["B"]
+		keys := keysOwnedBy(c, "B", 60)
+		for i, key := range keys {
+			e, _ := b.get(key)
+			switch i % 3 {
+			case 0:
+				b.delete(key)
+			case 1:
+				b.overwrite(key, entry{value: "garbage", version: e.version})
+			case 2:
+				b.delete(key)
+				b.putIfNewer(key, entry{value: "stale", version: e.version - 1})
+			}
+		}
+		stats, err := c.Repair()
+		if err != nil {
+			t.Fatalf("Repair: %v", err)
+		}
+		if stats.Differing == 0 || stats.Repaired != len(keys) || stats.Bytes == 0 {
+			t.Fatalf("repair of a corrupt replica %+v", stats)
+		}
+		// only the keys of the differing leaves are streamed
+		if stats.Keys < len(keys) || stats.Keys > numKeys/4 {
+			t.Fatalf("repair compared %d keys for %d corrupt ones", stats.Keys, len(keys))
+		}
+		for _, key := range keys {
+			if it, ok := b.Get(key); !ok || it.Value != "val-"+key {
+				t.Fatalf("B holds %s as %q, %v after repair", key, it.Value, ok)
+			}
+		}
+		checkReplicaPlacement(t, c, numKeys)
+		if stats, _ := c.Repair(); stats.Differing != 0 {
+			t.Fatalf("second repair found differences %+v", stats)
+		}
+	})
+
+	t.Run("majority wins", func(t *testing.T) {
+		c := newTestCluster(t, 20, []string{"A", "B", "C", "D", "E"}, numKeys, WithReplication(3, 2, 2))
+		key := "key-7"
+		owners := c.LookupReplicas(key)
+		e, _ := c.nodes[owners[0]].get(key)
+		// the primary holds a corrupt copy at the current version
+		c.nodes[owners[0]].overwrite(key, entry{value: "garbage", version: e.version})
+		if stats, _ := c.Repair(); stats.Repaired != 1 {
+			t.Fatalf("repair %+v, want one copy", stats)
+		}
+		for _, id := range owners {
+			if it, _ := c.nodes[id].Get(key); it.Value != "val-"+key {
+				t.Fatalf("%s holds %q after repair", id, it.Value)
+			}
+		}
+	})
+
+	t.Run("down nodes are left out", func(t *testing.T) {
+		c := newTestCluster(t, 20, []string{"A", "B", "C", "D", "E"}, numKeys, WithReplication(3, 2, 2))
+		keys := keysOwnedBy(c, "C", 10)
+		for _, key := range keys {
+			c.nodes["C"].delete(key)
+		}
+		c.MarkDown("C")
+		c.Repair()
+		if _, held := c.nodes["C"].Get(keys[0]); held {
+			t.Fatalf("repair wrote to a down node")
+		}
+		c.MarkUp("C")
+		c.Repair()
+		checkReplicaPlacement(t, c, numKeys)
+	})
+
+	t.Run("concurrent writes", func(t *testing.T) {
+		c := newTestCluster(t, 20, []string{"A", "B", "C", "D", "E"}, numKeys, WithReplication(3, 2, 2))
+		stop := c.StartRepair(time.Millisecond)
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := w; i < numKeys; i += 4 {
+					key := fmt.Sprintf("key-%d", i)
+					c.Set(key, "val-"+key)
+					c.Get(key)
+				}
+			}(w)
+		}
+		wg.Wait()
+		stop()
+		checkReplicaPlacement(t, c, numKeys)
+	})
+
+	t.Run("no token ranges", func(t *testing.T) {
+		c := New(20, WithBoundedLoad(0.25))
+		c.AddNode("A")
+		if _, err := c.Repair(); !errors.Is(err, ErrNoRanges) {
+			t.Fatalf("Repair under bounded loads got %v", err)
+		}
+	})
+}
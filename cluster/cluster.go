@@ -1,160 +1,727 @@
 package cluster
 
 import (
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"cache-ring/hashring"
 )
 
-// Cluster wraps a HashRing to manage nodes and key lookups.
+// Cluster wraps a hashring.Ring to manage nodes and key lookups.
+// Each key is stored on the first n distinct nodes clockwise from its hash.
+// A write succeeds once w of those replicas took it and a read needs answers
+// from r of them; replicas that disagree are reconciled by version.
+//
+// A Cluster is safe for concurrent use. Every membership change starts a new
+// ring epoch. Data operations hold mu for reading and so run entirely within
+// one epoch; membership changes hold it for writing until their migration is
+// complete, so no read or write ever observes a half-migrated range. Within
+// an epoch, operations on different nodes only contend on per-node locks.
+// With WithRebalancer, migrations run in the background after the epoch has
+// started instead, and reads fall back to where keys lived before.
 type Cluster struct {
-	ring  *hashring.HashRing
+	mu    sync.RWMutex
+	ring  hashring.Ring
 	nodes map[string]*CacheNode
+	// number of completed membership changes
+	epoch uint64
+	// replication factor and write/read quorums
+	n, w, r int
+	// version handed to the most recent write
+	version atomic.Uint64
+	// load bound for bounded-load hashing; 0 disables it
+	epsilon  float64
+	now      func() time.Time
+	capacity Capacity
+	// serialize writes to the keys of a stripe, see keyLock
+	keyLocks [numKeyLocks]sync.Mutex
+	// moves keys in the background; nil moves them during membership changes
+	rebalance *rebalancer
+	// removed nodes whose keys are still being moved to their new replicas
+	retired     map[string]*CacheNode
+	persistence Persistence
+	// states of the nodes that are not up, see SetNodeState
+	states map[string]NodeState
+	// nil unless writes to down nodes are hinted
+	handoff *HintedHandoff
+	hints   hintCounters
+	// the current or most recent decommission of each node
+	decommissions map[string]*decommission
+}
+
+// numKeyLocks is the number of lock stripes keys are spread over.
+const numKeyLocks = 256
+
+// MigrationStats summarizes the keys moved by a membership change.
+type MigrationStats struct {
+	// Moved counts the key copies written to their new replicas.
+	Moved int
+	// Dropped counts the keys destination nodes evicted because they were full.
+	Dropped int
+}
+
+// Option configures a Cluster.
+type Option func(*Cluster)
+
+// WithReplication stores every key on n distinct nodes. Set succeeds once w
+// replicas took the write and Get needs answers from r replicas. n < 1 is
+// treated as 1 and w and r are clamped to [1, n].
+func WithReplication(n, w, r int) Option {
+	return func(c *Cluster) {
+		c.n = max(n, 1)
+		c.w = min(max(w, 1), c.n)
+		c.r = min(max(r, 1), c.n)
+	}
+}
+
+// WithBoundedLoad enables consistent hashing with bounded loads: a node
+// holding more than (1+epsilon) times the average number of keys is skipped
+// and new keys continue clockwise to the next node. Keys stay where they were
+// placed until the membership changes, at which point every key is placed
+// again under the bound. epsilon <= 0 disables the bound.
+func WithBoundedLoad(epsilon float64) Option {
+	return func(c *Cluster) {
+		c.epsilon = max(epsilon, 0)
+	}
 }
 
-type CacheNode struct {
-	id   string
-	data map[string]string
+// WithClock makes the cluster read the current time from now, which decides
+// when entries written with SetWithTTL expire. The default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(c *Cluster) {
+		c.now = now
+	}
+}
+
+// WithCapacity limits every node to the given capacity. A full node evicts
+// keys with the capacity's policy, both on writes and when a migration moves
+// keys onto it.
+func WithCapacity(capacity Capacity) Option {
+	return func(c *Cluster) {
+		c.capacity = capacity
+	}
+}
+
+// WithRing routes keys with the given ring strategy instead of a
+// hashring.HashRing. The ring must be empty; the cluster adds and removes its
+// nodes. Migrations only touch the affected key ranges on rings that place
+// tokens on a hash circle; other rings re-check every key.
+func WithRing(ring hashring.Ring) Option {
+	return func(c *Cluster) {
+		c.ring = ring
+	}
 }
 
 // New creates a new Cluster with the provided number of virtual node replicas.
-func New(numReplicas int) *Cluster {
-	return &Cluster{
-		ring:  hashring.New(numReplicas),
-		nodes: make(map[string]*CacheNode),
+// By default every key is stored on a single node.
+func New(numReplicas int, opts ...Option) *Cluster {
+	c := &Cluster{
+		nodes:         make(map[string]*CacheNode),
+		retired:       make(map[string]*CacheNode),
+		states:        make(map[string]NodeState),
+		decommissions: make(map[string]*decommission),
+		n:             1,
+		w:             1,
+		r:             1,
+		now:           time.Now,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.ring == nil {
+		c.ring = hashring.New(numReplicas)
 	}
+	return c
 }
 
 // AddNode adds a node identifier to the cluster.
-func (c *Cluster) AddNode(nodeID string) {
-	node := &CacheNode{id: nodeID, data: make(map[string]string)}
+func (c *Cluster) AddNode(nodeID string) MigrationStats {
+	return c.AddNodeWithWeight(nodeID, 1)
+}
+
+// AddNodeWithWeight adds a node that takes weight times the share of a
+// weight 1 node. The weight is ignored if the ring is not a
+// hashring.WeightedRing. Adding an existing node is a no-op.
+func (c *Cluster) AddNodeWithWeight(nodeID string, weight int) MigrationStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.nodes[nodeID]; exists {
+		return MigrationStats{}
+	}
+	node := c.openNode(nodeID)
 	c.nodes[nodeID] = node
-	tokens := c.ring.TokensForNode(nodeID)
-	// If ring is currently empty, just add and return (no keys to migrate).
-	if len(c.ring.Nodes()) == 0 {
+	if wr, ok := c.ring.(hashring.WeightedRing); ok {
+		wr.AddNodeWithWeight(nodeID, weight)
+	} else {
 		c.ring.AddNode(nodeID)
-		return
-	}
-	for _, token := range tokens {
-		succ := c.ring.Successor(token)
-		prev := c.ring.Predecessor(token)
-		fromNode := c.ring.OwnerOfToken(succ)
-		src := c.nodes[fromNode]
-		if src == nil {
-			continue
+	}
+	spans := c.affectedSpans(nodeID, c.nodeTokens(nodeID))
+	if node.Len() > 0 {
+		// the node came back with keys, some of which it may no longer own
+		for _, key := range node.keys(fullRing) {
+			h := c.keyHash(key)
+			spans = append(spans, span{lo: h, hi: h})
 		}
-		for key := range src.data {
-			hash_value := hashring.HashBytes([]byte(key))
-			// handles interval wraps
-			if prev < token {
-				if hash_value > prev && hash_value <= token {
-					c.nodes[nodeID].data[key] = src.data[key]
-					delete(src.data, key)
-				}
-			} else {
-				if hash_value > prev || hash_value <= token {
-					c.nodes[nodeID].data[key] = src.data[key]
-					delete(src.data, key)
-				}
-			}
+		spans = spans.normalize()
+	}
+	stats := c.migrate(spans)
+	c.epoch++
+	return stats
+}
 
+// openNode returns the node for nodeID: the one removed earlier if its keys
+// are still being moved away, or a new node that recovers its keys from disk
+// under persistence. New writes are versioned above every recovered key. A
+// node that fails to open its files runs from memory and reports the error
+// in PersistenceErrors. The caller must hold the write lock.
+func (c *Cluster) openNode(nodeID string) *CacheNode {
+	if node, ok := c.retired[nodeID]; ok {
+		delete(c.retired, nodeID)
+		return node
+	}
+	node := newCacheNode(nodeID, nodeConfig{hash: c.keyHash, now: c.now, capacity: c.capacity, persistence: c.persistence})
+	if c.persistence.enabled() {
+		if err := node.open(); err != nil {
+			node.err = err
+		}
+		// no data operation runs while the write lock is held
+		if node.version > c.version.Load() {
+			c.version.Store(node.version)
 		}
 	}
-	c.ring.AddNode(nodeID)
+	return node
+}
+
+// SetNodeWeight changes the weight of an existing node. Only the keys in the
+// ranges of the tokens that are added or removed are moved.
+// Setting the weight of a missing node, or on a ring that is not a
+// hashring.WeightedRing, is a no-op.
+func (c *Cluster) SetNodeWeight(nodeID string, weight int) MigrationStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wr, ok := c.ring.(hashring.WeightedRing)
+	if !ok {
+		return MigrationStats{}
+	}
+	old := wr.Weight(nodeID)
+	if old == 0 {
+		return MigrationStats{}
+	}
+	if weight <= 0 {
+		weight = 1
+	}
+	if weight == old {
+		return MigrationStats{}
+	}
+	var tokens []uint64
+	if tr, ok := c.ring.(tokenRing); ok {
+		kept := len(tr.TokensForWeight(nodeID, min(old, weight)))
+		tokens = tr.TokensForWeight(nodeID, max(old, weight))[kept:]
+	}
+	var spans spanSet
+	if weight > old {
+		wr.SetWeight(nodeID, weight)
+		spans = c.affectedSpans(nodeID, tokens)
+	} else {
+		spans = c.affectedSpans(nodeID, tokens)
+		wr.SetWeight(nodeID, weight)
+	}
+	stats := c.migrate(spans)
+	c.epoch++
+	return stats
 }
 
 // RemoveNode removes a node identifier from the cluster.
-func (c *Cluster) RemoveNode(nodeID string) {
-	tokens := c.ring.TokensForNode(nodeID)
-	if len(c.ring.Nodes()) == 1 {
-		// we can just remove if it is the only node
-		c.ring.RemoveNode(nodeID)
-		// ensure internal node map is consistent
-		delete(c.nodes, nodeID)
-		return
-	}
-	for _, token := range tokens {
-		succ := c.ring.Successor(token)
-		prev := c.ring.Predecessor(token)
-		// Find the first successor whose owner is not the node being removed.
-		dstToken := succ
-		// Each node's replicas is capped so we should not have an inf loop here
-		for c.ring.OwnerOfToken(dstToken) == nodeID {
-			dstToken = c.ring.Successor(dstToken)
-		}
-		dstNode := c.ring.OwnerOfToken(dstToken)
-		for key := range c.nodes[nodeID].data {
-			hash_value := hashring.HashBytes([]byte(key))
-			if prev < token {
-				if hash_value > prev && hash_value <= token {
-					c.nodes[dstNode].data[key] = c.nodes[nodeID].data[key]
-					delete(c.nodes[nodeID].data, key)
-				}
-			} else {
-				if hash_value > prev || hash_value <= token {
-					c.nodes[dstNode].data[key] = c.nodes[nodeID].data[key]
-					delete(c.nodes[nodeID].data, key)
-				}
-			}
-		}
+// Its keys are handed to the nodes that take over its ranges. Decommission
+// does the same in the background and checks the keys arrived before the
+// node leaves the ring.
+func (c *Cluster) RemoveNode(nodeID string) MigrationStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.nodes[nodeID]; !exists {
+		return MigrationStats{}
 	}
+	spans := c.affectedSpans(nodeID, c.nodeTokens(nodeID))
 	// remove all virtual nodes on the ring
 	c.ring.RemoveNode(nodeID)
-	// remove the node from the nodes map
+	// the node still holds its data, so the migration can copy it out
+	node := c.nodes[nodeID]
+	c.retired[nodeID] = node
 	delete(c.nodes, nodeID)
+	delete(c.states, nodeID)
+	c.rehomeHints(node, false)
+	stats := c.migrate(spans)
+	c.epoch++
+	return stats
+}
+
+// Crash simulates the abrupt loss of a node: its data is dropped without
+// being migrated and the node leaves the ring. The surviving replicas of its
+// keys are then copied to the nodes that take over its ranges, so no data is
+// lost as long as the replication factor is greater than one. Under
+// persistence the node's files are kept, and adding it again recovers them.
+func (c *Cluster) Crash(nodeID string) MigrationStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.nodes[nodeID]; !exists {
+		return MigrationStats{}
+	}
+	spans := c.affectedSpans(nodeID, c.nodeTokens(nodeID))
+	c.ring.RemoveNode(nodeID)
+	// under persistence the node's files survive, as after a real crash
+	node := c.nodes[nodeID]
+	node.Close()
+	delete(c.nodes, nodeID)
+	delete(c.states, nodeID)
+	c.rehomeHints(node, true)
+	stats := c.migrate(spans)
+	c.epoch++
+	return stats
+}
+
+// Epoch returns the number of membership changes the cluster has completed.
+func (c *Cluster) Epoch() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.epoch
 }
 
-// LookupKey returns the node responsible for key. ok is false if the cluster is empty.
-func (c *Cluster) LookupKey(key string) (nodeID string, ok bool) { return c.ring.GetNode(key) }
+// LookupKey returns the node responsible for key: its first replica that is
+// not down. Under a load bound this is where Set places the key, which may
+// not be its node on the ring. ok is false if the cluster is empty or every
+// replica is down.
+func (c *Cluster) LookupKey(key string) (nodeID string, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.states) == 0 && c.epsilon == 0 {
+		return c.ring.GetNode(key)
+	}
+	return c.primary(c.replicasFor(key))
+}
+
+// primary returns the first of owners that is not down. ok is false if
+// all of them are down, and nodeID the first of them. The caller must hold
+// mu.
+func (c *Cluster) primary(owners []string) (nodeID string, ok bool) {
+	for _, id := range owners {
+		if !c.isDown(id) {
+			return id, true
+		}
+	}
+	if len(owners) == 0 {
+		return "", false
+	}
+	return owners[0], false
+}
+
+// LookupReplicas returns the nodes that store key, primary first. Down
+// nodes keep their place; draining nodes are skipped.
+func (c *Cluster) LookupReplicas(key string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lookupReplicas(key)
+}
+
+func (c *Cluster) lookupReplicas(key string) []string {
+	if draining := c.draining(); draining > 0 {
+		return c.withoutDraining(c.ring.GetNodes(key, c.n+draining), c.n)
+	}
+	return c.ring.GetNodes(key, c.n)
+}
+
+// RingSnapshot returns the layout of the cluster's ring, for hashring.Diff.
+// ok is false if the ring is not a hashring.HashRing and has no tokens to
+// snapshot.
+func (c *Cluster) RingSnapshot() (s *hashring.Snapshot, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	r, ok := c.ring.(*hashring.HashRing)
+	if !ok {
+		return nil, false
+	}
+	return r.Snapshot(), true
+}
+
+// Node returns the node nodeID, for inspecting or tampering with one replica
+// directly. ok is false if the node is not in the cluster.
+func (c *Cluster) Node(nodeID string) (node *CacheNode, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	node, ok = c.nodes[nodeID]
+	return node, ok
+}
 
 // ListNodes returns all nodes in stable order.
-func (c *Cluster) ListNodes() []string { return c.ring.Nodes() }
+func (c *Cluster) ListNodes() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ring.Nodes()
+}
+
+// replicasFor returns the nodes that store key, primary first. Without a
+// load bound these are the LookupReplicas. With one, the nodes along the
+// key's walk that already hold it come first, followed by the next nodes
+// that are below capacity. The caller must hold mu.
+func (c *Cluster) replicasFor(key string) []string {
+	if c.epsilon == 0 {
+		return c.lookupReplicas(key)
+	}
+	walk := c.withoutDraining(c.ring.GetNodes(key, len(c.nodes)), len(c.nodes))
+	want := min(c.n, len(walk))
+	owners := make([]string, 0, want)
+	for _, id := range walk {
+		if _, held := c.nodes[id].get(key); held && len(owners) < want {
+			owners = append(owners, id)
+		}
+	}
+	if len(owners) == want {
+		return owners
+	}
+	counts := c.keyCounts()
+	total := want
+	for _, count := range counts {
+		total += count
+	}
+	capacity := hashring.BoundedCapacity(total, len(walk), c.epsilon)
+	return fillBelowCapacity(owners, walk, want, counts, capacity)
+}
+
+// fillBelowCapacity appends to owners, in walk order, the nodes whose load is
+// below capacity until owners holds want nodes. If too few nodes are below
+// capacity, the remaining nodes of the walk are used.
+func fillBelowCapacity(owners, walk []string, want int, loads map[string]int, capacity int) []string {
+	for _, full := range []bool{false, true} {
+		for _, id := range walk {
+			if len(owners) < want && !slices.Contains(owners, id) && (full || loads[id] < capacity) {
+				owners = append(owners, id)
+			}
+		}
+	}
+	return owners
+}
 
 // Cache operations
+
+// Set writes value to every replica of key and returns the primary replica.
+// ok is false if the cluster is empty or fewer than the write quorum of
+// replicas took the write. The quorum is capped at the number of nodes.
 func (c *Cluster) Set(key, value string) (nodeID string, ok bool) {
-	nodeID, ok = c.LookupKey(key)
-	if !ok {
+	return c.SetWithTTL(key, value, 0)
+}
+
+// SetWithTTL is like Set, but the key expires once ttl has passed. Expired
+// keys are invisible to Get and are removed on access or by the sweeper.
+// A ttl <= 0 means the key never expires.
+func (c *Cluster) SetWithTTL(key, value string, ttl time.Duration) (nodeID string, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	owners := c.replicasFor(key)
+	if len(owners) == 0 {
 		return "", false
 	}
-	node := c.nodes[nodeID]
-	if node == nil {
+	mu := c.keyLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	e := entry{value: value, version: c.version.Add(1), expires: c.expiry(ttl)}
+	if c.writeReplicas(key, e, owners) < min(c.w, len(owners)) {
 		return "", false
 	}
-	node.data[key] = value
+	// with hinted handoff the write may succeed while every owner is down
+	nodeID, _ = c.primary(owners)
 	return nodeID, true
 }
 
+// expiry returns the expiration time of an entry written now with ttl, or
+// the zero time if ttl <= 0.
+func (c *Cluster) expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return c.now().Add(ttl)
+}
+
+// keyLock returns the lock that serializes writes to key. Writers hold it
+// while they read and write the replicas, which makes conditional updates
+// atomic and keeps read repair from undoing a concurrent delete. It is
+// taken while holding mu for reading.
+func (c *Cluster) keyLock(key string) *sync.Mutex {
+	return &c.keyLocks[c.keyHash(key)%numKeyLocks]
+}
+
+// writeReplicas stores e on every owner of key and returns the number of
+// replicas that took it. A down owner counts if another node took the
+// write as a hint for it. The caller must hold mu.
+func (c *Cluster) writeReplicas(key string, e entry, owners []string) int {
+	acks := 0
+	for _, id := range owners {
+		node := c.nodes[id]
+		if node == nil {
+			continue
+		}
+		if c.isDown(id) {
+			if c.hintFor(key, hint{entry: e}, id, owners) {
+				acks++
+			}
+			continue
+		}
+		node.putIfNewer(key, e)
+		acks++
+	}
+	return acks
+}
+
+// readReplicas returns the newest entry of key among owners and the node
+// holding it, or "" if no replica holds the key. A key in a range the
+// rebalancer has yet to move is looked up on its previous holders too.
+// answers is the number of replicas that answered and stale reports whether
+// any of them is missing the newest entry. The caller must hold mu.
+func (c *Cluster) readReplicas(key string, owners []string) (best entry, bestNode string, answers int, stale bool) {
+	versions := make([]uint64, 0, len(owners))
+	for _, id := range owners {
+		node := c.nodes[id]
+		if node == nil || c.isDown(id) {
+			continue
+		}
+		answers++
+		e, exists := node.get(key)
+		if !exists {
+			versions = append(versions, 0)
+			continue
+		}
+		versions = append(versions, e.version)
+		if bestNode == "" || e.version > best.version {
+			best, bestNode = e, id
+		}
+	}
+	for _, v := range versions {
+		stale = stale || (bestNode != "" && v != best.version)
+	}
+	if bestNode == "" && c.unsettled(key) {
+		// the key may not have been moved to its new replicas yet; leave
+		// moving it to the rebalancer
+		best, bestNode = c.previous(key, owners)
+	}
+	return best, bestNode, answers, stale
+}
+
+// repair copies the newest entry of key to the owners that are missing it.
+// It reads the replicas again under the key lock, so a write or delete that
+// finished since the caller's read is not undone. It returns the entry after
+// the repair. The caller must hold mu.
+func (c *Cluster) repair(key string, owners []string) (best entry, bestNode string) {
+	mu := c.keyLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+	best, bestNode, _, stale := c.readReplicas(key, owners)
+	if stale {
+		c.writeReplicas(key, best, owners)
+	}
+	return best, bestNode
+}
+
+// Get reads key from its replicas and returns the value with the highest
+// version together with the node that holds it. Replicas that are missing the
+// key or hold an older version are repaired. ok is false if the key is absent
+// or fewer than the read quorum of replicas answered.
 func (c *Cluster) Get(key string) (value string, nodeID string, ok bool) {
-	nodeID, ok = c.LookupKey(key)
+	e, nodeID, ok := c.get(key)
+	return e.value, nodeID, ok
+}
+
+// get implements Get and returns the whole entry.
+func (c *Cluster) get(key string) (e entry, nodeID string, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	owners := c.replicasFor(key)
+	if len(owners) == 0 {
+		return entry{}, "", false
+	}
+	best, bestNode, answers, stale := c.readReplicas(key, owners)
+	if answers < min(c.r, len(owners)) || bestNode == "" {
+		return entry{}, owners[0], false
+	}
+	if stale {
+		best, bestNode = c.repair(key, owners)
+		if bestNode == "" {
+			return entry{}, owners[0], false
+		}
+	}
+	return best, bestNode, true
+}
+
+// SetBytes is like Set for binary values. Values are stored immutably, so
+// value is copied and the caller may reuse it afterwards.
+func (c *Cluster) SetBytes(key string, value []byte) (nodeID string, ok bool) {
+	return c.SetWithTTL(key, string(value), 0)
+}
+
+// SetBytesWithTTL is like SetWithTTL for binary values. value is copied.
+func (c *Cluster) SetBytesWithTTL(key string, value []byte, ttl time.Duration) (nodeID string, ok bool) {
+	return c.SetWithTTL(key, string(value), ttl)
+}
+
+// GetBytes is like Get for binary values. The returned slice is a fresh copy
+// that the caller may modify without affecting the cached value.
+func (c *Cluster) GetBytes(key string) (value []byte, nodeID string, ok bool) {
+	v, nodeID, ok := c.Get(key)
 	if !ok {
-		return "", "", false
+		return nil, nodeID, false
 	}
-	node := c.nodes[nodeID]
-	if node == nil {
-		return "", nodeID, false
+	return []byte(v), nodeID, true
+}
+
+// StartSweeper removes expired keys from every node once per interval in a
+// background goroutine, so keys that are never read again do not linger.
+// Call the returned function to stop the sweeper; it waits for a running
+// sweep to finish.
+func (c *Cluster) StartSweeper(interval time.Duration) (stop func()) {
+	return every(interval, func() { c.sweep() })
+}
+
+// every calls fn once per interval in a background goroutine until the
+// returned function is called, which waits for a running call to finish.
+func every(interval time.Duration, fn func()) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
 	}
-	val, exists := node.data[key]
-	if !exists {
-		return "", nodeID, false
+}
+
+// sweep removes expired keys from every node and returns how many it removed.
+func (c *Cluster) sweep() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	removed := 0
+	for _, node := range c.nodes {
+		removed += node.sweep()
 	}
-	return val, nodeID, true
+	c.expireHints()
+	return removed
 }
 
 // Introspection / stats
-// nodeID -> #keys stored
+// nodeID -> #keys stored, counting every replica
 func (c *Cluster) KeyCounts() map[string]int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.keyCounts()
+}
+
+func (c *Cluster) keyCounts() map[string]int {
+	counts := make(map[string]int)
+	for nodeID, node := range c.nodes {
+		counts[nodeID] = node.Len()
+	}
+	return counts
+}
+
+// nodeID -> #keys evicted because the node was full
+func (c *Cluster) EvictionCounts() map[string]int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.evictionCounts()
+}
+
+func (c *Cluster) evictionCounts() map[string]int {
 	counts := make(map[string]int)
 	for nodeID, node := range c.nodes {
-		counts[nodeID] = len(node.data)
+		counts[nodeID] = node.Evictions()
 	}
 	return counts
 }
 
-// key -> nodeID
+// NodeLoad is the number of keys a node stores and, under bounded loads, the
+// most it may hold before new keys skip it.
+type NodeLoad struct {
+	Keys     int
+	Capacity int
+}
+
+// Loads reports the current load of every node from KeyCounts. Capacity is 0
+// when the cluster does not bound loads.
+func (c *Cluster) Loads() map[string]NodeLoad {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	counts := c.keyCounts()
+	capacity := 0
+	if c.epsilon > 0 {
+		total := 0
+		for _, count := range counts {
+			total += count
+		}
+		capacity = hashring.BoundedCapacity(total, len(counts), c.epsilon)
+	}
+	loads := make(map[string]NodeLoad, len(counts))
+	for nodeID, count := range counts {
+		loads[nodeID] = NodeLoad{Keys: count, Capacity: capacity}
+	}
+	return loads
+}
+
+// key -> nodeID of the first replica that holds it
 func (c *Cluster) SnapshotKeyOwners() map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	owners := make(map[string]string)
-	for nodeID, node := range c.nodes {
-		for key := range node.data {
-			owners[key] = nodeID
+	for key, holders := range c.snapshotKeyReplicas() {
+		owners[key] = holders[0]
+		for _, id := range c.lookupReplicas(key) {
+			if slices.Contains(holders, id) {
+				owners[key] = id
+				break
+			}
 		}
 	}
 	return owners
 }
+
+// key -> sorted nodeIDs of every replica that holds it
+func (c *Cluster) SnapshotKeyReplicas() map[string][]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.snapshotKeyReplicas()
+}
+
+func (c *Cluster) snapshotKeyReplicas() map[string][]string {
+	replicas := make(map[string][]string)
+	for nodeID, node := range c.nodes {
+		for _, key := range node.keys(fullRing) {
+			replicas[key] = append(replicas[key], nodeID)
+		}
+	}
+	for _, holders := range replicas {
+		sort.Strings(holders)
+	}
+	return replicas
+}
@@ -3,7 +3,11 @@ package cluster
 import (
 	"cache-ring/hashring"
 	"fmt"
+	"slices"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestClusterAddAndRemoveNode(t *testing.T) {
@@ -64,28 +68,29 @@ func TestRemoveNodeMigratesKeysToSuccessors(t *testing.T) {
 	expectedDest := make(map[string]string) // for keys that were on B
 	originalOwner := make(map[string]string)
 
+	ring := c.ring.(*hashring.HashRing)
 	// Helper to compute the destination node (pre-removal) for a key that belongs to removed node.
 	computeExpectedDest := func(key string, removedNode string) string {
 		hashValue := hashring.HashBytes([]byte(key))
-		for _, token := range c.ring.TokensForNode(removedNode) {
-			prev := c.ring.Predecessor(token)
+		for _, token := range ring.TokensForNode(removedNode) {
+			prev := ring.Predecessor(token)
 			if prev < token {
 				if hashValue > prev && hashValue <= token {
-					succ := c.ring.Successor(token)
-					owner := c.ring.OwnerOfToken(succ)
+					succ := ring.Successor(token)
+					owner := ring.OwnerOfToken(succ)
 					for owner == removedNode {
-						succ = c.ring.Successor(succ)
-						owner = c.ring.OwnerOfToken(succ)
+						succ = ring.Successor(succ)
+						owner = ring.OwnerOfToken(succ)
 					}
 					return owner
 				}
 			} else {
 				if hashValue > prev || hashValue <= token {
-					succ := c.ring.Successor(token)
-					owner := c.ring.OwnerOfToken(succ)
+					succ := ring.Successor(token)
+					owner := ring.OwnerOfToken(succ)
 					for owner == removedNode {
-						succ = c.ring.Successor(succ)
-						owner = c.ring.OwnerOfToken(succ)
+						succ = ring.Successor(succ)
+						owner = ring.OwnerOfToken(succ)
 					}
 					return owner
 				}
@@ -177,3 +182,690 @@ func TestRemoveNodeMigratesKeysToSuccessors(t *testing.T) {
 		}
 	}
 }
+
+func TestSetNodeWeightMovesOnlyAffectedKeys(t *testing.T) {
+	c := New(10)
+	c.AddNode("A")
+	c.AddNode("B")
+	c.AddNode("C")
+
+	const numKeys = 2000
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		c.Set(key, "val-"+key)
+	}
+
+	before := c.SnapshotKeyOwners()
+	c.SetNodeWeight("B", 3)
+	after := c.SnapshotKeyOwners()
+
+	if len(after) != numKeys {
+		t.Fatalf("expected %d keys after raising weight, got %d", numKeys, len(after))
+	}
+	for key, owner := range after {
+		want, ok := c.LookupKey(key)
+		if !ok || owner != want {
+			t.Fatalf("key %q stored on %q but routes to %q", key, owner, want)
+		}
+		// Raising B's weight may only move keys onto B.
+		if owner != before[key] && owner != "B" {
+			t.Fatalf("key %q moved from %q to %q; only moves to B expected", key, before[key], owner)
+		}
+	}
+	if c.KeyCounts()["B"] <= numKeys/3 {
+		t.Fatalf("expected B to hold more than a third of keys after raising weight, got %d", c.KeyCounts()["B"])
+	}
+
+	before = after
+	c.SetNodeWeight("B", 1)
+	after = c.SnapshotKeyOwners()
+	for key, owner := range after {
+		want, ok := c.LookupKey(key)
+		if !ok || owner != want {
+			t.Fatalf("key %q stored on %q but routes to %q", key, owner, want)
+		}
+		// Lowering B's weight may only move keys off B.
+		if owner != before[key] && before[key] != "B" {
+			t.Fatalf("key %q moved from %q to %q; only moves off B expected", key, before[key], owner)
+		}
+		if val, _, ok := c.Get(key); !ok || val != "val-"+key {
+			t.Fatalf("Get(%q) = (%q, %v); want (val-%s, true)", key, val, ok, key)
+		}
+	}
+}
+
+// newTestCluster returns a cluster of nodeIDs with numReplicas virtual nodes
+// each and the given options, holding numKeys keys "key-<i>" set to
+// "val-key-<i>", the values checkReplicaPlacement expects.
+func newTestCluster(t *testing.T, numReplicas int, nodeIDs []string, numKeys int, opts ...Option) *Cluster {
+	t.Helper()
+	c := New(numReplicas, opts...)
+	for _, id := range nodeIDs {
+		c.AddNode(id)
+	}
+	// a background rebalancer settles the new nodes first
+	c.WaitRebalance()
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if _, ok := c.Set(key, "val-"+key); !ok {
+			t.Fatalf("Set(%s) failed", key)
+		}
+	}
+	return c
+}
+
+// checkReplicaPlacement fails the test unless every key is stored on exactly
+// its current replica set with the expected value.
+func checkReplicaPlacement(t *testing.T, c *Cluster, numKeys int) {
+	t.Helper()
+	replicas := c.SnapshotKeyReplicas()
+	if len(replicas) != numKeys {
+		t.Fatalf("expected %d keys in the cluster, got %d", numKeys, len(replicas))
+	}
+	for key, holders := range replicas {
+		want := c.LookupReplicas(key)
+		sort.Strings(want)
+		if !slices.Equal(holders, want) {
+			t.Fatalf("key %q stored on %v; want %v", key, holders, want)
+		}
+		if val, _, ok := c.Get(key); !ok || val != "val-"+key {
+			t.Fatalf("Get(%q) = (%q, %v); want (val-%s, true)", key, val, ok, key)
+		}
+	}
+}
+
+func TestReplicationSurvivesNodeLoss(t *testing.T) {
+	const numKeys = 500
+	c := newTestCluster(t, 10, []string{"A", "B", "C", "D", "E"}, numKeys, WithReplication(3, 2, 2))
+	checkReplicaPlacement(t, c, numKeys)
+
+	t.Run("adding a node keeps three replicas", func(t *testing.T) {
+		c.AddNode("F")
+		checkReplicaPlacement(t, c, numKeys)
+	})
+
+	t.Run("crash does not lose data", func(t *testing.T) {
+		c.Crash("B")
+		if _, exists := c.nodes["B"]; exists {
+			t.Fatalf("expected crashed node to be gone")
+		}
+		checkReplicaPlacement(t, c, numKeys)
+	})
+
+	t.Run("remove does not lose data", func(t *testing.T) {
+		c.RemoveNode("D")
+		checkReplicaPlacement(t, c, numKeys)
+	})
+
+	t.Run("weight change keeps three replicas", func(t *testing.T) {
+		c.SetNodeWeight("A", 3)
+		checkReplicaPlacement(t, c, numKeys)
+		c.SetNodeWeight("A", 1)
+		checkReplicaPlacement(t, c, numKeys)
+	})
+}
+
+func TestGetReconcilesReplicas(t *testing.T) {
+	c := New(10, WithReplication(3, 3, 3))
+	c.AddNode("A")
+	c.AddNode("B")
+	c.AddNode("C")
+
+	c.Set("k", "v1")
+	c.Set("k", "v2")
+	owners := c.LookupReplicas("k")
+	// Simulate a replica that missed the second write and one that lost the key.
+	c.nodes[owners[0]].data["k"] = entry{value: "v1", version: 1}
+	c.nodes[owners[1]].delete("k")
+
+	val, nodeID, ok := c.Get("k")
+	if !ok || val != "v2" || nodeID != owners[2] {
+		t.Fatalf("Get(k) = (%q, %q, %v); want (v2, %s, true)", val, nodeID, ok, owners[2])
+	}
+	for _, id := range owners {
+		if e := c.nodes[id].data["k"]; e.value != "v2" {
+			t.Fatalf("replica %s not repaired: holds %q", id, e.value)
+		}
+	}
+}
+
+func TestClusterWithRingStrategies(t *testing.T) {
+	strategies := map[string]func() hashring.Ring{
+		"jump":       func() hashring.Ring { return hashring.NewJump() },
+		"maglev":     func() hashring.Ring { return hashring.NewMaglev(1009) },
+		"rendezvous": func() hashring.Ring { return hashring.NewRendezvous() },
+	}
+	for name, newRing := range strategies {
+		t.Run(name, func(t *testing.T) {
+			const numKeys = 300
+			c := newTestCluster(t, 0, []string{"A", "B", "C", "D"}, numKeys, WithRing(newRing()), WithReplication(2, 1, 1))
+			checkReplicaPlacement(t, c, numKeys)
+			c.AddNode("E")
+			checkReplicaPlacement(t, c, numKeys)
+			c.RemoveNode("B")
+			checkReplicaPlacement(t, c, numKeys)
+		})
+	}
+}
+
+func TestRendezvousClusterWeights(t *testing.T) {
+	c := New(0, WithRing(hashring.NewRendezvous()))
+	c.AddNode("A")
+	c.AddNodeWithWeight("B", 3)
+
+	const numKeys = 1000
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		c.Set(key, "val-"+key)
+	}
+	if got := c.KeyCounts()["B"]; got < numKeys*3/4*9/10 {
+		t.Fatalf("B holds %d keys; want about %d", got, numKeys*3/4)
+	}
+	c.SetNodeWeight("B", 1)
+	checkReplicaPlacement(t, c, numKeys)
+	if got := c.KeyCounts()["B"]; got > numKeys/2*11/10 {
+		t.Fatalf("B holds %d keys after lowering weight; want about %d", got, numKeys/2)
+	}
+}
+
+func TestBoundedLoad(t *testing.T) {
+	const epsilon = 0.25
+	c := New(10, WithBoundedLoad(epsilon))
+	c.AddNode("A")
+	c.AddNode("B")
+	c.AddNode("C")
+
+	// A hot range: every key naturally belongs to A.
+	const numKeys = 300
+	for i := 0; len(c.SnapshotKeyOwners()) < numKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if owner, _ := c.ring.GetNode(key); owner == "A" {
+			if _, ok := c.Set(key, "val-"+key); !ok {
+				t.Fatalf("Set failed for %q", key)
+			}
+		}
+	}
+
+	checkBounded := func(t *testing.T) {
+		t.Helper()
+		loads := c.Loads()
+		for nodeID, load := range loads {
+			if load.Capacity == 0 {
+				t.Fatalf("expected a capacity for %s under bounded loads", nodeID)
+			}
+			// new keys may push a node one past the capacity computed for the old total
+			if load.Keys > load.Capacity+1 {
+				t.Fatalf("node %s holds %d keys; capacity %d", nodeID, load.Keys, load.Capacity)
+			}
+		}
+		for key, owner := range c.SnapshotKeyOwners() {
+			if val, nodeID, ok := c.Get(key); !ok || val != "val-"+key || nodeID != owner {
+				t.Fatalf("Get(%q) = (%q, %q, %v); want (val-%s, %s, true)", key, val, nodeID, ok, key, owner)
+			}
+			if nodeID, ok := c.LookupKey(key); !ok || nodeID != owner {
+				t.Fatalf("LookupKey(%q) = (%q, %v); want the holder %s", key, nodeID, ok, owner)
+			}
+		}
+	}
+
+	checkBounded(t)
+	if got := c.KeyCounts()["A"]; got >= numKeys {
+		t.Fatalf("expected overflow away from A, but A holds %d keys", got)
+	}
+
+	c.AddNode("D")
+	checkBounded(t)
+	c.RemoveNode("B")
+	checkBounded(t)
+	if got := len(c.SnapshotKeyOwners()); got != numKeys {
+		t.Fatalf("expected %d keys after membership changes, got %d", numKeys, got)
+	}
+}
+
+func TestClusterWithCustomHasher(t *testing.T) {
+	hashers := map[string]hashring.Hasher{
+		"fnv1a":   hashring.FNV1a,
+		"murmur3": hashring.Murmur3,
+		"siphash": hashring.NewSipHash([16]byte{1, 2, 3}),
+	}
+	for name, h := range hashers {
+		t.Run(name, func(t *testing.T) {
+			const numKeys = 300
+			c := newTestCluster(t, 0, []string{"A", "B", "C"}, numKeys,
+				WithRing(hashring.New(10, hashring.WithHasher(h))), WithReplication(2, 1, 1))
+			// Migration only scans the ranges next to changed tokens, so it
+			// must measure keys with the same hasher as the ring.
+			c.AddNode("D")
+			checkReplicaPlacement(t, c, numKeys)
+			c.RemoveNode("A")
+			checkReplicaPlacement(t, c, numKeys)
+		})
+	}
+}
+
+func TestClusterKetamaRouting(t *testing.T) {
+	c := New(0, WithRing(hashring.New(0, hashring.WithKetama())))
+	c.AddNode("10.0.1.1:11211")
+	c.AddNode("10.0.1.2:11211")
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		c.Set(key, "val-"+key)
+	}
+	c.AddNode("10.0.1.3:11211")
+
+	// Keys must sit where a libketama client would look for them.
+	for key, want := range map[string]string{"foo": "10.0.1.2:11211", "user:1": "10.0.1.1:11211", "ketama": "10.0.1.3:11211"} {
+		if nodeID, ok := c.Set(key, "val-"+key); !ok || nodeID != want {
+			t.Fatalf("Set(%q) routed to (%s, %v); want %s", key, nodeID, ok, want)
+		}
+	}
+	checkReplicaPlacement(t, c, 203)
+}
+
+func TestConcurrentSetGetDuringRebalancing(t *testing.T) {
+	for _, n := range []int{1, 2} {
+		t.Run(fmt.Sprintf("replication %d", n), func(t *testing.T) {
+			c := New(10, WithReplication(n, n, 1))
+			for _, id := range []string{"A", "B", "C"} {
+				c.AddNode(id)
+			}
+
+			const writers, keysPerWriter, rounds = 8, 40, 10
+			stop := make(chan struct{})
+			var members sync.WaitGroup
+			members.Add(1)
+			go func() {
+				defer members.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					id := fmt.Sprintf("X%d", i%3)
+					c.AddNode(id)
+					c.SetNodeWeight("A", 1+i%3)
+					c.RemoveNode(id)
+				}
+			}()
+
+			var wg sync.WaitGroup
+			errs := make(chan error, writers)
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for round := 0; round < rounds; round++ {
+						for i := 0; i < keysPerWriter; i++ {
+							key := fmt.Sprintf("w%d-key-%d", w, i)
+							want := fmt.Sprintf("%s-round-%d", key, round)
+							if _, ok := c.Set(key, want); !ok {
+								errs <- fmt.Errorf("Set(%q) failed", key)
+								return
+							}
+							// Only this goroutine writes key, so it must read its own write.
+							if val, _, ok := c.Get(key); !ok || val != want {
+								errs <- fmt.Errorf("Get(%q) = (%q, %v); want (%q, true)", key, val, ok, want)
+								return
+							}
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+			close(stop)
+			members.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+
+			replicas := c.SnapshotKeyReplicas()
+			if got, want := len(replicas), writers*keysPerWriter; got != want {
+				t.Fatalf("expected %d keys after rebalancing, got %d", want, got)
+			}
+			for key, holders := range replicas {
+				want := c.LookupReplicas(key)
+				sort.Strings(want)
+				if !slices.Equal(holders, want) {
+					t.Fatalf("key %q stored on %v; want %v", key, holders, want)
+				}
+				if val, _, ok := c.Get(key); !ok || val != fmt.Sprintf("%s-round-%d", key, rounds-1) {
+					t.Fatalf("Get(%q) = (%q, %v); want last round", key, val, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentWritesToOneKeyConverge(t *testing.T) {
+	c := New(10, WithReplication(3, 3, 1))
+	for _, id := range []string{"A", "B", "C", "D"} {
+		c.AddNode(id)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				c.Set("hot", fmt.Sprintf("w%d-%d", w, i))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	var first entry
+	for i, id := range c.LookupReplicas("hot") {
+		e := c.nodes[id].data["hot"]
+		if i == 0 {
+			first = e
+		} else if e != first {
+			t.Fatalf("replica %s holds %+v; replica 0 holds %+v", id, e, first)
+		}
+	}
+	if first.version != c.version.Load() {
+		t.Fatalf("replicas hold version %d; last write was %d", first.version, c.version.Load())
+	}
+}
+
+// benchmarkCluster returns a single-node cluster holding numKeys keys and the
+// key ranges a second node with 100 virtual nodes would take over.
+func benchmarkCluster(b *testing.B, numKeys int) (*Cluster, spanSet) {
+	b.Helper()
+	c := New(100)
+	c.AddNode("A")
+	for i := 0; i < numKeys; i++ {
+		c.Set(fmt.Sprintf("key-%d", i), "value")
+	}
+	ring := c.ring.(*hashring.HashRing)
+	ring.AddNode("B")
+	spans := c.affectedSpans("B", ring.TokensForNode("B"))
+	ring.RemoveNode("B")
+	return c, spans
+}
+
+func BenchmarkMigrationScan(b *testing.B) {
+	const numKeys = 200000
+	c, spans := benchmarkCluster(b, numKeys)
+	node := c.nodes["A"]
+	tokens := c.ring.(*hashring.HashRing).TokensForNode("B")
+
+	b.Run("index range scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			node.keys(spans)
+		}
+	})
+	b.Run("full scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var keys []string
+			for key := range node.data {
+				if spans.contains(c.keyHash(key)) {
+					keys = append(keys, key)
+				}
+			}
+		}
+	})
+	// The original migration walked every key once per virtual token.
+	b.Run("full scan per token", func(b *testing.B) {
+		ring := c.ring.(*hashring.HashRing)
+		ring.AddNode("B")
+		defer ring.RemoveNode("B")
+		for i := 0; i < b.N; i++ {
+			var keys []string
+			for _, token := range tokens {
+				prev := ring.Predecessor(token)
+				for key := range node.data {
+					if hash := c.keyHash(key); (prev < token && hash > prev && hash <= token) ||
+						(prev >= token && (hash > prev || hash <= token)) {
+						keys = append(keys, key)
+					}
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkAddRemoveNode(b *testing.B) {
+	c, _ := benchmarkCluster(b, 200000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.AddNode("B")
+		c.RemoveNode("B")
+	}
+}
+
+// fakeClock is a manually advanced clock that is safe for concurrent use.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+func TestSetWithTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	c := New(10, WithClock(clock.Now), WithReplication(2, 2, 1))
+	c.AddNode("A")
+	c.AddNode("B")
+	c.AddNode("C")
+
+	t.Run("expired keys are invisible and removed on access", func(t *testing.T) {
+		c.SetWithTTL("short", "v", 10*time.Second)
+		c.Set("forever", "v")
+		if _, _, ok := c.Get("short"); !ok {
+			t.Fatalf("expected short to be readable before its TTL")
+		}
+		clock.Advance(10 * time.Second)
+		if val, _, ok := c.Get("short"); ok {
+			t.Fatalf("expected short to be expired, got %q", val)
+		}
+		for _, id := range c.LookupReplicas("short") {
+			if _, exists := c.nodes[id].data["short"]; exists {
+				t.Fatalf("expired key still stored on %s after access", id)
+			}
+		}
+		if _, _, ok := c.Get("forever"); !ok {
+			t.Fatalf("expected key without TTL to stay readable")
+		}
+	})
+
+	t.Run("sweeper removes expired keys", func(t *testing.T) {
+		for i := 0; i < 50; i++ {
+			c.SetWithTTL(fmt.Sprintf("ttl-%d", i), "v", time.Minute)
+		}
+		clock.Advance(time.Minute)
+		stop := c.StartSweeper(time.Millisecond)
+		defer stop()
+		deadline := time.Now().Add(5 * time.Second)
+		for len(c.SnapshotKeyReplicas()) != 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("sweeper left %d keys; want only forever", len(c.SnapshotKeyReplicas()))
+			}
+			time.Sleep(time.Millisecond)
+		}
+		stop()
+		stop()
+	})
+
+	t.Run("remaining TTL moves with migrated keys", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			c.SetWithTTL(fmt.Sprintf("move-%d", i), "v", 30*time.Second)
+		}
+		clock.Advance(20 * time.Second)
+		c.AddNode("D")
+		c.RemoveNode("A")
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("move-%d", i)
+			if _, _, ok := c.Get(key); !ok {
+				t.Fatalf("expected %q to survive migration", key)
+			}
+		}
+		clock.Advance(10 * time.Second)
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("move-%d", i)
+			if _, _, ok := c.Get(key); ok {
+				t.Fatalf("expected %q to expire 30s after it was written", key)
+			}
+		}
+		if removed := c.sweep(); removed != 0 {
+			t.Fatalf("expected reads to have removed every expired key, sweep removed %d", removed)
+		}
+	})
+}
+
+func TestCapacityEviction(t *testing.T) {
+	t.Run("nodes never exceed their capacity", func(t *testing.T) {
+		c := New(10, WithCapacity(Capacity{MaxEntries: 20}))
+		c.AddNode("A")
+		c.AddNode("B")
+		c.AddNode("C")
+		for i := 0; i < 200; i++ {
+			c.Set(fmt.Sprintf("key-%d", i), "v")
+		}
+		evicted := 0
+		for nodeID, count := range c.KeyCounts() {
+			if count > 20 {
+				t.Fatalf("node %s holds %d keys; want at most 20", nodeID, count)
+			}
+			evicted += c.EvictionCounts()[nodeID]
+		}
+		if stored := len(c.SnapshotKeyOwners()); stored+evicted != 200 {
+			t.Fatalf("stored %d and evicted %d keys; want 200 in total", stored, evicted)
+		}
+	})
+
+	t.Run("recently read keys survive", func(t *testing.T) {
+		c := New(10, WithCapacity(Capacity{MaxEntries: 5}))
+		c.AddNode("A")
+		for i := 0; i < 5; i++ {
+			c.Set(fmt.Sprintf("key-%d", i), "v")
+		}
+		c.Get("key-0")
+		c.Set("key-5", "v")
+		if _, _, ok := c.Get("key-0"); !ok {
+			t.Fatalf("expected recently read key-0 to survive eviction")
+		}
+		if _, _, ok := c.Get("key-1"); ok {
+			t.Fatalf("expected least recently used key-1 to be evicted")
+		}
+	})
+
+	t.Run("migration into full nodes reports dropped keys", func(t *testing.T) {
+		c := New(10, WithCapacity(Capacity{MaxEntries: 45}))
+		c.AddNode("A")
+		c.AddNode("B")
+		c.AddNode("C")
+		for i := 0; i < 100; i++ {
+			c.Set(fmt.Sprintf("key-%d", i), "v")
+		}
+		if total := sumCounts(c.EvictionCounts()); total != 0 {
+			t.Fatalf("evicted %d keys before the migration; want 0", total)
+		}
+		before := c.KeyCounts()["C"]
+		stats := c.RemoveNode("C")
+		if stats.Moved != before {
+			t.Fatalf("moved %d keys; want %d", stats.Moved, before)
+		}
+		// two nodes of 45 cannot hold all 100 keys
+		if want := 100 - len(c.SnapshotKeyOwners()); stats.Dropped != want || want < 10 {
+			t.Fatalf("dropped %d keys; want %d and at least 10", stats.Dropped, want)
+		}
+		if total := sumCounts(c.EvictionCounts()); total != stats.Dropped {
+			t.Fatalf("eviction counts sum to %d; want %d", total, stats.Dropped)
+		}
+	})
+}
+
+func sumCounts(counts map[string]int) int {
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	return total
+}
+
+func TestBytesValues(t *testing.T) {
+	c := New(10, WithReplication(2, 2, 1))
+	c.AddNode("A")
+	c.AddNode("B")
+	c.AddNode("C")
+
+	payload := []byte{0x00, 0xff, 'a', 0x80, 0x00}
+	if _, ok := c.SetBytes("bin", payload); !ok {
+		t.Fatalf("expected SetBytes to succeed")
+	}
+	// mutating the caller's slice must not change the cached value
+	payload[0] = 'x'
+
+	got, _, ok := c.GetBytes("bin")
+	if !ok || !slices.Equal(got, []byte{0x00, 0xff, 'a', 0x80, 0x00}) {
+		t.Fatalf("GetBytes returned %v, %v", got, ok)
+	}
+	got[1] = 'y'
+	again, _, _ := c.GetBytes("bin")
+	if again[1] != 0xff {
+		t.Fatalf("mutating a returned slice changed the cached value")
+	}
+
+	// byte and string values are interchangeable
+	if val, _, ok := c.Get("bin"); !ok || val != "\x00\xffa\x80\x00" {
+		t.Fatalf("Get returned %q, %v", val, ok)
+	}
+	c.Set("str", "hello")
+	if val, _, ok := c.GetBytes("str"); !ok || string(val) != "hello" {
+		t.Fatalf("GetBytes returned %q, %v", val, ok)
+	}
+	if _, _, ok := c.GetBytes("missing"); ok {
+		t.Fatalf("expected missing key to be absent")
+	}
+	if owners := c.SnapshotKeyOwners(); len(owners) != 2 {
+		t.Fatalf("snapshot holds %d keys; want 2", len(owners))
+	}
+}
+
+func TestRingSnapshotDiff(t *testing.T) {
+	c := New(20)
+	c.AddNode("A")
+	c.AddNode("B")
+	for i := 0; i < 1000; i++ {
+		c.Set(fmt.Sprintf("key-%d", i), "v")
+	}
+	before, ok := c.RingSnapshot()
+	if !ok {
+		t.Fatalf("RingSnapshot of the default ring not ok")
+	}
+	owners := c.SnapshotKeyOwners()
+	c.AddNode("C")
+	after, _ := c.RingSnapshot()
+	moves := hashring.Diff(before, after)
+
+	for key, owner := range c.SnapshotKeyOwners() {
+		moved := false
+		for _, m := range moves {
+			if m.Contains(c.keyHash(key)) {
+				moved = true
+				if m.From != owners[key] || m.To != owner {
+					t.Fatalf("key %s moved %s -> %s, range says %s -> %s", key, owners[key], owner, m.From, m.To)
+				}
+			}
+		}
+		if moved != (owner != owners[key]) {
+			t.Fatalf("key %s moved %s -> %s, in a moved range: %v", key, owners[key], owner, moved)
+		}
+	}
+
+	if _, ok := New(20, WithRing(hashring.NewJump())).RingSnapshot(); ok {
+		t.Fatalf("RingSnapshot of a jump ring ok")
+	}
+}
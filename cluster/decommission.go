@@ -0,0 +1,421 @@
+package cluster
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Errors returned by Decommission and WaitDecommission.
+var (
+	// ErrUnknownNode is returned for a node that is not in the cluster.
+	ErrUnknownNode = errors.New("cluster: unknown node")
+	// ErrNodeDown is returned for a node that is down, whose keys cannot be
+	// streamed.
+	ErrNodeDown = errors.New("cluster: node is down")
+	// ErrLastNode is returned for the last node that is not draining, whose
+	// keys would have no other node to go to.
+	ErrLastNode = errors.New("cluster: no other node to take the keys")
+	// ErrDecommissioning is returned if the node is already being
+	// decommissioned.
+	ErrDecommissioning = errors.New("cluster: node is already being decommissioned")
+	// ErrNotDecommissioned is returned by WaitDecommission for a node that
+	// was never decommissioned.
+	ErrNotDecommissioned = errors.New("cluster: node is not being decommissioned")
+	// ErrDecommissionCancelled is returned if the decommission was cancelled,
+	// or interrupted by another change of the node's state or membership.
+	ErrDecommissionCancelled = errors.New("cluster: decommission cancelled")
+	// ErrVerifyFailed is returned if the node's keys were still missing on
+	// their new replicas after the last attempt to stream them.
+	ErrVerifyFailed = errors.New("cluster: decommission verification failed")
+)
+
+// decommissionAttempts is how many times a decommission verifies the new
+// replicas, streaming the keys they are missing again in between.
+const decommissionAttempts = 3
+
+// DecommissionProgress reports on the decommission of a node.
+type DecommissionProgress struct {
+	// Running is true until the node is removed, the verification fails or
+	// the decommission is cancelled.
+	Running bool
+	// RangesDone of RangesTotal hash ranges have been streamed to their new
+	// replicas.
+	RangesDone, RangesTotal int
+	// KeysDone of about KeysTotal keys have been visited, including the keys
+	// streamed again after a failed verification.
+	KeysDone, KeysTotal int
+	// Copies counts the copies written to the new replicas and Bytes their
+	// key and value bytes.
+	Copies, Bytes int
+	// Verified is the number of the node's keys found on all of their new
+	// replicas by the last verification, Unverified the number that were
+	// not.
+	Verified, Unverified int
+	// Removed is true once the node's tokens left the ring.
+	Removed bool
+	// Err is ErrDecommissionCancelled or ErrVerifyFailed if the
+	// decommission stopped without removing the node.
+	Err error
+	// ETA estimates the streaming time left from the rate so far; 0 when
+	// unknown.
+	ETA time.Duration
+}
+
+// decommission streams the keys of a draining node to their new replicas.
+type decommission struct {
+	node *CacheNode
+	// the ranges whose replica sets lost the node
+	spans  spanSet
+	limit  RebalanceLimit
+	cancel chan struct{}
+	done   chan struct{}
+	// false once the decommission ended; guarded by Cluster.mu
+	active bool
+
+	mu       sync.Mutex
+	progress DecommissionProgress
+	started  time.Time
+}
+
+// Decommission takes a node out of the cluster without losing its keys. The
+// node is set to StateDraining, so its ranges are served by the next nodes
+// on the ring while it keeps answering reads for the keys they do not hold
+// yet. In the background, the keys of its ranges are then streamed to their
+// new replicas, throttled like the rebalancer if one is configured. Once
+// every key the node holds is found on its live replicas at the same
+// version and checksum, or a newer one, the node leaves the ring. Keys that
+// fail the check are streamed again a few times before the decommission
+// gives up with ErrVerifyFailed and the node is set back to StateUp.
+//
+// The node keeps its keys until it is removed, so cancelling, failing, or
+// changing the node's state or membership meanwhile loses nothing.
+func (c *Cluster) Decommission(nodeID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	node := c.nodes[nodeID]
+	switch {
+	case node == nil:
+		return ErrUnknownNode
+	case c.decommissions[nodeID] != nil && c.decommissions[nodeID].active:
+		return ErrDecommissioning
+	case c.isDown(nodeID):
+		return ErrNodeDown
+	case !c.othersServing(nodeID):
+		return ErrLastNode
+	}
+	limit := RebalanceLimit{BatchSize: DefaultRebalanceBatch}
+	if c.rebalance != nil {
+		limit = c.rebalance.limit
+	}
+	d := &decommission{
+		node:   node,
+		spans:  c.affectedSpans(nodeID, c.nodeTokens(nodeID)),
+		limit:  limit,
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+		active: true,
+	}
+	d.progress = DecommissionProgress{
+		Running:     true,
+		RangesTotal: len(d.spans),
+		KeysTotal:   len(c.holders(d.spans)),
+	}
+	d.started = time.Now()
+	// draining without migrating: the keys move in the background and the
+	// node keeps its copies until they are verified
+	c.states[nodeID] = StateDraining
+	c.decommissions[nodeID] = d
+	c.epoch++
+	go d.run(c)
+	return nil
+}
+
+// DecommissionProgress returns the progress of the current or most recent
+// decommission of a node. ok is false if the node was never decommissioned.
+func (c *Cluster) DecommissionProgress(nodeID string) (p DecommissionProgress, ok bool) {
+	c.mu.RLock()
+	d := c.decommissions[nodeID]
+	c.mu.RUnlock()
+	if d == nil {
+		return DecommissionProgress{}, false
+	}
+	return d.report(), true
+}
+
+// CancelDecommission stops the decommission of a node after the batch it is
+// streaming and sets the node back to StateUp. The copies streamed so far
+// are moved off the nodes that no longer replicate them, like after any
+// change of state. It waits for the background work to stop.
+func (c *Cluster) CancelDecommission(nodeID string) {
+	c.mu.Lock()
+	d := c.decommissions[nodeID]
+	if d == nil || !d.active {
+		c.mu.Unlock()
+		return
+	}
+	d.active = false
+	close(d.cancel)
+	c.setState(nodeID, StateUp)
+	c.mu.Unlock()
+	<-d.done
+}
+
+// WaitDecommission blocks until the decommission of a node ends and returns
+// its final progress and Err.
+func (c *Cluster) WaitDecommission(nodeID string) (DecommissionProgress, error) {
+	c.mu.RLock()
+	d := c.decommissions[nodeID]
+	c.mu.RUnlock()
+	if d == nil {
+		return DecommissionProgress{}, ErrNotDecommissioned
+	}
+	<-d.done
+	p := d.report()
+	return p, p.Err
+}
+
+// decommissionCovers reports whether hash lies in a range of a node being
+// decommissioned. The caller must hold mu.
+func (c *Cluster) decommissionCovers(hash uint64) bool {
+	for _, d := range c.decommissions {
+		if d.active && d.spans.contains(hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// current reports whether the decommission may go on: it was not cancelled
+// and the node is still draining in the cluster. The caller must hold
+// Cluster.mu.
+func (d *decommission) current(c *Cluster) bool {
+	id := d.node.id
+	return d.active && c.nodes[id] == d.node && c.states[id] == StateDraining
+}
+
+// run streams the ranges, then verifies the new replicas and removes the
+// node, streaming the keys that failed the check again in between.
+func (d *decommission) run(c *Cluster) {
+	defer close(d.done)
+	for _, sp := range d.spans {
+		c.mu.RLock()
+		found := c.holders(spanSet{sp})
+		c.mu.RUnlock()
+		keys := make([]string, 0, len(found))
+		for key := range found {
+			keys = append(keys, key)
+		}
+		if !d.stream(c, keys) {
+			d.stop(c)
+			return
+		}
+		d.mu.Lock()
+		d.progress.RangesDone++
+		d.mu.Unlock()
+	}
+	for attempt := 1; ; attempt++ {
+		missing, ok := d.finish(c, attempt == decommissionAttempts)
+		if !ok || len(missing) == 0 {
+			return
+		}
+		d.mu.Lock()
+		d.progress.KeysTotal += len(missing)
+		d.mu.Unlock()
+		if !d.stream(c, missing) {
+			d.stop(c)
+			return
+		}
+	}
+}
+
+// stream copies the newest version of keys to their replicas in throttled
+// batches. It returns false if the decommission was cancelled or
+// interrupted.
+func (d *decommission) stream(c *Cluster, keys []string) bool {
+	for len(keys) > 0 {
+		batch := keys[:min(d.limit.BatchSize, len(keys))]
+		keys = keys[len(batch):]
+
+		c.mu.RLock()
+		if !d.current(c) {
+			c.mu.RUnlock()
+			return false
+		}
+		copies, bytes := 0, 0
+		for _, key := range batch {
+			mu := c.keyLock(key)
+			mu.Lock()
+			n, size := c.copyNewest(key, c.holdersOf(key), c.replicasFor(key))
+			mu.Unlock()
+			copies += n
+			bytes += size
+		}
+		c.mu.RUnlock()
+
+		d.mu.Lock()
+		d.progress.KeysDone += len(batch)
+		d.progress.Copies += copies
+		d.progress.Bytes += bytes
+		wait := d.limit.wait(d.progress.KeysDone, d.progress.Bytes, d.started)
+		d.mu.Unlock()
+
+		select {
+		case <-d.cancel:
+			return false
+		case <-time.After(wait):
+		}
+	}
+	return true
+}
+
+// finish verifies the new replicas under the write lock, so no write races
+// the check, and removes the node if every key passed. Otherwise it returns
+// the keys that failed, or gives up after the last attempt. ok is false if
+// the decommission ended.
+func (d *decommission) finish(c *Cluster, last bool) (missing []string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !d.current(c) {
+		d.end(ErrDecommissionCancelled)
+		return nil, false
+	}
+	verified, missing := c.verifyDrained(d.node)
+	d.mu.Lock()
+	d.progress.Verified, d.progress.Unverified = verified, len(missing)
+	d.mu.Unlock()
+	switch {
+	case len(missing) == 0:
+		c.dropDrained(d.node)
+		d.active = false
+		d.mu.Lock()
+		d.progress.Removed = true
+		d.mu.Unlock()
+		d.end(nil)
+		return nil, true
+	case last:
+		d.active = false
+		c.setState(d.node.id, StateUp)
+		d.end(ErrVerifyFailed)
+		return nil, false
+	}
+	return missing, true
+}
+
+// stop ends a decommission that was cancelled or interrupted while
+// streaming.
+func (d *decommission) stop(c *Cluster) {
+	c.mu.Lock()
+	d.active = false
+	c.mu.Unlock()
+	d.end(ErrDecommissionCancelled)
+}
+
+// end records the outcome of the decommission.
+func (d *decommission) end(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.progress.Running = false
+	d.progress.Err = err
+}
+
+// report returns the progress with a fresh ETA.
+func (d *decommission) report() DecommissionProgress {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := d.progress
+	if p.Running && p.KeysDone > 0 && p.KeysDone < p.KeysTotal {
+		elapsed := time.Since(d.started)
+		p.ETA = elapsed * time.Duration(p.KeysTotal-p.KeysDone) / time.Duration(p.KeysDone)
+	}
+	return p
+}
+
+// verifyDrained checks that every key the draining node holds is on each of
+// its live replicas at the same entry or a newer version. On a token ring
+// the node's Merkle tree of every range is compared with the replicas'
+// trees first, and only the keys of differing leaves are checked one by
+// one; the keys of a range without live replicas are all checked, and
+// fail. It returns the number of keys that passed and the keys that did
+// not. The caller must hold mu.
+func (c *Cluster) verifyDrained(node *CacheNode) (verified int, missing []string) {
+	check := func(key string) {
+		if c.holdsCopies(node, key) {
+			verified++
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	tr, ok := c.ring.(tokenRing)
+	if !ok || c.epsilon > 0 {
+		for _, key := range node.keys(fullRing) {
+			check(key)
+		}
+		return verified, missing
+	}
+	for _, token := range c.ringTokens(tr) {
+		prev := tr.Predecessor(token)
+		tree := node.MerkleTree(prev, token, DefaultMerkleDepth)
+		if tree.Keys == 0 {
+			continue
+		}
+		differing := make(map[int]bool)
+		live := 0
+		for _, id := range c.rangeOwners(tr, token) {
+			if c.isDown(id) {
+				continue
+			}
+			live++
+			for _, leaf := range tree.Diff(c.nodes[id].MerkleTree(prev, token, DefaultMerkleDepth)) {
+				differing[leaf] = true
+			}
+		}
+		if live == 0 {
+			for _, key := range node.keys((spanSet{}).addRange(prev, token)) {
+				check(key)
+			}
+			continue
+		}
+		keys := node.leafKeys(tree, differing)
+		verified += tree.Keys - len(keys)
+		for _, key := range keys {
+			check(key)
+		}
+	}
+	return verified, missing
+}
+
+// holdsCopies reports whether every live replica of key holds the entry
+// node has for it, or a newer one, and there is at least one. The caller
+// must hold mu.
+func (c *Cluster) holdsCopies(node *CacheNode, key string) bool {
+	e, exists := node.get(key)
+	if !exists {
+		// deleted or expired since
+		return true
+	}
+	live := 0
+	for _, id := range c.replicasFor(key) {
+		if c.isDown(id) {
+			continue
+		}
+		held, exists := c.nodes[id].get(key)
+		if !exists || held.version < e.version || (held.version == e.version && !held.same(e)) {
+			return false
+		}
+		live++
+	}
+	return live > 0
+}
+
+// dropDrained removes a node whose keys are all on their new replicas. Its
+// replica sets already skip it, so no keys move. The caller must hold the
+// write lock.
+func (c *Cluster) dropDrained(node *CacheNode) {
+	c.ring.RemoveNode(node.id)
+	delete(c.nodes, node.id)
+	delete(c.states, node.id)
+	c.rehomeHints(node, false)
+	node.destroy()
+	c.epoch++
+}
@@ -0,0 +1,193 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDecommission(t *testing.T) {
+	const numKeys = 1000
+
+	t.Run("replicated", func(t *testing.T) {
+		c := newTestCluster(t, 20, []string{"A", "B", "C", "D", "E"}, numKeys, WithReplication(3, 2, 2))
+		held := c.KeyCounts()["B"]
+		if err := c.Decommission("B"); err != nil {
+			t.Fatalf("Decommission: %v", err)
+		}
+		p, err := c.WaitDecommission("B")
+		if err != nil {
+			t.Fatalf("WaitDecommission: %v", err)
+		}
+		if p.Running || !p.Removed || p.Verified != held || p.Unverified != 0 || p.Copies == 0 {
+			t.Fatalf("final progress %+v, B held %d keys", p, held)
+		}
+		if p.RangesDone != p.RangesTotal || p.KeysDone < p.KeysTotal {
+			t.Fatalf("progress %+v did not cover every range", p)
+		}
+		if slices.Contains(c.ListNodes(), "B") {
+			t.Fatalf("decommissioned node still on the ring")
+		}
+		if _, ok := c.NodeState("B"); ok {
+			t.Fatalf("decommissioned node still has a state")
+		}
+		checkReplicaPlacement(t, c, numKeys)
+	})
+
+	t.Run("reads and writes while streaming", func(t *testing.T) {
+		c := newRebalancingCluster(t, numKeys, RebalanceLimit{KeysPerSecond: 2000, BatchSize: 20})
+		if err := c.Decommission("B"); err != nil {
+			t.Fatalf("Decommission: %v", err)
+		}
+		if state, _ := c.NodeState("B"); state != StateDraining {
+			t.Fatalf("B in state %v while decommissioned", state)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if p, _ := c.DecommissionProgress("B"); !p.Running || p.KeysDone == 0 || p.ETA <= 0 {
+			t.Fatalf("progress while streaming %+v", p)
+		}
+		checkReadable(t, c, numKeys)
+		for i := 0; i < numKeys; i += 2 {
+			if err := c.Delete(fmt.Sprintf("key-%d", i)); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+		}
+		for i := 1; i < numKeys; i += 4 {
+			key := fmt.Sprintf("key-%d", i)
+			c.Set(key, "new-"+key)
+		}
+
+		if _, err := c.WaitDecommission("B"); err != nil {
+			t.Fatalf("WaitDecommission: %v", err)
+		}
+		for i := 0; i < numKeys; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			v, _, ok := c.Get(key)
+			switch {
+			case i%2 == 0 && ok:
+				t.Fatalf("deleted key %s came back as %q", key, v)
+			case i%4 == 1 && v != "new-"+key:
+				t.Fatalf("Get(%s) = %q, want the value written while streaming", key, v)
+			case i%4 == 3 && v != "val-"+key:
+				t.Fatalf("Get(%s) = %q, %v after the decommission", key, v, ok)
+			}
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		c := newRebalancingCluster(t, numKeys, RebalanceLimit{KeysPerSecond: 1000, BatchSize: 10})
+		held := c.KeyCounts()["B"]
+		c.Decommission("B")
+		time.Sleep(30 * time.Millisecond)
+		c.CancelDecommission("B")
+		p, err := c.WaitDecommission("B")
+		if !errors.Is(err, ErrDecommissionCancelled) || p.Running || p.Removed || p.RangesDone == p.RangesTotal {
+			t.Fatalf("progress after cancel %+v, %v", p, err)
+		}
+		if state, ok := c.NodeState("B"); !ok || state != StateUp {
+			t.Fatalf("B in state %v, %v after cancel", state, ok)
+		}
+		checkReadable(t, c, numKeys)
+		c.WaitRebalance()
+		checkSettled(t, c, numKeys)
+		if got := c.KeyCounts()["B"]; got != held {
+			t.Fatalf("B holds %d keys after cancel, want %d", got, held)
+		}
+		// a later decommission starts over
+		if err := c.Decommission("B"); err != nil {
+			t.Fatalf("Decommission after cancel: %v", err)
+		}
+		if _, err := c.WaitDecommission("B"); err != nil {
+			t.Fatalf("WaitDecommission: %v", err)
+		}
+		checkSettled(t, c, numKeys)
+	})
+
+	t.Run("interrupted by removal", func(t *testing.T) {
+		c := newRebalancingCluster(t, numKeys, RebalanceLimit{KeysPerSecond: 1000, BatchSize: 10})
+		c.Decommission("B")
+		time.Sleep(20 * time.Millisecond)
+		c.RemoveNode("B")
+		if _, err := c.WaitDecommission("B"); !errors.Is(err, ErrDecommissionCancelled) {
+			t.Fatalf("WaitDecommission after RemoveNode got %v", err)
+		}
+		checkReadable(t, c, numKeys)
+		c.WaitRebalance()
+		checkSettled(t, c, numKeys)
+	})
+
+	t.Run("verification fails", func(t *testing.T) {
+		// the other nodes cannot fit B's keys, and evict the copies first
+		// because they are used less than the keys already there
+		c := New(20, WithCapacity(Capacity{MaxEntries: numKeys / 3, Policy: LFU}))
+		for _, id := range []string{"A", "B", "C", "D"} {
+			c.AddNode(id)
+		}
+		for i := 0; i < numKeys; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			c.Set(key, "val-"+key)
+			c.Get(key)
+		}
+		c.Decommission("B")
+		p, err := c.WaitDecommission("B")
+		if !errors.Is(err, ErrVerifyFailed) || p.Removed || p.Unverified == 0 {
+			t.Fatalf("progress of a decommission that cannot fit %+v, %v", p, err)
+		}
+		if state, ok := c.NodeState("B"); !ok || state != StateUp {
+			t.Fatalf("B in state %v, %v after the failure", state, ok)
+		}
+	})
+
+	t.Run("no live replicas", func(t *testing.T) {
+		// N=1 leaves the other nodes as the only new replicas, and they are
+		// down before the verification
+		c := newRebalancingCluster(t, numKeys, RebalanceLimit{KeysPerSecond: 2000, BatchSize: 20})
+		held := c.KeyCounts()["B"]
+		c.Decommission("B")
+		c.MarkDown("A")
+		c.MarkDown("C")
+		p, err := c.WaitDecommission("B")
+		if !errors.Is(err, ErrVerifyFailed) || p.Removed || p.Unverified != held {
+			t.Fatalf("progress of a decommission without live replicas %+v, %v", p, err)
+		}
+		if got := c.KeyCounts()["B"]; got != held {
+			t.Fatalf("B holds %d of its %d keys", got, held)
+		}
+	})
+
+	t.Run("last node", func(t *testing.T) {
+		c := New(20)
+		c.AddNode("A")
+		c.Set("k", "v")
+		if err := c.Decommission("A"); !errors.Is(err, ErrLastNode) {
+			t.Fatalf("Decommission of the last node got %v", err)
+		}
+		if v, _, ok := c.Get("k"); !ok || v != "v" {
+			t.Fatalf("Get(k) = %q, %v after the refused decommission", v, ok)
+		}
+		if _, err := c.WaitDecommission("A"); !errors.Is(err, ErrNotDecommissioned) {
+			t.Fatalf("WaitDecommission after the refused decommission got %v", err)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		c := newRebalancingCluster(t, 100, RebalanceLimit{KeysPerSecond: 100, BatchSize: 10})
+		if err := c.Decommission("Z"); !errors.Is(err, ErrUnknownNode) {
+			t.Fatalf("Decommission of a missing node got %v", err)
+		}
+		c.MarkDown("C")
+		if err := c.Decommission("C"); !errors.Is(err, ErrNodeDown) {
+			t.Fatalf("Decommission of a down node got %v", err)
+		}
+		if _, err := c.WaitDecommission("C"); !errors.Is(err, ErrNotDecommissioned) {
+			t.Fatalf("WaitDecommission without a decommission got %v", err)
+		}
+		c.Decommission("B")
+		if err := c.Decommission("B"); !errors.Is(err, ErrDecommissioning) {
+			t.Fatalf("second Decommission got %v", err)
+		}
+		c.CancelDecommission("B")
+	})
+}
@@ -0,0 +1,263 @@
+package cluster
+
+import (
+	"container/heap"
+	"container/list"
+)
+
+// EvictionPolicy selects how a full node picks the key to evict.
+type EvictionPolicy int
+
+const (
+	// LRU evicts the least recently used key.
+	LRU EvictionPolicy = iota
+	// LFU evicts the least frequently used key, oldest access first on ties.
+	LFU
+	// ARC evicts with Adaptive Replacement Cache, which balances recency and
+	// frequency by remembering recently evicted keys.
+	ARC
+)
+
+// String returns the policy name.
+func (p EvictionPolicy) String() string {
+	switch p {
+	case LRU:
+		return "lru"
+	case LFU:
+		return "lfu"
+	case ARC:
+		return "arc"
+	}
+	return "unknown"
+}
+
+// Capacity limits what a single node stores. Zero limits are unlimited.
+type Capacity struct {
+	// MaxEntries is the most keys a node holds.
+	MaxEntries int
+	// MaxBytes is the most bytes of keys plus values a node holds.
+	MaxBytes int
+	// Policy picks the key to evict once a limit is exceeded.
+	Policy EvictionPolicy
+}
+
+// limited reports whether any limit is set.
+func (c Capacity) limited() bool {
+	return c.MaxEntries > 0 || c.MaxBytes > 0
+}
+
+// exceeded reports whether a node with the given number of entries and bytes
+// is over the limits.
+func (c Capacity) exceeded(entries, bytes int) bool {
+	return (c.MaxEntries > 0 && entries > c.MaxEntries) || (c.MaxBytes > 0 && bytes > c.MaxBytes)
+}
+
+// evictor tracks the keys resident on a node and picks eviction victims.
+// It is guarded by the node's lock.
+type evictor interface {
+	// add records a key that was just stored.
+	add(key string)
+	// touch records an access to a resident key.
+	touch(key string)
+	// remove forgets a key that was deleted.
+	remove(key string)
+	// evict forgets and returns the next victim; ok is false if none is resident.
+	evict() (key string, ok bool)
+}
+
+func newEvictor(capacity Capacity) evictor {
+	switch capacity.Policy {
+	case LFU:
+		return newLFU()
+	case ARC:
+		return newARC(capacity.MaxEntries)
+	default:
+		return newLRU()
+	}
+}
+
+// lru keeps resident keys in recency order, most recent at the front.
+type lru struct {
+	order *list.List
+	elems map[string]*list.Element
+}
+
+func newLRU() *lru {
+	return &lru{order: list.New(), elems: make(map[string]*list.Element)}
+}
+
+func (l *lru) add(key string) {
+	l.elems[key] = l.order.PushFront(key)
+}
+
+func (l *lru) touch(key string) {
+	if el, ok := l.elems[key]; ok {
+		l.order.MoveToFront(el)
+	}
+}
+
+func (l *lru) remove(key string) {
+	if el, ok := l.elems[key]; ok {
+		l.order.Remove(el)
+		delete(l.elems, key)
+	}
+}
+
+func (l *lru) evict() (string, bool) {
+	el := l.order.Back()
+	if el == nil {
+		return "", false
+	}
+	key := el.Value.(string)
+	l.remove(key)
+	return key, true
+}
+
+// lfuItem is a resident key with its access count.
+type lfuItem struct {
+	key  string
+	freq int
+	// last access, to break frequency ties by recency
+	tick  uint64
+	index int
+}
+
+// lfuHeap is a min-heap of items ordered by (freq, tick).
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *lfuHeap) Push(x any) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *lfuHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// lfu evicts the key with the fewest accesses.
+type lfu struct {
+	items map[string]*lfuItem
+	heap  lfuHeap
+	tick  uint64
+}
+
+func newLFU() *lfu {
+	return &lfu{items: make(map[string]*lfuItem)}
+}
+
+func (l *lfu) add(key string) {
+	l.tick++
+	item := &lfuItem{key: key, freq: 1, tick: l.tick}
+	l.items[key] = item
+	heap.Push(&l.heap, item)
+}
+
+func (l *lfu) touch(key string) {
+	if item, ok := l.items[key]; ok {
+		l.tick++
+		item.freq++
+		item.tick = l.tick
+		heap.Fix(&l.heap, item.index)
+	}
+}
+
+func (l *lfu) remove(key string) {
+	if item, ok := l.items[key]; ok {
+		heap.Remove(&l.heap, item.index)
+		delete(l.items, key)
+	}
+}
+
+func (l *lfu) evict() (string, bool) {
+	if len(l.heap) == 0 {
+		return "", false
+	}
+	item := heap.Pop(&l.heap).(*lfuItem)
+	delete(l.items, item.key)
+	return item.key, true
+}
+
+// arc implements Adaptive Replacement Cache (Megiddo & Modha). Resident keys
+// live in t1 (seen once recently) or t2 (seen at least twice); b1 and b2
+// remember keys recently evicted from each. A miss that hits b1 means t1 was
+// too small and grows its target p; a miss that hits b2 shrinks it.
+type arc struct {
+	// target size in entries; 0 sizes the ghost lists by the resident keys
+	size           int
+	p              int
+	t1, t2, b1, b2 *lru
+}
+
+func newARC(size int) *arc {
+	return &arc{size: size, t1: newLRU(), t2: newLRU(), b1: newLRU(), b2: newLRU()}
+}
+
+// capacity returns the cache size ARC adapts against.
+func (a *arc) capacity() int {
+	if a.size > 0 {
+		return a.size
+	}
+	return max(len(a.t1.elems)+len(a.t2.elems), 1)
+}
+
+func (a *arc) add(key string) {
+	c := a.capacity()
+	switch {
+	case a.b1.elems[key] != nil:
+		a.p = min(c, a.p+max(len(a.b2.elems)/len(a.b1.elems), 1))
+		a.b1.remove(key)
+		a.t2.add(key)
+	case a.b2.elems[key] != nil:
+		a.p = max(0, a.p-max(len(a.b1.elems)/len(a.b2.elems), 1))
+		a.b2.remove(key)
+		a.t2.add(key)
+	default:
+		a.t1.add(key)
+	}
+}
+
+func (a *arc) touch(key string) {
+	if a.t1.elems[key] != nil {
+		a.t1.remove(key)
+		a.t2.add(key)
+	} else {
+		a.t2.touch(key)
+	}
+}
+
+func (a *arc) remove(key string) {
+	a.t1.remove(key)
+	a.t2.remove(key)
+}
+
+func (a *arc) evict() (string, bool) {
+	from, ghost := a.t2, a.b2
+	if len(a.t1.elems) > 0 && (len(a.t1.elems) > a.p || len(a.t2.elems) == 0) {
+		from, ghost = a.t1, a.b1
+	}
+	key, ok := from.evict()
+	if !ok {
+		return "", false
+	}
+	ghost.add(key)
+	// keep each ghost list no longer than the cache
+	for c := a.capacity(); len(ghost.elems) > c; {
+		ghost.evict()
+	}
+	return key, true
+}
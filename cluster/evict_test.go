@@ -0,0 +1,128 @@
+package cluster
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// drain evicts every key and returns them in eviction order.
+func drain(e evictor) []string {
+	var keys []string
+	for {
+		key, ok := e.evict()
+		if !ok {
+			return keys
+		}
+		keys = append(keys, key)
+	}
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	t.Run("lru evicts the least recently used key", func(t *testing.T) {
+		e := newEvictor(Capacity{MaxEntries: 3, Policy: LRU})
+		e.add("a")
+		e.add("b")
+		e.add("c")
+		e.touch("a")
+		e.remove("b")
+		got := drain(e)
+		want := []string{"c", "a"}
+		if !slices.Equal(got, want) {
+			t.Fatalf("eviction order %v; want %v", got, want)
+		}
+	})
+
+	t.Run("lfu evicts the least frequently used key", func(t *testing.T) {
+		e := newEvictor(Capacity{MaxEntries: 3, Policy: LFU})
+		e.add("a")
+		e.add("b")
+		e.add("c")
+		e.touch("a")
+		e.touch("a")
+		e.touch("c")
+		// b and c tie after touching b, so the older access goes first
+		e.touch("b")
+		got := drain(e)
+		want := []string{"c", "b", "a"}
+		if !slices.Equal(got, want) {
+			t.Fatalf("eviction order %v; want %v", got, want)
+		}
+	})
+
+	t.Run("arc protects frequently used keys from a scan", func(t *testing.T) {
+		e := newEvictor(Capacity{MaxEntries: 4, Policy: ARC}).(*arc)
+		e.add("hot1")
+		e.add("hot2")
+		e.touch("hot1")
+		e.touch("hot2")
+		// a one-off scan only churns t1
+		for _, key := range []string{"s1", "s2", "s3", "s4", "s5"} {
+			e.add(key)
+			if len(e.t1.elems)+len(e.t2.elems) > 4 {
+				e.evict()
+			}
+		}
+		if e.t2.elems["hot1"] == nil || e.t2.elems["hot2"] == nil {
+			t.Fatalf("expected hot keys to survive the scan")
+		}
+		if len(e.b1.elems) > 4 || len(e.b2.elems) > 4 {
+			t.Fatalf("ghost lists hold %d and %d keys; want at most 4", len(e.b1.elems), len(e.b2.elems))
+		}
+	})
+
+	t.Run("arc adapts when a ghost key returns", func(t *testing.T) {
+		e := newEvictor(Capacity{MaxEntries: 2, Policy: ARC}).(*arc)
+		e.add("a")
+		e.add("b")
+		if key, _ := e.evict(); key != "a" {
+			t.Fatalf("evicted %q; want a", key)
+		}
+		e.add("a")
+		if e.p == 0 {
+			t.Fatalf("expected a hit in b1 to grow the recency target")
+		}
+		if e.t2.elems["a"] == nil {
+			t.Fatalf("expected a returning ghost key to be promoted to t2")
+		}
+	})
+}
+
+func TestNodeCapacity(t *testing.T) {
+	hash := func(key string) uint64 { return uint64(len(key)) }
+
+	t.Run("entry limit", func(t *testing.T) {
+		n := newCacheNode("A", nodeConfig{hash: hash, now: time.Now, capacity: Capacity{MaxEntries: 2}})
+		n.putIfNewer("a", entry{value: "1", version: 1})
+		n.putIfNewer("b", entry{value: "2", version: 2})
+		n.get("a")
+		n.putIfNewer("c", entry{value: "3", version: 3})
+		if n.Len() != 2 || n.Evictions() != 1 {
+			t.Fatalf("node holds %d keys after %d evictions; want 2 after 1", n.Len(), n.Evictions())
+		}
+		if _, ok := n.get("b"); ok {
+			t.Fatalf("expected the least recently used key b to be evicted")
+		}
+		if n.index.len != n.Len() {
+			t.Fatalf("index holds %d keys; want %d", n.index.len, n.Len())
+		}
+	})
+
+	t.Run("byte limit", func(t *testing.T) {
+		n := newCacheNode("A", nodeConfig{hash: hash, now: time.Now, capacity: Capacity{MaxBytes: 10}})
+		n.putIfNewer("a", entry{value: "1234", version: 1})
+		n.putIfNewer("b", entry{value: "1234", version: 2})
+		// overwriting with a larger value pushes the node over its limit
+		n.putIfNewer("b", entry{value: "12345678", version: 3})
+		if n.bytes > 10 {
+			t.Fatalf("node holds %d bytes; want at most 10", n.bytes)
+		}
+		if _, ok := n.get("a"); ok {
+			t.Fatalf("expected a to be evicted to make room for b")
+		}
+		n.delete("b")
+		if n.bytes != 0 {
+			t.Fatalf("empty node counts %d bytes; want 0", n.bytes)
+		}
+	})
+}
@@ -0,0 +1,278 @@
+package cluster
+
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for the hinted handoff limits.
+const (
+	DefaultHintTTL  = 10 * time.Minute
+	DefaultMaxHints = 10000
+)
+
+// HintedHandoff configures how writes to unavailable nodes are kept for them.
+type HintedHandoff struct {
+	// TTL is how long a hint waits for its node to come back before it is
+	// discarded.
+	TTL time.Duration
+	// MaxHints and MaxBytes cap the hints, and the bytes of their keys and
+	// values, that one node holds for others. 0 for MaxBytes is unlimited.
+	MaxHints int
+	MaxBytes int
+}
+
+// HintStats counts the hints of a cluster.
+type HintStats struct {
+	// Pending is the number of hints waiting for each node.
+	Pending map[string]int
+	// PendingBytes is the size of all pending hints.
+	PendingBytes int
+	// Stored, Delivered, Expired and Dropped count hints since the cluster
+	// was created. Dropped hints were rejected because no node could take
+	// them within its caps, or were lost with the node holding them.
+	Stored, Delivered, Expired, Dropped int
+}
+
+// WithHintedHandoff makes writes to a node marked down go to the next
+// healthy node on the ring as a hint tagged with the intended owner. The hint
+// counts towards the write quorum and is delivered when the owner is marked
+// up again. Without it, writes to a down node are lost for that node.
+func WithHintedHandoff(h HintedHandoff) Option {
+	return func(c *Cluster) {
+		if h.TTL <= 0 {
+			h.TTL = DefaultHintTTL
+		}
+		if h.MaxHints <= 0 {
+			h.MaxHints = DefaultMaxHints
+		}
+		c.handoff = &h
+	}
+}
+
+// hint is a write kept for a node that was down.
+type hint struct {
+	entry
+	// deleted hints carry a delete at the entry's version
+	deleted bool
+	stored  time.Time
+}
+
+// hintCounters are the cumulative counts of HintStats.
+type hintCounters struct {
+	stored, delivered, expired, dropped atomic.Int64
+}
+
+// deliverHints writes the hints held for nodeID to it, or to the current
+// replicas of their keys if it no longer takes writes as an owner, and
+// returns how many it delivered. The caller must hold the write lock.
+func (c *Cluster) deliverHints(nodeID string) (delivered int) {
+	target := c.nodes[nodeID]
+	for _, node := range c.nodes {
+		for key, h := range node.takeHints(nodeID) {
+			switch {
+			case c.hintExpired(h):
+				c.hints.expired.Add(1)
+				continue
+			case c.states[nodeID] == StateDraining:
+				c.writeHint(key, h)
+			case h.deleted:
+				target.deleteIfOlder(key, h.version)
+			default:
+				target.putIfNewer(key, h.entry)
+			}
+			delivered++
+		}
+	}
+	c.hints.delivered.Add(int64(delivered))
+	return delivered
+}
+
+// HintStats returns the pending hints and the hint counters.
+func (c *Cluster) HintStats() HintStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	stats := HintStats{
+		Pending:   make(map[string]int),
+		Stored:    int(c.hints.stored.Load()),
+		Delivered: int(c.hints.delivered.Load()),
+		Expired:   int(c.hints.expired.Load()),
+		Dropped:   int(c.hints.dropped.Load()),
+	}
+	for _, node := range c.nodes {
+		node.mu.Lock()
+		for owner, hints := range node.hints {
+			stats.Pending[owner] += len(hints)
+		}
+		stats.PendingBytes += node.hintBytes
+		node.mu.Unlock()
+	}
+	return stats
+}
+
+// hintFor stores h for key on the next node clockwise from the key that is
+// up and not owner, preferring nodes that are not replicas of the key
+// already, and reports whether a node took it. The caller must hold mu.
+func (c *Cluster) hintFor(key string, h hint, owner string, owners []string) bool {
+	if c.handoff == nil {
+		return false
+	}
+	h.stored = c.now()
+	walk := c.ring.GetNodes(key, len(c.nodes))
+	for _, replica := range []bool{false, true} {
+		for _, id := range walk {
+			if id == owner || c.states[id] != StateUp || slices.Contains(owners, id) != replica {
+				continue
+			}
+			if c.nodes[id].addHint(owner, key, h, c.handoff) {
+				c.hints.stored.Add(1)
+				return true
+			}
+		}
+	}
+	c.hints.dropped.Add(1)
+	return false
+}
+
+// hintExpired reports whether h outlived the hint TTL.
+func (c *Cluster) hintExpired(h hint) bool {
+	return !c.now().Before(h.stored.Add(c.handoff.TTL))
+}
+
+// expireHints discards the hints that outlived the hint TTL. The caller must
+// hold mu.
+func (c *Cluster) expireHints() {
+	if c.handoff == nil {
+		return
+	}
+	for _, node := range c.nodes {
+		c.hints.expired.Add(int64(node.dropHints(c.hintExpired)))
+	}
+}
+
+// rehomeHints settles the hints involving a node that leaves the cluster,
+// after it left the ring. Hints for it are written to the current replicas
+// of their keys, since their writes may exist nowhere else. Hints it held are
+// handed to other nodes, or lost if it crashed. The caller must hold the
+// write lock.
+func (c *Cluster) rehomeHints(node *CacheNode, crashed bool) {
+	if c.handoff == nil {
+		return
+	}
+	for _, holder := range c.nodes {
+		for key, h := range holder.takeHints(node.id) {
+			c.writeHint(key, h)
+		}
+	}
+	node.mu.Lock()
+	held := node.hints
+	node.hints, node.hintCount, node.hintBytes = nil, 0, 0
+	node.mu.Unlock()
+	for owner, hints := range held {
+		for key, h := range hints {
+			switch {
+			case crashed:
+				c.hints.dropped.Add(1)
+			case c.nodes[owner] == nil:
+				c.writeHint(key, h)
+			default:
+				c.hintFor(key, h, owner, c.lookupReplicas(key))
+			}
+		}
+	}
+}
+
+// writeHint applies a hint to the current replicas of its key, hinting
+// again for the ones that are down. The caller must hold mu.
+func (c *Cluster) writeHint(key string, h hint) {
+	if c.hintExpired(h) {
+		c.hints.expired.Add(1)
+		return
+	}
+	owners := c.lookupReplicas(key)
+	for _, id := range owners {
+		switch {
+		case c.isDown(id):
+			c.hintFor(key, h, id, owners)
+		case h.deleted:
+			c.nodes[id].deleteIfOlder(key, h.version)
+		default:
+			c.nodes[id].putIfNewer(key, h.entry)
+		}
+	}
+}
+
+// addHint stores h for key on behalf of owner and reports whether it fit
+// within the caps. A newer hint for the same key replaces an older one.
+func (n *CacheNode) addHint(owner, key string, h hint, caps *HintedHandoff) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	old, exists := n.hints[owner][key]
+	if exists && old.version >= h.version {
+		return true
+	}
+	count, bytes := n.hintCount, n.hintBytes+h.size(key)
+	if exists {
+		count--
+		bytes -= old.size(key)
+	}
+	if count >= caps.MaxHints || (caps.MaxBytes > 0 && bytes > caps.MaxBytes) {
+		return false
+	}
+	if n.hints == nil {
+		n.hints = make(map[string]map[string]hint)
+	}
+	if n.hints[owner] == nil {
+		n.hints[owner] = make(map[string]hint)
+	}
+	n.hints[owner][key] = h
+	n.hintCount, n.hintBytes = count+1, bytes
+	return true
+}
+
+// takeHints removes and returns the hints held for owner.
+func (n *CacheNode) takeHints(owner string) map[string]hint {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	hints := n.hints[owner]
+	for key, h := range hints {
+		n.hintBytes -= h.size(key)
+	}
+	n.hintCount -= len(hints)
+	delete(n.hints, owner)
+	return hints
+}
+
+// dropHints removes the hints for which expired returns true and returns
+// how many it removed.
+func (n *CacheNode) dropHints(expired func(hint) bool) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	dropped := 0
+	for owner, hints := range n.hints {
+		for key, h := range hints {
+			if expired(h) {
+				n.hintBytes -= h.size(key)
+				n.hintCount--
+				delete(hints, key)
+				dropped++
+			}
+		}
+		if len(hints) == 0 {
+			delete(n.hints, owner)
+		}
+	}
+	return dropped
+}
+
+// deleteIfOlder removes key if the node holds it at a version below version,
+// which applies a delete that happened while the node was away without
+// undoing a later write.
+func (n *CacheNode) deleteIfOlder(key string, version uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if e, exists := n.data[key]; exists && e.version < version {
+		n.remove(key)
+	}
+}
@@ -0,0 +1,218 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newHandoffCluster returns a cluster of five nodes keeping three replicas
+// with write and read quorums of two.
+func newHandoffCluster(t *testing.T, opts ...Option) *Cluster {
+	t.Helper()
+	return newTestCluster(t, 10, []string{"A", "B", "C", "D", "E"}, 0, append([]Option{WithReplication(3, 2, 2)}, opts...)...)
+}
+
+// keysOwnedBy returns numKeys keys that have nodeID among their replicas.
+func keysOwnedBy(c *Cluster, nodeID string, numKeys int) []string {
+	var keys []string
+	for i := 0; len(keys) < numKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		for _, id := range c.LookupReplicas(key) {
+			if id == nodeID {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	return keys
+}
+
+func TestHintedHandoff(t *testing.T) {
+	t.Run("writes are delivered on recovery", func(t *testing.T) {
+		c := newHandoffCluster(t, WithHintedHandoff(HintedHandoff{}))
+		keys := keysOwnedBy(c, "B", 50)
+		c.MarkDown("B")
+		if !c.IsDown("B") {
+			t.Fatalf("B not marked down")
+		}
+		for _, key := range keys {
+			if _, ok := c.Set(key, "val-"+key); !ok {
+				t.Fatalf("Set(%s) failed with a hint for B", key)
+			}
+		}
+		if _, held := c.nodes["B"].Get(keys[0]); held {
+			t.Fatalf("down node took a write")
+		}
+		stats := c.HintStats()
+		if stats.Pending["B"] != len(keys) || stats.Stored != len(keys) || stats.PendingBytes == 0 {
+			t.Fatalf("hint stats while B is down %+v", stats)
+		}
+
+		if got := c.MarkUp("B"); got != len(keys) {
+			t.Fatalf("MarkUp delivered %d hints, want %d", got, len(keys))
+		}
+		for _, key := range keys {
+			if it, ok := c.nodes["B"].Get(key); !ok || it.Value != "val-"+key {
+				t.Fatalf("B holds %s as %q, %v after recovery", key, it.Value, ok)
+			}
+		}
+		stats = c.HintStats()
+		if len(stats.Pending) != 0 || stats.PendingBytes != 0 || stats.Delivered != len(keys) {
+			t.Fatalf("hint stats after recovery %+v", stats)
+		}
+	})
+
+	t.Run("deletes are delivered on recovery", func(t *testing.T) {
+		c := newHandoffCluster(t, WithHintedHandoff(HintedHandoff{}))
+		keys := keysOwnedBy(c, "C", 20)
+		for _, key := range keys {
+			c.Set(key, "val-"+key)
+		}
+		c.MarkDown("C")
+		for _, key := range keys {
+			if err := c.Delete(key); err != nil {
+				t.Fatalf("Delete(%s) with a hint for C: %v", key, err)
+			}
+		}
+		// a write after the delete must survive its delivery
+		c.Set(keys[0], "again")
+		c.MarkUp("C")
+		for _, key := range keys[1:] {
+			if _, held := c.nodes["C"].Get(key); held {
+				t.Fatalf("C kept deleted key %s", key)
+			}
+		}
+		if it, _ := c.nodes["C"].Get(keys[0]); it.Value != "again" {
+			t.Fatalf("C holds %s as %q, want the write after the delete", keys[0], it.Value)
+		}
+	})
+
+	t.Run("hints expire", func(t *testing.T) {
+		now := time.Now()
+		c := newHandoffCluster(t,
+			WithHintedHandoff(HintedHandoff{TTL: time.Minute}),
+			WithClock(func() time.Time { return now }),
+		)
+		keys := keysOwnedBy(c, "B", 10)
+		c.MarkDown("B")
+		for _, key := range keys[:5] {
+			c.Set(key, "val-"+key)
+		}
+		now = now.Add(2 * time.Minute)
+		c.sweep()
+		for _, key := range keys[5:] {
+			c.Set(key, "val-"+key)
+		}
+		if stats := c.HintStats(); stats.Expired != 5 || stats.Pending["B"] != 5 {
+			t.Fatalf("hint stats after the sweep %+v", stats)
+		}
+		now = now.Add(2 * time.Minute)
+		if got := c.MarkUp("B"); got != 0 {
+			t.Fatalf("MarkUp delivered %d expired hints", got)
+		}
+		if stats := c.HintStats(); stats.Expired != 10 {
+			t.Fatalf("hint stats after recovery %+v", stats)
+		}
+	})
+
+	t.Run("caps", func(t *testing.T) {
+		c := newHandoffCluster(t, WithHintedHandoff(HintedHandoff{MaxHints: 2}))
+		keys := keysOwnedBy(c, "B", 20)
+		c.MarkDown("B")
+		for _, key := range keys {
+			c.Set(key, "val-"+key)
+		}
+		// four healthy nodes hold two hints each
+		stats := c.HintStats()
+		if stats.Pending["B"] != 8 || stats.Dropped != len(keys)-8 {
+			t.Fatalf("hint stats past the caps %+v", stats)
+		}
+	})
+
+	t.Run("removal writes hints to the new owners", func(t *testing.T) {
+		c := newHandoffCluster(t, WithHintedHandoff(HintedHandoff{}))
+		keys := keysOwnedBy(c, "B", 20)
+		c.MarkDown("B")
+		for _, key := range keys {
+			c.Set(key, "val-"+key)
+		}
+		c.RemoveNode("B")
+		if stats := c.HintStats(); len(stats.Pending) != 0 {
+			t.Fatalf("hints for a removed node kept: %+v", stats)
+		}
+		checkReplicaPlacement(t, c, len(keys))
+		for _, key := range keys {
+			for _, id := range c.LookupReplicas(key) {
+				if it, _ := c.nodes[id].Get(key); it.Value != "val-"+key {
+					t.Fatalf("new owner %s holds %s as %q", id, key, it.Value)
+				}
+			}
+		}
+	})
+
+	t.Run("multi-key quorums", func(t *testing.T) {
+		c := newHandoffCluster(t, WithReplication(3, 2, 3))
+		key := keysOwnedBy(c, "B", 1)[0]
+		if _, ok := c.Set(key, "v"); !ok {
+			t.Fatalf("Set(%s) failed", key)
+		}
+		replicas := c.LookupReplicas(key)
+		c.MarkDown(replicas[0])
+		c.MarkDown(replicas[1])
+		if _, ok := c.Set(key, "w"); ok {
+			t.Fatalf("Set(%s) made its quorum with two of three owners down", key)
+		}
+		if c.MultiSet(map[string]string{key: "w"}) {
+			t.Fatalf("MultiSet made its quorum with two of three owners down")
+		}
+		if _, _, ok := c.Get(key); ok {
+			t.Fatalf("Get(%s) made its quorum with two of three owners down", key)
+		}
+		if got := c.MultiGet([]string{key}); len(got) != 0 {
+			t.Fatalf("MultiGet made its quorum with two of three owners down: %v", got)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		c := newHandoffCluster(t)
+		keys := keysOwnedBy(c, "B", 20)
+		c.MarkDown("B")
+		for _, key := range keys {
+			// the two healthy owners still make the quorum
+			if _, ok := c.Set(key, "val-"+key); !ok {
+				t.Fatalf("Set(%s) failed", key)
+			}
+			if v, _, ok := c.Get(key); !ok || v != "val-"+key {
+				t.Fatalf("Get(%s) = %q, %v", key, v, ok)
+			}
+		}
+		// MultiGet, like Get, does not count B's copies as stale, so it does
+		// not wait for the key lock to repair them
+		mu := c.keyLock(keys[0])
+		mu.Lock()
+		done := make(chan map[string]string, 1)
+		go func() { done <- c.MultiGet(keys[:1]) }()
+		select {
+		case got := <-done:
+			mu.Unlock()
+			if got[keys[0]] != "val-"+keys[0] {
+				t.Fatalf("MultiGet(%s) = %v", keys[0], got)
+			}
+		case <-time.After(time.Second):
+			mu.Unlock()
+			t.Fatalf("MultiGet repaired the replica that is down")
+		}
+		// B would bring the key back without a tombstone
+		if err := c.Delete(keys[1]); !errors.Is(err, ErrNoQuorum) {
+			t.Fatalf("Delete with an owner down and no handoff got %v", err)
+		}
+		if got := c.MarkUp("B"); got != 0 {
+			t.Fatalf("MarkUp delivered %d hints without handoff", got)
+		}
+		if _, held := c.nodes["B"].Get(keys[0]); held {
+			t.Fatalf("B got a write made while it was down")
+		}
+	})
+}
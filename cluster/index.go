@@ -0,0 +1,110 @@
+package cluster
+
+import (
+	"slices"
+	"sort"
+)
+
+// indexChunkSize is the most keys a hashIndex chunk holds before it splits.
+const indexChunkSize = 256
+
+// indexItem is one key in a hashIndex.
+type indexItem struct {
+	hash uint64
+	key  string
+}
+
+func (a indexItem) less(b indexItem) bool {
+	return a.hash < b.hash || (a.hash == b.hash && a.key < b.key)
+}
+
+// hashIndex keeps keys ordered by (hash, key) in a list of sorted chunks,
+// effectively a two-level B+tree. It lets a node extract the keys of a ring
+// range (prev, token] with a binary search and a sequential scan instead of
+// looking at every key. It is not safe for concurrent use; CacheNode guards
+// it with its lock.
+type hashIndex struct {
+	// non-empty chunks, each sorted, in order
+	chunks [][]indexItem
+	len    int
+}
+
+func newHashIndex() *hashIndex {
+	return &hashIndex{}
+}
+
+// locate returns the chunk that holds or would hold it and the position of
+// the first item in that chunk that is not less than it.
+func (ix *hashIndex) locate(it indexItem) (ci, j int) {
+	ci = sort.Search(len(ix.chunks), func(i int) bool { return it.less(ix.chunks[i][0]) })
+	ci = max(ci-1, 0)
+	chunk := ix.chunks[ci]
+	j = sort.Search(len(chunk), func(j int) bool { return !chunk[j].less(it) })
+	return ci, j
+}
+
+// insert adds key with the given hash. Inserting a present key is a no-op.
+func (ix *hashIndex) insert(hash uint64, key string) {
+	it := indexItem{hash: hash, key: key}
+	if len(ix.chunks) == 0 {
+		ix.chunks = [][]indexItem{{it}}
+		ix.len = 1
+		return
+	}
+	ci, j := ix.locate(it)
+	chunk := ix.chunks[ci]
+	if j < len(chunk) && chunk[j] == it {
+		return
+	}
+	chunk = slices.Insert(chunk, j, it)
+	if len(chunk) > indexChunkSize {
+		half := len(chunk) / 2
+		right := append(make([]indexItem, 0, indexChunkSize), chunk[half:]...)
+		ix.chunks[ci] = chunk[:half]
+		ix.chunks = slices.Insert(ix.chunks, ci+1, right)
+	} else {
+		ix.chunks[ci] = chunk
+	}
+	ix.len++
+}
+
+// remove deletes key with the given hash. Removing a missing key is a no-op.
+func (ix *hashIndex) remove(hash uint64, key string) {
+	it := indexItem{hash: hash, key: key}
+	if len(ix.chunks) == 0 {
+		return
+	}
+	ci, j := ix.locate(it)
+	chunk := ix.chunks[ci]
+	if j == len(chunk) || chunk[j] != it {
+		return
+	}
+	chunk = slices.Delete(chunk, j, j+1)
+	switch {
+	case len(chunk) == 0:
+		ix.chunks = slices.Delete(ix.chunks, ci, ci+1)
+	case len(chunk) < indexChunkSize/4 && ci+1 < len(ix.chunks) && len(chunk)+len(ix.chunks[ci+1]) <= indexChunkSize:
+		// merge sparse neighbours so the chunk list stays short
+		ix.chunks[ci] = append(chunk, ix.chunks[ci+1]...)
+		ix.chunks = slices.Delete(ix.chunks, ci+1, ci+2)
+	default:
+		ix.chunks[ci] = chunk
+	}
+	ix.len--
+}
+
+// ascend calls fn for every key whose hash is in [lo, hi], in order.
+func (ix *hashIndex) ascend(lo, hi uint64, fn func(key string)) {
+	if len(ix.chunks) == 0 {
+		return
+	}
+	ci, j := ix.locate(indexItem{hash: lo})
+	for ; ci < len(ix.chunks); ci, j = ci+1, 0 {
+		for _, it := range ix.chunks[ci][j:] {
+			if it.hash > hi {
+				return
+			}
+			fn(it.key)
+		}
+	}
+}
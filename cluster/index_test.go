@@ -0,0 +1,68 @@
+package cluster
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"testing"
+)
+
+func TestHashIndex(t *testing.T) {
+	ix := newHashIndex()
+	rng := rand.New(rand.NewPCG(1, 2))
+	want := make(map[string]uint64)
+
+	// Small hashes force collisions so ordering by key is exercised too.
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key-%d", rng.IntN(5000))
+		hash := uint64(len(key)) * 1000
+		if rng.IntN(3) == 0 {
+			ix.remove(hash, key)
+			delete(want, key)
+		} else {
+			ix.insert(hash, key)
+			want[key] = hash
+		}
+	}
+	if ix.len != len(want) {
+		t.Fatalf("index holds %d keys; want %d", ix.len, len(want))
+	}
+
+	collect := func(lo, hi uint64) []string {
+		var keys []string
+		ix.ascend(lo, hi, func(key string) { keys = append(keys, key) })
+		return keys
+	}
+	expect := func(lo, hi uint64) []string {
+		var keys []string
+		for key, hash := range want {
+			if hash >= lo && hash <= hi {
+				keys = append(keys, key)
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if want[keys[i]] != want[keys[j]] {
+				return want[keys[i]] < want[keys[j]]
+			}
+			return keys[i] < keys[j]
+		})
+		return keys
+	}
+
+	for _, r := range [][2]uint64{{0, ^uint64(0)}, {5000, 5000}, {5001, 6000}, {6000, 7000}, {8000, 9000}} {
+		if got, want := collect(r[0], r[1]), expect(r[0], r[1]); !slices.Equal(got, want) {
+			t.Fatalf("ascend(%d, %d) = %v; want %v", r[0], r[1], got, want)
+		}
+	}
+
+	for key, hash := range want {
+		ix.remove(hash, key)
+	}
+	if ix.len != 0 || len(ix.chunks) != 0 {
+		t.Fatalf("expected empty index, got len %d with %d chunks", ix.len, len(ix.chunks))
+	}
+	if got := collect(0, ^uint64(0)); len(got) != 0 {
+		t.Fatalf("expected no keys in empty index, got %v", got)
+	}
+}
@@ -0,0 +1,159 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"math/bits"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Limits of the depth of a MerkleTree.
+const (
+	DefaultMerkleDepth = 6
+	MaxMerkleDepth     = 16
+)
+
+// MerkleTree summarizes the keys a node holds in the ring range (Start, End].
+// The range is split into 2^depth leaves of equal width by key hash. Each
+// leaf digests the keys, versions and values that fall in it, and each inner
+// node digests its two children, so two replicas of a range agree on the
+// root exactly when they hold the same keys, and a walk down the differing
+// digests finds the leaves they disagree on. Start == End covers the whole
+// ring.
+type MerkleTree struct {
+	Start, End uint64
+	// Keys is the number of keys in the range
+	Keys  int
+	depth int
+	// digests in heap order: the root first, the children of i at 2i+1 and
+	// 2i+2, and the leaves last
+	digests []uint64
+}
+
+// MerkleTree builds the tree of the keys the node holds in the ring range
+// (start, end] with 2^depth leaves. Expired keys are left out. The depth is
+// clamped to [0, MaxMerkleDepth].
+func (n *CacheNode) MerkleTree(start, end uint64, depth int) *MerkleTree {
+	depth = min(max(depth, 0), MaxMerkleDepth)
+	t := &MerkleTree{
+		Start:   start,
+		End:     end,
+		depth:   depth,
+		digests: make([]uint64, 1<<(depth+1)-1),
+	}
+	leaves := t.digests[len(t.digests)-1<<depth:]
+
+	n.mu.Lock()
+	now := n.cfg.now()
+	// the index ascends by hash, so the keys arrive leaf by leaf
+	d := xxhash.New()
+	cur := -1
+	for _, sp := range (spanSet{}).addRange(start, end) {
+		n.index.ascend(sp.lo, sp.hi, func(key string) {
+			e := n.data[key]
+			if e.expired(now) {
+				return
+			}
+			if leaf := t.leaf(n.cfg.hash(key)); leaf != cur {
+				if cur >= 0 {
+					leaves[cur] = d.Sum64()
+				}
+				d.Reset()
+				cur = leaf
+			}
+			e.digest(d, key)
+			t.Keys++
+		})
+	}
+	if cur >= 0 {
+		leaves[cur] = d.Sum64()
+	}
+	n.mu.Unlock()
+
+	var buf [16]byte
+	for i := len(t.digests) - len(leaves) - 1; i >= 0; i-- {
+		binary.LittleEndian.PutUint64(buf[:8], t.digests[2*i+1])
+		binary.LittleEndian.PutUint64(buf[8:], t.digests[2*i+2])
+		t.digests[i] = xxhash.Sum64(buf[:])
+	}
+	return t
+}
+
+// leafKeys returns the unexpired keys the node holds in the given leaves of
+// t.
+func (n *CacheNode) leafKeys(t *MerkleTree, leaves map[int]bool) []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := n.cfg.now()
+	var keys []string
+	for _, sp := range (spanSet{}).addRange(t.Start, t.End) {
+		n.index.ascend(sp.lo, sp.hi, func(key string) {
+			if leaves[t.leaf(n.cfg.hash(key))] && !n.data[key].expired(now) {
+				keys = append(keys, key)
+			}
+		})
+	}
+	return keys
+}
+
+// Root returns the digest of the whole range.
+func (t *MerkleTree) Root() uint64 { return t.digests[0] }
+
+// Depth returns the depth of the tree; it has 2^Depth leaves.
+func (t *MerkleTree) Depth() int { return t.depth }
+
+// Diff returns the leaves, in ascending order, on which t and other
+// disagree. It only descends into subtrees whose digests differ. Trees of
+// different ranges or depths cannot be compared, so every leaf differs.
+func (t *MerkleTree) Diff(other *MerkleTree) []int {
+	numLeaves := 1 << t.depth
+	if t.Start != other.Start || t.End != other.End || t.depth != other.depth {
+		all := make([]int, numLeaves)
+		for i := range all {
+			all[i] = i
+		}
+		return all
+	}
+	var leaves []int
+	firstLeaf := numLeaves - 1
+	var walk func(i int)
+	walk = func(i int) {
+		if t.digests[i] == other.digests[i] {
+			return
+		}
+		if i >= firstLeaf {
+			leaves = append(leaves, i-firstLeaf)
+			return
+		}
+		walk(2*i + 1)
+		walk(2*i + 2)
+	}
+	walk(0)
+	return leaves
+}
+
+// leaf returns the leaf that the key hash falls in. The hash must be in the
+// tree's range.
+func (t *MerkleTree) leaf(hash uint64) int {
+	offset := hash - t.Start - 1
+	width := t.End - t.Start
+	if width == 0 {
+		// the whole ring
+		return int(offset >> (64 - t.depth) & (1<<t.depth - 1))
+	}
+	// offset * 2^depth / width without overflow; offset < width keeps the
+	// quotient below 2^depth
+	hi, lo := bits.Mul64(offset, 1<<t.depth)
+	q, _ := bits.Div64(hi, lo, width)
+	return int(q)
+}
+
+// digest writes what identifies the entry stored for key to d.
+func (e entry) digest(d *xxhash.Digest, key string) {
+	var buf [binary.MaxVarintLen64]byte
+	for _, v := range []uint64{uint64(len(key)), e.version, uint64(e.expires.UnixNano()), uint64(e.flags), uint64(len(e.value))} {
+		d.Write(binary.AppendUvarint(buf[:0], v))
+	}
+	d.WriteString(key)
+	d.WriteString(e.value)
+}
@@ -0,0 +1,89 @@
+package cluster
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestMerkleTree(t *testing.T) {
+	a, b := NewCacheNode("A", Capacity{}), NewCacheNode("B", Capacity{})
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		e := entry{value: "val-" + key, version: uint64(i + 1)}
+		a.putIfNewer(key, e)
+		b.putIfNewer(key, e)
+	}
+	// a range that wraps past the top of the ring
+	start, end := uint64(math.MaxUint64-1<<62), uint64(1<<62)
+
+	t.Run("equal replicas", func(t *testing.T) {
+		ta, tb := a.MerkleTree(start, end, 8), b.MerkleTree(start, end, 8)
+		if ta.Root() != tb.Root() || len(ta.Diff(tb)) != 0 {
+			t.Fatalf("equal replicas differ: %d leaves", len(ta.Diff(tb)))
+		}
+		// about half the keys fall in a range of half the ring
+		if ta.Keys < 150 || ta.Keys > 350 {
+			t.Fatalf("tree covers %d of 500 keys", ta.Keys)
+		}
+		if full := a.MerkleTree(7, 7, 8); full.Keys != 500 {
+			t.Fatalf("whole ring tree covers %d of 500 keys", full.Keys)
+		}
+	})
+
+	t.Run("diff finds the changed leaves", func(t *testing.T) {
+		want := make(map[int]bool)
+		var changed []string
+		ta := a.MerkleTree(start, end, 8)
+		for i := 0; i < 500; i += 50 {
+			key := fmt.Sprintf("key-%d", i)
+			hash := b.cfg.hash(key)
+			if !(spanSet{}).addRange(start, end).normalize().contains(hash) {
+				continue
+			}
+			want[ta.leaf(hash)] = true
+			changed = append(changed, key)
+			b.overwrite(key, entry{value: "corrupt", version: uint64(i + 1)})
+		}
+		tb := b.MerkleTree(start, end, 8)
+		got := ta.Diff(tb)
+		if len(got) != len(want) || !slices.IsSorted(got) {
+			t.Fatalf("Diff returned leaves %v, want %d", got, len(want))
+		}
+		leaves := make(map[int]bool)
+		for _, leaf := range got {
+			if !want[leaf] {
+				t.Fatalf("Diff returned leaf %d that holds no changed key", leaf)
+			}
+			leaves[leaf] = true
+		}
+		keys := b.leafKeys(tb, leaves)
+		for _, key := range changed {
+			if !slices.Contains(keys, key) {
+				t.Fatalf("leafKeys of the differing leaves misses changed key %s", key)
+			}
+		}
+		if len(keys) > 100 {
+			t.Fatalf("leafKeys returned %d keys for %d changed ones", len(keys), len(changed))
+		}
+	})
+
+	t.Run("leaves", func(t *testing.T) {
+		for _, r := range []struct{ start, end uint64 }{{start, end}, {10, 10}, {0, 1000}, {1000, 0}} {
+			for depth := 0; depth <= 4; depth++ {
+				tree := &MerkleTree{Start: r.start, End: r.end, depth: depth}
+				first, last := tree.leaf(r.start+1), tree.leaf(r.end)
+				if first != 0 || last != 1<<depth-1 {
+					t.Fatalf("range (%d, %d] depth %d maps its ends to leaves %d and %d", r.start, r.end, depth, first, last)
+				}
+			}
+		}
+	})
+
+	t.Run("different shapes", func(t *testing.T) {
+		if got := a.MerkleTree(start, end, 3).Diff(a.MerkleTree(start, end, 4)); len(got) != 8 {
+			t.Fatalf("trees of different depths differ in %d leaves, want all 8", len(got))
+		}
+	})
+}
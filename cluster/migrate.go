@@ -0,0 +1,231 @@
+package cluster
+
+import (
+	"math"
+	"slices"
+	"sort"
+
+	"cache-ring/hashring"
+)
+
+// span is an inclusive interval [lo, hi] of key hashes.
+type span struct {
+	lo, hi uint64
+}
+
+// spanSet is a set of key hash intervals. Call normalize before contains.
+type spanSet []span
+
+// fullRing covers every key hash.
+var fullRing = spanSet{{lo: 0, hi: math.MaxUint64}}
+
+// addRange adds the ring interval (prev, token], splitting it if it wraps.
+func (s spanSet) addRange(prev, token uint64) spanSet {
+	if prev < token {
+		return append(s, span{lo: prev + 1, hi: token})
+	}
+	if prev != math.MaxUint64 {
+		s = append(s, span{lo: prev + 1, hi: math.MaxUint64})
+	}
+	return append(s, span{lo: 0, hi: token})
+}
+
+// normalize sorts the spans and merges the ones that overlap or touch.
+func (s spanSet) normalize() spanSet {
+	sort.Slice(s, func(i, j int) bool { return s[i].lo < s[j].lo })
+	merged := s[:0]
+	for _, sp := range s {
+		if n := len(merged); n > 0 && (merged[n-1].hi == math.MaxUint64 || sp.lo <= merged[n-1].hi+1) {
+			merged[n-1].hi = max(merged[n-1].hi, sp.hi)
+			continue
+		}
+		merged = append(merged, sp)
+	}
+	return merged
+}
+
+// contains reports whether hash falls in one of the spans.
+func (s spanSet) contains(hash uint64) bool {
+	idx := sort.Search(len(s), func(i int) bool { return s[i].hi >= hash })
+	return idx < len(s) && s[idx].lo <= hash
+}
+
+// tokenRing is a ring that places nodes as tokens on a hash circle, which
+// lets migrations find the key ranges next to the tokens that changed.
+type tokenRing interface {
+	hashring.Ring
+	TokensForNode(nodeID string) []uint64
+	TokensForWeight(nodeID string, weight int) []uint64
+	Predecessor(token uint64) uint64
+	Successor(token uint64) uint64
+	OwnerOfToken(token uint64) string
+	HashKey(key string) uint64
+}
+
+// keyHash returns the position of key on the ring's hash circle.
+func (c *Cluster) keyHash(key string) uint64 {
+	if tr, ok := c.ring.(tokenRing); ok {
+		return tr.HashKey(key)
+	}
+	return hashring.HashBytes([]byte(key))
+}
+
+// nodeTokens returns the tokens of nodeID, or nil if the ring has no tokens.
+func (c *Cluster) nodeTokens(nodeID string) []uint64 {
+	if tr, ok := c.ring.(tokenRing); ok {
+		return tr.TokensForNode(nodeID)
+	}
+	return nil
+}
+
+// affectedSpans returns the key ranges whose replica sets may change when the
+// given tokens of nodeID are added to or removed from the ring. It must be
+// called while the tokens are on the ring. Rings without tokens give no
+// locality, so every key is affected.
+//
+// A key only depends on the tokens it walks past before it has seen n
+// distinct nodes, so for each token the affected range stretches back
+// counter-clockwise until n nodes other than nodeID have been passed.
+// Draining nodes replicate nothing, so they are not counted.
+func (c *Cluster) affectedSpans(nodeID string, tokens []uint64) spanSet {
+	tr, ok := c.ring.(tokenRing)
+	if !ok {
+		return fullRing
+	}
+	var spans spanSet
+	for _, token := range tokens {
+		seen := make(map[string]struct{}, c.n)
+		prev := token
+		for len(seen) < c.n {
+			prev = tr.Predecessor(prev)
+			if prev == token {
+				// walked the whole ring without finding n other nodes
+				return fullRing
+			}
+			if owner := tr.OwnerOfToken(prev); owner != nodeID && c.states[owner] != StateDraining {
+				seen[owner] = struct{}{}
+			}
+		}
+		spans = spans.addRange(prev, token)
+	}
+	return spans.normalize()
+}
+
+// The migration helpers below run while the caller holds the write lock.
+
+// reconcile makes every key whose hash falls in spans live on exactly its
+// current replica set. The newest version found on any node is copied to the
+// replicas that lack it and the key is deleted from nodes that no longer
+// replicate it. Under bounded loads every key is placed again instead.
+func (c *Cluster) reconcile(spans spanSet) MigrationStats {
+	evictionsBefore := c.totalEvictions()
+	var stats MigrationStats
+	if c.epsilon > 0 {
+		stats.Moved = c.rebalanceBounded()
+	} else {
+		for key, holders := range c.holders(spans) {
+			copies, _ := c.place(key, holders, c.lookupReplicas(key))
+			stats.Moved += copies
+		}
+	}
+	stats.Dropped = c.totalEvictions() - evictionsBefore
+	return stats
+}
+
+// totalEvictions sums the eviction counts of all nodes.
+func (c *Cluster) totalEvictions() int {
+	total := 0
+	for _, count := range c.evictionCounts() {
+		total += count
+	}
+	return total
+}
+
+// holders returns the nodes, removed ones included, holding each key whose
+// hash falls in spans.
+func (c *Cluster) holders(spans spanSet) map[string][]*CacheNode {
+	found := make(map[string][]*CacheNode)
+	for _, nodes := range []map[string]*CacheNode{c.nodes, c.retired} {
+		for _, node := range nodes {
+			for _, key := range node.keys(spans) {
+				found[key] = append(found[key], node)
+			}
+		}
+	}
+	return found
+}
+
+// place copies the newest version of key among holders to owners and
+// deletes it from the holders that are not owners. Without owners the
+// holders keep the key, the only copies left. It returns the number of
+// copies written and the bytes they took.
+func (c *Cluster) place(key string, holders []*CacheNode, owners []string) (copies, bytes int) {
+	if len(owners) == 0 {
+		return 0, 0
+	}
+	copies, bytes = c.copyNewest(key, holders, owners)
+	for _, node := range holders {
+		if !slices.Contains(owners, node.id) {
+			node.delete(key)
+		}
+	}
+	return copies, bytes
+}
+
+// copyNewest copies the newest version of key among holders to owners,
+// leaving the holders as they are. It returns the number of copies written
+// and the bytes they took.
+func (c *Cluster) copyNewest(key string, holders []*CacheNode, owners []string) (copies, bytes int) {
+	var best entry
+	found := false
+	for _, node := range holders {
+		if e, exists := node.get(key); exists && (!found || e.version > best.version) {
+			best, found = e, true
+		}
+	}
+	if !found {
+		return 0, 0
+	}
+	for _, id := range owners {
+		if node := c.nodes[id]; node != nil && node.putIfNewer(key, best) {
+			copies++
+		}
+	}
+	return copies, copies * best.size(key)
+}
+
+// rebalanceBounded places every key again under the load bound, as if the
+// keys were inserted one by one in hash order into empty nodes. Visiting
+// keys in a fixed order keeps the result independent of map iteration.
+// It returns the number of copies written.
+func (c *Cluster) rebalanceBounded() int {
+	found := c.holders(fullRing)
+	keys := make([]string, 0, len(found))
+	hashes := make(map[string]uint64, len(found))
+	for key := range found {
+		keys = append(keys, key)
+		hashes[key] = c.keyHash(key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if hashes[keys[i]] != hashes[keys[j]] {
+			return hashes[keys[i]] < hashes[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	numNodes := len(c.ring.Nodes()) - c.draining()
+	want := min(c.n, numNodes)
+	capacity := hashring.BoundedCapacity(len(keys)*want, numNodes, c.epsilon)
+	loads := make(map[string]int, numNodes)
+	copies := 0
+	for _, key := range keys {
+		walk := c.withoutDraining(c.ring.GetNodes(key, len(c.nodes)), numNodes)
+		owners := fillBelowCapacity(make([]string, 0, want), walk, want, loads, capacity)
+		for _, id := range owners {
+			loads[id]++
+		}
+		n, _ := c.place(key, found[key], owners)
+		copies += n
+	}
+	return copies
+}
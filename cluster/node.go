@@ -0,0 +1,378 @@
+package cluster
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"cache-ring/hashring"
+)
+
+// CacheNode holds the keys stored on one node of the cluster. Besides the
+// key/value map it keeps the keys ordered by ring hash, so migrations can
+// extract a token range without scanning every key. A node with a capacity
+// evicts keys once it is full.
+// It is safe for concurrent use.
+type CacheNode struct {
+	id    string
+	cfg   nodeConfig
+	mu    sync.Mutex
+	data  map[string]entry
+	index *hashIndex
+	// nil unless the node has a capacity
+	evictor evictor
+	// bytes of keys plus values stored
+	bytes     int
+	evictions int
+	// highest version stored, so versions the node assigns itself keep
+	// increasing
+	version uint64
+	// nil unless the node persists its keys
+	log *nodeLog
+	// first persistence error, see Err
+	err error
+	// writes held for other nodes while they are down: owner -> key -> hint
+	hints     map[string]map[string]hint
+	hintCount int
+	hintBytes int
+}
+
+// nodeConfig carries the cluster settings every CacheNode needs.
+type nodeConfig struct {
+	// position of a key on the ring's hash circle
+	hash        func(key string) uint64
+	now         func() time.Time
+	capacity    Capacity
+	persistence Persistence
+}
+
+// entry is a stored value tagged with the version of the write that made it.
+// When replicas disagree, the entry with the highest version wins.
+// The expiry is absolute, so an entry keeps its remaining TTL when it moves
+// between nodes.
+type entry struct {
+	value   string
+	version uint64
+	// zero means the entry never expires
+	expires time.Time
+	// opaque client flags, see Item
+	flags uint32
+}
+
+// expired reports whether the entry's TTL has run out at now.
+func (e entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// size is what an entry counts against a node's byte capacity.
+func (e entry) size(key string) int {
+	return len(key) + len(e.value)
+}
+
+func newCacheNode(nodeID string, cfg nodeConfig) *CacheNode {
+	n := &CacheNode{
+		id:    nodeID,
+		cfg:   cfg,
+		data:  make(map[string]entry),
+		index: newHashIndex(),
+	}
+	if cfg.capacity.limited() {
+		n.evictor = newEvictor(cfg.capacity)
+	}
+	return n
+}
+
+// NewCacheNode returns an empty node for use outside a Cluster, such as
+// behind a server. Keys are hashed like hashring.New does and a zero
+// capacity is unlimited.
+func NewCacheNode(nodeID string, capacity Capacity) *CacheNode {
+	return newCacheNode(nodeID, nodeConfig{
+		hash:     func(key string) uint64 { return hashring.HashBytes([]byte(key)) },
+		now:      time.Now,
+		capacity: capacity,
+	})
+}
+
+// ID returns the node identifier.
+func (n *CacheNode) ID() string { return n.id }
+
+// Len returns the number of keys stored on the node, including expired keys
+// that have not been removed yet.
+func (n *CacheNode) Len() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.data)
+}
+
+// Bytes returns the number of bytes of keys plus values stored on the node.
+func (n *CacheNode) Bytes() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.bytes
+}
+
+// Evictions returns the number of keys the node evicted because it was full.
+func (n *CacheNode) Evictions() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.evictions
+}
+
+// get returns the entry for key. Expired entries are removed on access and
+// reported as missing.
+func (n *CacheNode) get(key string) (entry, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.lookup(key)
+}
+
+// getMany is like get for several keys under one lock acquisition. Missing
+// keys are left out of the result.
+func (n *CacheNode) getMany(keys []string) map[string]entry {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	found := make(map[string]entry, len(keys))
+	for _, key := range keys {
+		if e, ok := n.lookup(key); ok {
+			found[key] = e
+		}
+	}
+	return found
+}
+
+// lookup implements get. The caller must hold mu.
+func (n *CacheNode) lookup(key string) (entry, bool) {
+	e, ok := n.data[key]
+	if ok && e.expired(n.cfg.now()) {
+		n.remove(key)
+		return entry{}, false
+	}
+	if ok && n.evictor != nil {
+		n.evictor.touch(key)
+	}
+	return e, ok
+}
+
+// putIfNewer stores e unless the node already holds key at the same or a
+// newer version, so replicas converge no matter in which order concurrent
+// writes arrive. If the node is full afterwards, keys are evicted until it
+// fits again, which may include key itself if it alone exceeds the capacity.
+// It reports whether e was stored.
+func (n *CacheNode) putIfNewer(key string, e entry) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.put(key, e)
+}
+
+// putManyIfNewer is like putIfNewer for several keys under one lock
+// acquisition.
+func (n *CacheNode) putManyIfNewer(entries map[string]entry) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for key, e := range entries {
+		n.put(key, e)
+	}
+}
+
+// put implements putIfNewer. The caller must hold mu.
+func (n *CacheNode) put(key string, e entry) bool {
+	old, exists := n.data[key]
+	if exists && old.version >= e.version {
+		return false
+	}
+	if exists {
+		n.bytes -= old.size(key)
+		if n.evictor != nil {
+			n.evictor.touch(key)
+		}
+	} else {
+		n.index.insert(n.cfg.hash(key), key)
+		if n.evictor != nil {
+			n.evictor.add(key)
+		}
+	}
+	n.data[key] = e
+	n.bytes += e.size(key)
+	n.version = max(n.version, e.version)
+	n.logPut(key, e)
+
+	for n.evictor != nil && n.cfg.capacity.exceeded(len(n.data), n.bytes) {
+		victim, ok := n.evictor.evict()
+		if !ok {
+			break
+		}
+		n.remove(victim)
+		n.evictions++
+	}
+	return true
+}
+
+// delete removes key and reports whether the node held an unexpired entry
+// for it.
+func (n *CacheNode) delete(key string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	e, ok := n.data[key]
+	n.remove(key)
+	return ok && !e.expired(n.cfg.now())
+}
+
+// remove deletes key from the map and the index. The caller must hold mu.
+func (n *CacheNode) remove(key string) {
+	if e, exists := n.data[key]; exists {
+		n.index.remove(n.cfg.hash(key), key)
+		if n.evictor != nil {
+			n.evictor.remove(key)
+		}
+		n.bytes -= e.size(key)
+		delete(n.data, key)
+		n.logDelete(key)
+	}
+}
+
+// sweep removes every expired entry and returns how many it removed.
+func (n *CacheNode) sweep() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := n.cfg.now()
+	removed := 0
+	for key, e := range n.data {
+		if e.expired(now) {
+			n.remove(key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// keys returns the keys stored on the node whose hash falls in spans, with
+// one range scan of the index per span.
+func (n *CacheNode) keys(spans spanSet) []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var keys []string
+	for _, sp := range spans {
+		n.index.ascend(sp.lo, sp.hi, func(key string) {
+			keys = append(keys, key)
+		})
+	}
+	return keys
+}
+
+// Item is a value stored on a node together with the metadata of the
+// memcached protocol.
+type Item struct {
+	Value string
+	// Flags are opaque to the cache and returned with the value.
+	Flags uint32
+	// Expires is when the item expires; the zero time means never.
+	Expires time.Time
+	// CAS is the version of the item. It is assigned by the node and ignored
+	// on writes.
+	CAS uint64
+}
+
+func (e entry) item() Item {
+	return Item{Value: e.value, Flags: e.flags, Expires: e.expires, CAS: e.version}
+}
+
+// Get returns the item stored under key.
+func (n *CacheNode) Get(key string) (Item, bool) {
+	e, ok := n.get(key)
+	return e.item(), ok
+}
+
+// Set stores item under key and returns its CAS version.
+func (n *CacheNode) Set(key string, item Item) uint64 {
+	cas, _ := n.store(key, item, func(entry, bool) error { return nil })
+	return cas
+}
+
+// Add stores item only if key is absent, and returns ErrNotStored otherwise.
+func (n *CacheNode) Add(key string, item Item) error {
+	_, err := n.store(key, item, func(_ entry, found bool) error {
+		if found {
+			return ErrNotStored
+		}
+		return nil
+	})
+	return err
+}
+
+// Replace stores item only if key is present, and returns ErrNotStored
+// otherwise.
+func (n *CacheNode) Replace(key string, item Item) error {
+	_, err := n.store(key, item, func(_ entry, found bool) error {
+		if !found {
+			return ErrNotStored
+		}
+		return nil
+	})
+	return err
+}
+
+// CompareAndSwap stores item only if the CAS version of key is still cas.
+// It returns ErrNotFound if key is absent and ErrExists if it was written
+// since.
+func (n *CacheNode) CompareAndSwap(key string, item Item, cas uint64) error {
+	_, err := n.store(key, item, func(cur entry, found bool) error {
+		if !found {
+			return ErrNotFound
+		}
+		if cur.version != cas {
+			return ErrExists
+		}
+		return nil
+	})
+	return err
+}
+
+// Delete removes key and returns ErrNotFound if it was absent.
+func (n *CacheNode) Delete(key string) error {
+	if !n.delete(key) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Incr adds delta to the decimal value of key like Cluster.Incr.
+func (n *CacheNode) Incr(key string, delta uint64) (uint64, error) {
+	return n.addDelta(key, incr(delta))
+}
+
+// Decr subtracts delta from the decimal value of key like Cluster.Decr.
+func (n *CacheNode) Decr(key string, delta uint64) (uint64, error) {
+	return n.addDelta(key, decr(delta))
+}
+
+func (n *CacheNode) addDelta(key string, apply func(uint64) uint64) (uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	e, ok := n.lookup(key)
+	if !ok {
+		return 0, ErrNotFound
+	}
+	num, err := strconv.ParseUint(e.value, 10, 64)
+	if err != nil {
+		return 0, ErrNotNumber
+	}
+	num = apply(num)
+	e.value = strconv.FormatUint(num, 10)
+	e.version = n.version + 1
+	n.put(key, e)
+	return num, nil
+}
+
+// store writes item under key with the next version if check accepts the
+// current entry, all under the node lock. It returns the new version.
+func (n *CacheNode) store(key string, item Item, check func(cur entry, found bool) error) (uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	cur, found := n.lookup(key)
+	if err := check(cur, found); err != nil {
+		return 0, err
+	}
+	e := entry{value: item.Value, flags: item.Flags, expires: item.Expires, version: n.version + 1}
+	n.put(key, e)
+	return e.version, nil
+}
@@ -0,0 +1,52 @@
+package cluster
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCacheNodeItems(t *testing.T) {
+	n := NewCacheNode("A", Capacity{})
+
+	cas := n.Set("k", Item{Value: "v1", Flags: 7})
+	item, ok := n.Get("k")
+	if !ok || item.Value != "v1" || item.Flags != 7 || item.CAS != cas {
+		t.Fatalf("Get returned %+v, %v", item, ok)
+	}
+	if err := n.Add("k", Item{Value: "v2"}); !errors.Is(err, ErrNotStored) {
+		t.Fatalf("Add of a present key returned %v; want ErrNotStored", err)
+	}
+	if err := n.Replace("missing", Item{Value: "v2"}); !errors.Is(err, ErrNotStored) {
+		t.Fatalf("Replace of a missing key returned %v; want ErrNotStored", err)
+	}
+	if err := n.CompareAndSwap("k", Item{Value: "v2"}, cas); err != nil {
+		t.Fatalf("CompareAndSwap returned %v", err)
+	}
+	if err := n.CompareAndSwap("k", Item{Value: "v3"}, cas); !errors.Is(err, ErrExists) {
+		t.Fatalf("CompareAndSwap with a stale CAS returned %v; want ErrExists", err)
+	}
+	if item, _ := n.Get("k"); item.Value != "v2" || item.CAS <= cas {
+		t.Fatalf("Get returned %+v; want v2 with a CAS above %d", item, cas)
+	}
+
+	n.Set("n", Item{Value: "41"})
+	if v, err := n.Incr("n", 1); err != nil || v != 42 {
+		t.Fatalf("Incr returned %d, %v; want 42", v, err)
+	}
+	if v, err := n.Decr("n", 50); err != nil || v != 0 {
+		t.Fatalf("Decr returned %d, %v; want 0", v, err)
+	}
+	if _, err := n.Incr("k", 1); !errors.Is(err, ErrNotNumber) {
+		t.Fatalf("Incr of a non-number returned %v; want ErrNotNumber", err)
+	}
+
+	if err := n.Delete("k"); err != nil {
+		t.Fatalf("Delete returned %v", err)
+	}
+	if err := n.Delete("k"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Delete of a missing key returned %v; want ErrNotFound", err)
+	}
+	if n.Len() != 1 || n.Bytes() != len("n")+len("0") {
+		t.Fatalf("node holds %d keys in %d bytes; want 1 in 2", n.Len(), n.Bytes())
+	}
+}
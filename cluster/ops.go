@@ -0,0 +1,345 @@
+package cluster
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Errors returned by the conditional cache operations.
+var (
+	// ErrNotFound means the key is absent.
+	ErrNotFound = errors.New("cluster: key not found")
+	// ErrNotStored means the condition of Add or Replace did not hold.
+	ErrNotStored = errors.New("cluster: not stored")
+	// ErrExists means the key was modified since the version passed to
+	// CompareAndSwap was read.
+	ErrExists = errors.New("cluster: key modified since read")
+	// ErrNotNumber means Incr or Decr found a value that is not a decimal
+	// unsigned 64-bit integer.
+	ErrNotNumber = errors.New("cluster: value is not a number")
+	// ErrNoQuorum means fewer replicas than the quorum answered, including
+	// when the cluster has no nodes.
+	ErrNoQuorum = errors.New("cluster: quorum not reached")
+)
+
+// GetWithVersion is like Get, but also returns the version of the value for
+// use with CompareAndSwap.
+func (c *Cluster) GetWithVersion(key string) (value string, version uint64, ok bool) {
+	e, _, ok := c.get(key)
+	return e.value, e.version, ok
+}
+
+// Delete removes key from all of its replicas. It returns ErrNotFound if no
+// replica held the key. Deletes are not versioned, so a replica that is down
+// and cannot be given a tombstone hint would bring the key back when it is
+// up again: Delete then returns ErrNoQuorum, whatever the write quorum.
+func (c *Cluster) Delete(key string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	owners := c.replicasFor(key)
+	if len(owners) == 0 {
+		return ErrNoQuorum
+	}
+	mu := c.keyLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	acks, deleted, missed := 0, false, false
+	for _, id := range owners {
+		node := c.nodes[id]
+		if node == nil {
+			continue
+		}
+		if c.isDown(id) {
+			tombstone := hint{entry: entry{version: c.version.Add(1)}, deleted: true}
+			if c.hintFor(key, tombstone, id, owners) {
+				acks++
+			} else {
+				missed = true
+			}
+			continue
+		}
+		deleted = node.delete(key) || deleted
+		acks++
+	}
+	if c.unsettled(key) {
+		// delete the copies not moved yet, or the rebalancer would bring
+		// them back
+		for _, node := range c.holdersOf(key) {
+			deleted = node.delete(key) || deleted
+		}
+	}
+	if missed || acks < min(c.w, len(owners)) {
+		return ErrNoQuorum
+	}
+	if !deleted {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Add stores value only if key is absent, and returns ErrNotStored
+// otherwise. A ttl <= 0 means the key never expires.
+func (c *Cluster) Add(key, value string, ttl time.Duration) error {
+	_, err := c.update(key, func(cur entry, found bool) (entry, error) {
+		if found {
+			return entry{}, ErrNotStored
+		}
+		return entry{value: value, expires: c.expiry(ttl)}, nil
+	})
+	return err
+}
+
+// Replace stores value only if key is present, and returns ErrNotStored
+// otherwise. A ttl <= 0 means the key never expires.
+func (c *Cluster) Replace(key, value string, ttl time.Duration) error {
+	_, err := c.update(key, func(cur entry, found bool) (entry, error) {
+		if !found {
+			return entry{}, ErrNotStored
+		}
+		return entry{value: value, expires: c.expiry(ttl)}, nil
+	})
+	return err
+}
+
+// CompareAndSwap stores value only if the version of key is still version,
+// as returned by GetWithVersion. It returns ErrNotFound if key is absent and
+// ErrExists if it was written since. A ttl <= 0 means the key never expires.
+func (c *Cluster) CompareAndSwap(key, value string, version uint64, ttl time.Duration) error {
+	_, err := c.update(key, func(cur entry, found bool) (entry, error) {
+		if !found {
+			return entry{}, ErrNotFound
+		}
+		if cur.version != version {
+			return entry{}, ErrExists
+		}
+		return entry{value: value, expires: c.expiry(ttl)}, nil
+	})
+	return err
+}
+
+// Incr adds delta to the decimal value of key and returns the result. It
+// wraps around at 2^64 like memcached. The key keeps its expiration time.
+func (c *Cluster) Incr(key string, delta uint64) (uint64, error) {
+	return c.addDelta(key, incr(delta))
+}
+
+// Decr subtracts delta from the decimal value of key and returns the
+// result. Like memcached, it stops at 0 instead of wrapping around.
+func (c *Cluster) Decr(key string, delta uint64) (uint64, error) {
+	return c.addDelta(key, decr(delta))
+}
+
+// incr returns a function adding delta with wrap-around.
+func incr(delta uint64) func(uint64) uint64 {
+	return func(n uint64) uint64 { return n + delta }
+}
+
+// decr returns a function subtracting delta without going below 0.
+func decr(delta uint64) func(uint64) uint64 {
+	return func(n uint64) uint64 { return n - min(n, delta) }
+}
+
+func (c *Cluster) addDelta(key string, apply func(uint64) uint64) (uint64, error) {
+	e, err := c.update(key, func(cur entry, found bool) (entry, error) {
+		if !found {
+			return entry{}, ErrNotFound
+		}
+		n, err := strconv.ParseUint(cur.value, 10, 64)
+		if err != nil {
+			return entry{}, ErrNotNumber
+		}
+		cur.value = strconv.FormatUint(apply(n), 10)
+		return cur, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	n, _ := strconv.ParseUint(e.value, 10, 64)
+	return n, nil
+}
+
+// update reads the newest entry of key under its key lock, passes it to fn
+// and writes the entry fn returns to every replica with a new version. An
+// error from fn is returned without writing.
+func (c *Cluster) update(key string, fn func(cur entry, found bool) (entry, error)) (entry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	owners := c.replicasFor(key)
+	if len(owners) == 0 {
+		return entry{}, ErrNoQuorum
+	}
+	mu := c.keyLock(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	cur, curNode, answers, _ := c.readReplicas(key, owners)
+	if answers < min(c.r, len(owners)) {
+		return entry{}, ErrNoQuorum
+	}
+	next, err := fn(cur, curNode != "")
+	if err != nil {
+		return entry{}, err
+	}
+	next.version = c.version.Add(1)
+	if c.writeReplicas(key, next, owners) < min(c.w, len(owners)) {
+		return entry{}, ErrNoQuorum
+	}
+	return next, nil
+}
+
+// MultiGet reads several keys and returns the values of those that are
+// present. Keys are grouped by the nodes that own them, so each node is
+// visited once no matter how many of the keys it holds. Like Get, a key is
+// left out if fewer of its replicas than the read quorum answered.
+func (c *Cluster) MultiGet(keys []string) map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	owners, byNode := c.groupByNode(keys)
+	found := make(map[string]map[string]entry, len(owners))
+	for id, nodeKeys := range byNode {
+		if c.isDown(id) {
+			continue
+		}
+		for key, e := range c.nodes[id].getMany(nodeKeys) {
+			if found[key] == nil {
+				found[key] = make(map[string]entry)
+			}
+			found[key][id] = e
+		}
+	}
+
+	answers := make(map[string]int, len(owners))
+	for key, ids := range owners {
+		for _, id := range ids {
+			if !c.isDown(id) {
+				answers[key]++
+			}
+		}
+		if answers[key] < min(c.r, len(ids)) {
+			delete(found, key)
+		}
+	}
+
+	values := make(map[string]string, len(found))
+	for key, held := range found {
+		var best entry
+		for _, e := range held {
+			if e.version > best.version {
+				best = e
+			}
+		}
+		// down owners are repaired by hints, not by reads
+		stale := len(held) < answers[key]
+		for _, e := range held {
+			stale = stale || e.version != best.version
+		}
+		if stale {
+			var bestNode string
+			if best, bestNode = c.repair(key, owners[key]); bestNode == "" {
+				continue
+			}
+		}
+		values[key] = best.value
+	}
+	for key, ids := range owners {
+		if _, held := found[key]; !held && answers[key] >= min(c.r, len(ids)) && c.unsettled(key) {
+			if best, bestNode := c.previous(key, ids); bestNode != "" {
+				values[key] = best.value
+			}
+		}
+	}
+	return values
+}
+
+// MultiSet writes several keys. Like MultiGet, it groups keys by owner node
+// and visits each node once. ok is false if the cluster is empty or, like
+// Set, any key reached fewer replicas than the write quorum.
+func (c *Cluster) MultiSet(items map[string]string) (ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	owners, byNode := c.groupByNode(keys)
+	if len(owners) < len(keys) {
+		return false
+	}
+	unlock := c.lockKeys(keys)
+	defer unlock()
+
+	entries := make(map[string]entry, len(items))
+	for key, value := range items {
+		entries[key] = entry{value: value, version: c.version.Add(1)}
+	}
+	acks := make(map[string]int, len(keys))
+	for id, nodeKeys := range byNode {
+		if c.isDown(id) {
+			for _, key := range nodeKeys {
+				if c.hintFor(key, hint{entry: entries[key]}, id, owners[key]) {
+					acks[key]++
+				}
+			}
+			continue
+		}
+		batch := make(map[string]entry, len(nodeKeys))
+		for _, key := range nodeKeys {
+			batch[key] = entries[key]
+			acks[key]++
+		}
+		c.nodes[id].putManyIfNewer(batch)
+	}
+	for key, ids := range owners {
+		if acks[key] < min(c.w, len(ids)) {
+			return false
+		}
+	}
+	return true
+}
+
+// groupByNode returns the owners of every key that has any, and the keys
+// each node owns. The caller must hold mu.
+func (c *Cluster) groupByNode(keys []string) (owners map[string][]string, byNode map[string][]string) {
+	owners = make(map[string][]string, len(keys))
+	byNode = make(map[string][]string)
+	for _, key := range keys {
+		if _, seen := owners[key]; seen {
+			continue
+		}
+		ids := c.replicasFor(key)
+		if len(ids) == 0 {
+			continue
+		}
+		owners[key] = ids
+		for _, id := range ids {
+			byNode[id] = append(byNode[id], key)
+		}
+	}
+	return owners, byNode
+}
+
+// lockKeys takes the key locks of keys in stripe order, so concurrent
+// batches cannot deadlock, and returns a function that releases them.
+func (c *Cluster) lockKeys(keys []string) (unlock func()) {
+	stripes := make([]uint64, 0, len(keys))
+	for _, key := range keys {
+		stripes = append(stripes, c.keyHash(key)%numKeyLocks)
+	}
+	slices.Sort(stripes)
+	stripes = slices.Compact(stripes)
+	for _, s := range stripes {
+		c.keyLocks[s].Lock()
+	}
+	return func() {
+		for _, s := range stripes {
+			c.keyLocks[s].Unlock()
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newOpsCluster(t *testing.T) *Cluster {
+	return newTestCluster(t, 10, []string{"A", "B", "C"}, 0, WithReplication(2, 2, 1))
+}
+
+func TestDelete(t *testing.T) {
+	c := newOpsCluster(t)
+	c.Set("k", "v")
+	if err := c.Delete("k"); err != nil {
+		t.Fatalf("Delete returned %v", err)
+	}
+	if _, _, ok := c.Get("k"); ok {
+		t.Fatalf("expected k to be deleted")
+	}
+	for nodeID, count := range c.KeyCounts() {
+		if count != 0 {
+			t.Fatalf("node %s still holds %d keys", nodeID, count)
+		}
+	}
+	if err := c.Delete("k"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Delete of a missing key returned %v; want ErrNotFound", err)
+	}
+	if err := New(10).Delete("k"); !errors.Is(err, ErrNoQuorum) {
+		t.Fatalf("Delete on an empty cluster returned %v; want ErrNoQuorum", err)
+	}
+}
+
+func TestAddAndReplace(t *testing.T) {
+	c := newOpsCluster(t)
+	if err := c.Replace("k", "v", 0); !errors.Is(err, ErrNotStored) {
+		t.Fatalf("Replace of a missing key returned %v; want ErrNotStored", err)
+	}
+	if err := c.Add("k", "v1", 0); err != nil {
+		t.Fatalf("Add returned %v", err)
+	}
+	if err := c.Add("k", "v2", 0); !errors.Is(err, ErrNotStored) {
+		t.Fatalf("Add of a present key returned %v; want ErrNotStored", err)
+	}
+	if err := c.Replace("k", "v3", 0); err != nil {
+		t.Fatalf("Replace returned %v", err)
+	}
+	if val, _, _ := c.Get("k"); val != "v3" {
+		t.Fatalf("got %q, want v3", val)
+	}
+
+	t.Run("expired keys count as absent", func(t *testing.T) {
+		clock := &fakeClock{now: time.Unix(1000, 0)}
+		c := New(10, WithClock(clock.Now))
+		c.AddNode("A")
+		c.Add("k", "old", time.Second)
+		clock.Advance(time.Second)
+		if err := c.Add("k", "new", 0); err != nil {
+			t.Fatalf("Add over an expired key returned %v", err)
+		}
+	})
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	c := newOpsCluster(t)
+	if err := c.CompareAndSwap("k", "v", 1, 0); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("CompareAndSwap of a missing key returned %v; want ErrNotFound", err)
+	}
+	c.Set("k", "v1")
+	_, version, ok := c.GetWithVersion("k")
+	if !ok {
+		t.Fatalf("expected k to be present")
+	}
+	if err := c.CompareAndSwap("k", "v2", version, 0); err != nil {
+		t.Fatalf("CompareAndSwap returned %v", err)
+	}
+	if err := c.CompareAndSwap("k", "v3", version, 0); !errors.Is(err, ErrExists) {
+		t.Fatalf("CompareAndSwap with a stale version returned %v; want ErrExists", err)
+	}
+	if val, _, _ := c.Get("k"); val != "v2" {
+		t.Fatalf("got %q, want v2", val)
+	}
+
+	t.Run("concurrent swaps lose no updates", func(t *testing.T) {
+		c.Set("counter", "0")
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for done := 0; done < 50; {
+					val, version, _ := c.GetWithVersion("counter")
+					var n int
+					fmt.Sscan(val, &n)
+					if c.CompareAndSwap("counter", fmt.Sprint(n+1), version, 0) == nil {
+						done++
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if val, _, _ := c.Get("counter"); val != "400" {
+			t.Fatalf("counter is %s; want 400", val)
+		}
+	})
+}
+
+func TestIncrDecr(t *testing.T) {
+	c := newOpsCluster(t)
+	if _, err := c.Incr("n", 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Incr of a missing key returned %v; want ErrNotFound", err)
+	}
+	c.Set("word", "abc")
+	if _, err := c.Incr("word", 1); !errors.Is(err, ErrNotNumber) {
+		t.Fatalf("Incr of a non-number returned %v; want ErrNotNumber", err)
+	}
+
+	c.Set("n", "10")
+	if n, err := c.Incr("n", 5); err != nil || n != 15 {
+		t.Fatalf("Incr returned %d, %v; want 15", n, err)
+	}
+	if n, err := c.Decr("n", 20); err != nil || n != 0 {
+		t.Fatalf("Decr returned %d, %v; want 0", n, err)
+	}
+	c.Set("n", fmt.Sprint(uint64(math.MaxUint64)))
+	if n, err := c.Incr("n", 2); err != nil || n != 1 {
+		t.Fatalf("Incr returned %d, %v; want 1 after wrapping", n, err)
+	}
+
+	var wg sync.WaitGroup
+	c.Set("hits", "0")
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				c.Incr("hits", 1)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, id := range c.LookupReplicas("hits") {
+		if e, _ := c.nodes[id].get("hits"); e.value != "800" {
+			t.Fatalf("replica %s holds %s; want 800", id, e.value)
+		}
+	}
+}
+
+func TestMultiGetAndMultiSet(t *testing.T) {
+	c := newOpsCluster(t)
+	items := make(map[string]string)
+	keys := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		items[key] = "val-" + key
+		keys = append(keys, key)
+	}
+	if !c.MultiSet(items) {
+		t.Fatalf("expected MultiSet to succeed")
+	}
+	checkReplicaPlacement(t, c, 100)
+
+	got := c.MultiGet(append(keys, "missing"))
+	if len(got) != len(items) {
+		t.Fatalf("MultiGet returned %d keys; want %d", len(got), len(items))
+	}
+	for key, want := range items {
+		if got[key] != want {
+			t.Fatalf("MultiGet(%s) = %q, want %q", key, got[key], want)
+		}
+	}
+
+	t.Run("repairs replicas", func(t *testing.T) {
+		owners := c.LookupReplicas("key-7")
+		c.nodes[owners[1]].delete("key-7")
+		if got := c.MultiGet([]string{"key-7"}); got["key-7"] != "val-key-7" {
+			t.Fatalf("MultiGet returned %q", got["key-7"])
+		}
+		if _, ok := c.nodes[owners[1]].get("key-7"); !ok {
+			t.Fatalf("expected MultiGet to repair replica %s", owners[1])
+		}
+	})
+
+	if New(10).MultiSet(items) {
+		t.Fatalf("expected MultiSet on an empty cluster to fail")
+	}
+}
@@ -0,0 +1,468 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultCompactAfter is the log size at which a node compacts its log into
+// a snapshot when Persistence.CompactAfter is not set.
+const DefaultCompactAfter = 4 << 20
+
+// Names of the files in a node's directory.
+const (
+	logFile      = "log"
+	snapshotFile = "snapshot"
+)
+
+// errCorrupt means a snapshot failed its checksum.
+var errCorrupt = errors.New("cluster: corrupt snapshot")
+
+// Persistence makes nodes durable. Every write and removal is appended to a
+// log in the node's directory under Dir, and once the log has grown past
+// CompactAfter bytes the node's contents are written to a snapshot and the
+// log starts over. A node opened on a directory it used before recovers its
+// keys from the snapshot and the log; a record torn by a crash is dropped.
+type Persistence struct {
+	Dir          string
+	CompactAfter int64
+	// Fsync syncs the log after every record. Without it, records reach the
+	// operating system at once, which survives the process crashing but not
+	// the machine.
+	Fsync bool
+}
+
+// enabled reports whether nodes persist their keys.
+func (p Persistence) enabled() bool { return p.Dir != "" }
+
+// WithPersistence stores every node's keys under p.Dir, so a node that is
+// added again after the process restarted, or after Crash, comes back with
+// the keys it had. Keys deleted or overwritten on other replicas while the
+// node was away are reconciled by version when it rejoins; keys deleted
+// while it was away and not held anywhere else come back with it.
+func WithPersistence(p Persistence) Option {
+	return func(c *Cluster) {
+		c.persistence = p
+	}
+}
+
+// PersistenceErrors returns the nodes that stopped persisting their keys and
+// why. They keep serving from memory.
+func (c *Cluster) PersistenceErrors() map[string]error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	errs := make(map[string]error)
+	for id, node := range c.nodes {
+		if err := node.Err(); err != nil {
+			errs[id] = err
+		}
+	}
+	return errs
+}
+
+// Close closes the files of every node. Under persistence, a cluster created
+// later on the same directory recovers the nodes' keys as they are added.
+// The cluster must not be used afterwards.
+func (c *Cluster) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var errs []error
+	for _, nodes := range []map[string]*CacheNode{c.nodes, c.retired} {
+		for _, node := range nodes {
+			errs = append(errs, node.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// OpenCacheNode is like NewCacheNode, but the node keeps its keys in a log and
+// snapshot in its directory under p.Dir and recovers them from there. Close
+// the node to release its files.
+func OpenCacheNode(nodeID string, capacity Capacity, p Persistence) (*CacheNode, error) {
+	n := NewCacheNode(nodeID, capacity)
+	n.cfg.persistence = p
+	if err := n.open(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Op codes of log records.
+const (
+	opPut byte = iota + 1
+	opDelete
+)
+
+// nodeLog is the append-only log of a node.
+type nodeLog struct {
+	dir  string
+	cfg  Persistence
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+// open recovers the node's keys from its directory and starts logging to it.
+// The node must be new and not shared yet.
+func (n *CacheNode) open() error {
+	p := n.cfg.persistence
+	if p.CompactAfter <= 0 {
+		p.CompactAfter = DefaultCompactAfter
+	}
+	dir := filepath.Join(p.Dir, url.PathEscape(n.id))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := n.replay(filepath.Join(dir, snapshotFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("node %s: %w", n.id, err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	size, err := n.replayLog(f)
+	if err == nil {
+		// drop a record torn by a crash, so new records follow good ones
+		err = f.Truncate(size)
+	}
+	if err == nil {
+		_, err = f.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("node %s: %w", n.id, err)
+	}
+	n.log = &nodeLog{dir: dir, cfg: p, f: f, w: bufio.NewWriter(f), size: size}
+	return nil
+}
+
+// replay applies the records of the snapshot at path. Unlike the log, a
+// snapshot is written whole before it replaces the last one, so any bad
+// record means it is corrupt.
+func (n *CacheNode) replay(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	good, err := n.replayLog(f)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if good != info.Size() {
+		return errCorrupt
+	}
+	return nil
+}
+
+// replayLog applies the records of r from its start until the end or the
+// first record that is incomplete or fails its checksum, and returns the
+// offset after the last good record. It leaves r positioned there. A record
+// whose length runs past the end of r is incomplete, so a corrupt length is
+// never allocated.
+func (n *CacheNode) replayLog(r io.ReadSeeker) (int64, error) {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	br := bufio.NewReader(r)
+	var good int64
+	for {
+		length, err := binary.ReadUvarint(br)
+		if err != nil {
+			break
+		}
+		if rest := end - good - int64(uvarintLen(length)) - 4; rest < 0 || length > uint64(rest) {
+			break
+		}
+		buf := make([]byte, 4+length)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			break
+		}
+		payload := buf[4:]
+		if binary.LittleEndian.Uint32(buf) != crc32.ChecksumIEEE(payload) {
+			break
+		}
+		if !n.apply(payload) {
+			break
+		}
+		good += int64(uvarintLen(length)) + int64(len(buf))
+	}
+	_, err = r.Seek(good, io.SeekStart)
+	return good, err
+}
+
+// apply replays one record and reports whether it was well formed. The
+// caller must not have attached the log yet, so nothing is logged again.
+func (n *CacheNode) apply(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	op, rest := payload[0], payload[1:]
+	key, rest, ok := readBytes(rest)
+	if !ok {
+		return false
+	}
+	switch op {
+	case opDelete:
+		n.remove(string(key))
+		return len(rest) == 0
+	case opPut:
+		var e entry
+		var expires int64
+		var flags uint64
+		var value []byte
+		if e.version, rest, ok = readUvarint(rest); !ok {
+			return false
+		}
+		if expires, rest, ok = readVarint(rest); !ok {
+			return false
+		}
+		if flags, rest, ok = readUvarint(rest); !ok {
+			return false
+		}
+		if value, rest, ok = readBytes(rest); !ok || len(rest) != 0 {
+			return false
+		}
+		if expires != 0 {
+			e.expires = time.Unix(0, expires)
+		}
+		e.flags, e.value = uint32(flags), string(value)
+		// records are replayed in the order they happened, so the last
+		// one wins even when a version repeats
+		n.remove(string(key))
+		n.put(string(key), e)
+		return true
+	}
+	return false
+}
+
+// logPut appends the write of e to key to the log. The caller must hold mu.
+func (n *CacheNode) logPut(key string, e entry) {
+	if n.log == nil {
+		return
+	}
+	n.append(putRecord(key, e))
+}
+
+// putRecord encodes the write of e to key: the op code, the key, the
+// version, the expiry in unix nanoseconds or 0, the flags and the value.
+func putRecord(key string, e entry) []byte {
+	var expires int64
+	if !e.expires.IsZero() {
+		expires = e.expires.UnixNano()
+	}
+	rec := []byte{opPut}
+	rec = appendBytes(rec, key)
+	rec = binary.AppendUvarint(rec, e.version)
+	rec = binary.AppendVarint(rec, expires)
+	rec = binary.AppendUvarint(rec, uint64(e.flags))
+	return appendBytes(rec, e.value)
+}
+
+// frame prefixes a record with its length and CRC-32 checksum.
+func frame(payload []byte) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(payload)))
+	b = binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(payload))
+	return append(b, payload...)
+}
+
+// logDelete appends the removal of key to the log. The caller must hold mu.
+func (n *CacheNode) logDelete(key string) {
+	if n.log == nil {
+		return
+	}
+	n.append(appendBytes([]byte{opDelete}, key))
+}
+
+// append writes one record and compacts the log once it is large enough.
+// The first error stops logging; see Err. The caller must hold mu.
+func (n *CacheNode) append(payload []byte) {
+	l := n.log
+	rec := frame(payload)
+	if _, err := l.w.Write(rec); err != nil {
+		n.fail(err)
+		return
+	}
+	if err := l.w.Flush(); err != nil {
+		n.fail(err)
+		return
+	}
+	if l.cfg.Fsync {
+		if err := l.f.Sync(); err != nil {
+			n.fail(err)
+			return
+		}
+	}
+	l.size += int64(len(rec))
+	if l.size >= l.cfg.CompactAfter {
+		if err := n.compact(); err != nil {
+			n.fail(err)
+		}
+	}
+}
+
+// compact writes every unexpired entry to a new snapshot, replaces the old
+// one and empties the log. A crash at any point leaves either the old
+// snapshot and the full log, or the new snapshot and a log whose replay
+// changes nothing. The caller must hold mu.
+func (n *CacheNode) compact() error {
+	l := n.log
+	tmp := filepath.Join(l.dir, snapshotFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	now := n.cfg.now()
+	for key, e := range n.data {
+		if e.expired(now) {
+			continue
+		}
+		w.Write(frame(putRecord(key, e)))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(l.dir, snapshotFile))
+	}
+	if err == nil {
+		err = syncDir(l.dir)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := l.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	l.size = 0
+	return nil
+}
+
+// fail records the first persistence error and stops logging, so the files
+// keep a consistent prefix of the node's history.
+func (n *CacheNode) fail(err error) {
+	if n.err == nil {
+		n.err = fmt.Errorf("node %s: %w", n.id, err)
+	}
+	n.log.f.Close()
+	n.log = nil
+}
+
+// Compact writes the node's keys to a snapshot and empties its log. It is a
+// no-op for a node without persistence.
+func (n *CacheNode) Compact() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.log == nil {
+		return n.err
+	}
+	if err := n.compact(); err != nil {
+		n.fail(err)
+	}
+	return n.err
+}
+
+// Err returns the error that stopped the node from persisting its keys, or
+// nil. After an error the node keeps serving from memory.
+func (n *CacheNode) Err() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.err
+}
+
+// Close flushes and closes the node's log. The node must not be written to
+// afterwards. It is a no-op for a node without persistence.
+func (n *CacheNode) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.log == nil {
+		return n.err
+	}
+	err := n.log.w.Flush()
+	if cerr := n.log.f.Close(); err == nil {
+		err = cerr
+	}
+	n.log = nil
+	return err
+}
+
+// destroy closes the node and deletes its files, once its keys live
+// elsewhere.
+func (n *CacheNode) destroy() error {
+	n.mu.Lock()
+	l := n.log
+	n.mu.Unlock()
+	if l == nil {
+		return nil
+	}
+	n.Close()
+	return os.RemoveAll(l.dir)
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func appendBytes(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func readBytes(b []byte) (field, rest []byte, ok bool) {
+	length, rest, ok := readUvarint(b)
+	if !ok || length > uint64(len(rest)) {
+		return nil, nil, false
+	}
+	return rest[:length], rest[length:], true
+}
+
+func readUvarint(b []byte) (uint64, []byte, bool) {
+	v, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, false
+	}
+	return v, b[n:], true
+}
+
+func readVarint(b []byte) (int64, []byte, bool) {
+	v, n := binary.Varint(b)
+	if n <= 0 {
+		return 0, nil, false
+	}
+	return v, b[n:], true
+}
+
+func uvarintLen(v uint64) int {
+	return len(binary.AppendUvarint(nil, v))
+}
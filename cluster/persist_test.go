@@ -0,0 +1,232 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNodePersistence(t *testing.T) {
+	p := Persistence{Dir: t.TempDir()}
+	expires := time.Now().Add(time.Hour).Truncate(0)
+
+	n, err := OpenCacheNode("node-1", Capacity{}, p)
+	if err != nil {
+		t.Fatalf("OpenCacheNode: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		n.Set(fmt.Sprintf("key-%d", i), Item{Value: fmt.Sprintf("v%d", i), Flags: uint32(i)})
+	}
+	n.Set("ttl", Item{Value: "x", Expires: expires})
+	n.Set("key-1", Item{Value: "changed"})
+	n.Delete("key-2")
+	if err := n.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	reopen := func(t *testing.T) *CacheNode {
+		t.Helper()
+		n, err := OpenCacheNode("node-1", Capacity{}, p)
+		if err != nil {
+			t.Fatalf("OpenCacheNode: %v", err)
+		}
+		t.Cleanup(func() { n.Close() })
+		return n
+	}
+
+	t.Run("recover", func(t *testing.T) {
+		n := reopen(t)
+		if got := n.Len(); got != 100 {
+			t.Fatalf("recovered %d keys, want %d", got, 100)
+		}
+		if it, ok := n.Get("key-3"); !ok || it.Value != "v3" || it.Flags != 3 {
+			t.Fatalf("key-3 recovered as %+v, %v", it, ok)
+		}
+		if it, _ := n.Get("key-1"); it.Value != "changed" {
+			t.Fatalf("key-1 recovered as %q, want the last write", it.Value)
+		}
+		if _, ok := n.Get("key-2"); ok {
+			t.Fatalf("deleted key-2 came back")
+		}
+		if it, _ := n.Get("ttl"); !it.Expires.Equal(expires) {
+			t.Fatalf("ttl expires at %v, want %v", it.Expires, expires)
+		}
+		// versions keep increasing after a restart
+		before, _ := n.Get("key-5")
+		if cas := n.Set("key-5", Item{Value: "new"}); cas <= before.CAS {
+			t.Fatalf("new version %d not above recovered %d", cas, before.CAS)
+		}
+		n.Close()
+	})
+
+	t.Run("torn record", func(t *testing.T) {
+		path := filepath.Join(p.Dir, "node-1", logFile)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		// a crash in the middle of the last record
+		if err := os.Truncate(path, info.Size()-2); err != nil {
+			t.Fatalf("Truncate: %v", err)
+		}
+		n := reopen(t)
+		if it, _ := n.Get("key-5"); it.Value != "v5" {
+			t.Fatalf("key-5 = %q; the torn write should be lost", it.Value)
+		}
+		if it, _ := n.Get("key-6"); it.Value != "v6" {
+			t.Fatalf("key-6 = %q; records before the torn one should survive", it.Value)
+		}
+		n.Set("after", Item{Value: "ok"})
+		n.Close()
+		if it, _ := reopen(t).Get("after"); it.Value != "ok" {
+			t.Fatalf("write after recovery lost")
+		}
+	})
+
+	t.Run("corrupt length", func(t *testing.T) {
+		path := filepath.Join(p.Dir, "node-1", logFile)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+		// a length far past the end of the log
+		f.Write(binary.AppendUvarint(nil, 1<<32))
+		f.Write([]byte("tail"))
+		f.Close()
+		n := reopen(t)
+		if it, _ := n.Get("after"); it.Value != "ok" {
+			t.Fatalf("records before the corrupt one should survive")
+		}
+		n.Set("later", Item{Value: "ok"})
+		n.Close()
+		if it, _ := reopen(t).Get("later"); it.Value != "ok" {
+			t.Fatalf("write after recovery lost")
+		}
+	})
+
+	t.Run("compaction", func(t *testing.T) {
+		p := Persistence{Dir: t.TempDir(), CompactAfter: 512}
+		n, err := OpenCacheNode("node-2", Capacity{}, p)
+		if err != nil {
+			t.Fatalf("OpenCacheNode: %v", err)
+		}
+		for round := 0; round < 5; round++ {
+			for i := 0; i < 50; i++ {
+				n.Set(fmt.Sprintf("key-%d", i), Item{Value: fmt.Sprintf("round-%d", round)})
+			}
+		}
+		n.Close()
+		info, err := os.Stat(filepath.Join(p.Dir, "node-2", logFile))
+		if err != nil || info.Size() >= 512 {
+			t.Fatalf("log not compacted: %v, %v", info, err)
+		}
+		if _, err := os.Stat(filepath.Join(p.Dir, "node-2", snapshotFile)); err != nil {
+			t.Fatalf("no snapshot: %v", err)
+		}
+		n, err = OpenCacheNode("node-2", Capacity{}, p)
+		if err != nil {
+			t.Fatalf("OpenCacheNode: %v", err)
+		}
+		defer n.Close()
+		for i := 0; i < 50; i++ {
+			if it, _ := n.Get(fmt.Sprintf("key-%d", i)); it.Value != "round-4" {
+				t.Fatalf("key-%d = %q after compaction", i, it.Value)
+			}
+		}
+	})
+
+	t.Run("corrupt snapshot", func(t *testing.T) {
+		p := Persistence{Dir: t.TempDir()}
+		n, _ := OpenCacheNode("node-3", Capacity{}, p)
+		n.Set("a", Item{Value: "b"})
+		if err := n.Compact(); err != nil {
+			t.Fatalf("Compact: %v", err)
+		}
+		n.Close()
+		path := filepath.Join(p.Dir, "node-3", snapshotFile)
+		data, _ := os.ReadFile(path)
+		data[len(data)-1] ^= 0xff
+		os.WriteFile(path, data, 0o644)
+		if _, err := OpenCacheNode("node-3", Capacity{}, p); !errors.Is(err, errCorrupt) {
+			t.Fatalf("OpenCacheNode of a corrupt snapshot got %v", err)
+		}
+	})
+}
+
+func TestClusterPersistence(t *testing.T) {
+	const numKeys = 300
+	p := Persistence{Dir: t.TempDir(), CompactAfter: 4096}
+	nodes := []string{"A", "B", "C"}
+	start := func(t *testing.T) *Cluster {
+		t.Helper()
+		c := New(20, WithPersistence(p))
+		for _, id := range nodes {
+			c.AddNode(id)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	checkKeys := func(t *testing.T, c *Cluster, prefix string) {
+		t.Helper()
+		for i := 0; i < numKeys; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			if v, _, ok := c.Get(key); !ok || v != prefix+key {
+				t.Fatalf("Get(%s) = %q, %v; want %q", key, v, ok, prefix+key)
+			}
+		}
+	}
+
+	c := start(t)
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		c.Set(key, "v1-"+key)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	t.Run("restart", func(t *testing.T) {
+		c := start(t)
+		checkKeys(t, c, "v1-")
+		// new writes must win over the recovered versions
+		for i := 0; i < numKeys; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			c.Set(key, "v2-"+key)
+		}
+		checkKeys(t, c, "v2-")
+		if errs := c.PersistenceErrors(); len(errs) != 0 {
+			t.Fatalf("persistence errors: %v", errs)
+		}
+		c.Close()
+	})
+
+	t.Run("crash and rejoin", func(t *testing.T) {
+		c := start(t)
+		held := c.KeyCounts()["B"]
+		c.Crash("B")
+		if got := c.KeyCounts()["B"]; got != 0 {
+			t.Fatalf("crashed node still counted with %d keys", got)
+		}
+		c.AddNode("B")
+		if got := c.KeyCounts()["B"]; got != held {
+			t.Fatalf("B rejoined with %d keys, want %d", got, held)
+		}
+		checkKeys(t, c, "v2-")
+		c.Close()
+	})
+
+	t.Run("remove deletes files", func(t *testing.T) {
+		c := start(t)
+		c.RemoveNode("C")
+		if _, err := os.Stat(filepath.Join(p.Dir, "C")); !os.IsNotExist(err) {
+			t.Fatalf("files of removed node kept: %v", err)
+		}
+		checkKeys(t, c, "v2-")
+		c.AddNode("C")
+		checkKeys(t, c, "v2-")
+	})
+}
@@ -0,0 +1,415 @@
+package cluster
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultRebalanceBatch is the number of keys the rebalancer moves between
+// throttling pauses when RebalanceLimit.BatchSize is not set.
+const DefaultRebalanceBatch = 100
+
+// RebalanceLimit throttles background rebalancing. Zero limits are
+// unlimited.
+type RebalanceLimit struct {
+	KeysPerSecond  int
+	BytesPerSecond int
+	// BatchSize is the number of keys moved at a time. The cluster is only
+	// locked against membership changes while a batch is moved.
+	BatchSize int
+}
+
+// RebalanceProgress reports on the current or most recent rebalance run.
+type RebalanceProgress struct {
+	// Running is true from the first membership change of a run until all
+	// of its ranges are moved or it is cancelled, including while paused.
+	Running   bool
+	Paused    bool
+	Cancelled bool
+	// RangesDone of RangesTotal hash ranges have been moved.
+	RangesDone, RangesTotal int
+	// KeysDone of about KeysTotal keys have been visited. Keys written while
+	// the run goes on can make KeysDone exceed KeysTotal.
+	KeysDone, KeysTotal int
+	// Bytes counts the key and value bytes copied.
+	Bytes int
+	MigrationStats
+	// ETA estimates the time left from the rate so far; 0 when unknown.
+	ETA time.Duration
+}
+
+// WithRebalancer makes membership changes return as soon as the ring is
+// updated and moves the affected keys in the background, throttled by limit.
+// Until a range is moved, reads of keys its new owners do not hold fall back
+// to the nodes that held them before, including removed nodes, which keep
+// their data until the run completes. Under bounded loads every key may move
+// on a membership change, so keys are still moved before it returns.
+func WithRebalancer(limit RebalanceLimit) Option {
+	return func(c *Cluster) {
+		if limit.BatchSize <= 0 {
+			limit.BatchSize = DefaultRebalanceBatch
+		}
+		c.rebalance = &rebalancer{c: c, limit: limit}
+		c.rebalance.cond = sync.NewCond(&c.rebalance.mu)
+	}
+}
+
+// rebalancer moves the keys of unsettled ranges to their replicas, one range
+// at a time and one batch of keys at a time. Lock order is Cluster.mu before
+// rebalancer.mu; the worker never holds mu while taking Cluster.mu.
+type rebalancer struct {
+	c     *Cluster
+	limit RebalanceLimit
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// ranges whose keys may still be on their previous holders, in the order
+	// they are moved; the worker is moving the first one
+	queue []span
+	// queue merged and sorted, for covers
+	unsettled spanSet
+	// the run in progress, nil if none
+	cur      *run
+	progress RebalanceProgress
+	started  time.Time
+}
+
+// run is one pass of the worker over the queue. A cancelled run may still be
+// finishing a batch after the next one started, so the worker only touches
+// the queue and the progress while its run is current.
+type run struct {
+	// closed when the worker exits
+	done chan struct{}
+	// closed to interrupt the worker
+	cancel chan struct{}
+}
+
+// migrate moves the keys whose hashes fall in spans to their current
+// replicas: before returning, or in the background when a rebalancer is
+// configured. Removed nodes are dropped once their keys have moved. The
+// caller must hold the write lock.
+func (c *Cluster) migrate(spans spanSet) MigrationStats {
+	if c.rebalance == nil || c.epsilon > 0 {
+		stats := c.reconcile(spans)
+		if c.rebalance == nil || !c.rebalance.running() {
+			c.dropRetired()
+		}
+		return stats
+	}
+	c.rebalance.enqueue(spans)
+	return MigrationStats{}
+}
+
+// dropRetired forgets the removed nodes once their keys have moved, deleting
+// their files under persistence. The caller must hold the write lock.
+func (c *Cluster) dropRetired() {
+	for id, node := range c.retired {
+		node.destroy()
+		delete(c.retired, id)
+	}
+}
+
+// unsettled reports whether key lies in a range the rebalancer or a
+// decommission has yet to move, so that its previous holders may still have
+// it. The caller must hold mu.
+func (c *Cluster) unsettled(key string) bool {
+	hash := c.keyHash(key)
+	return (c.rebalance != nil && c.rebalance.covers(hash)) || c.decommissionCovers(hash)
+}
+
+// previous returns the newest entry of key held by a node that is not one of
+// owners, removed nodes included, and that node's ID, or "" if none holds
+// it. The caller must hold mu.
+func (c *Cluster) previous(key string, owners []string) (best entry, bestNode string) {
+	for _, node := range c.holdersOf(key) {
+		if slices.Contains(owners, node.id) {
+			continue
+		}
+		if e, exists := node.get(key); exists && (bestNode == "" || e.version > best.version) {
+			best, bestNode = e, node.id
+		}
+	}
+	return best, bestNode
+}
+
+// holdersOf returns the nodes, removed ones included, that hold key. The
+// caller must hold mu.
+func (c *Cluster) holdersOf(key string) []*CacheNode {
+	var found []*CacheNode
+	for _, nodes := range []map[string]*CacheNode{c.nodes, c.retired} {
+		for _, node := range nodes {
+			if _, exists := node.get(key); exists {
+				found = append(found, node)
+			}
+		}
+	}
+	return found
+}
+
+// RebalanceProgress returns the progress of the current or most recent
+// rebalance run. It is the zero value without WithRebalancer.
+func (c *Cluster) RebalanceProgress() RebalanceProgress {
+	if c.rebalance == nil {
+		return RebalanceProgress{}
+	}
+	r := c.rebalance
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := r.progress
+	if p.Running && p.KeysDone > 0 && p.KeysDone < p.KeysTotal {
+		elapsed := time.Since(r.started)
+		p.ETA = elapsed * time.Duration(p.KeysTotal-p.KeysDone) / time.Duration(p.KeysDone)
+	}
+	return p
+}
+
+// PauseRebalance stops the rebalancer after the batch it is moving. Reads
+// keep falling back to the previous holders of the ranges not yet moved.
+func (c *Cluster) PauseRebalance() {
+	if c.rebalance == nil {
+		return
+	}
+	r := c.rebalance
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cur != nil {
+		r.progress.Paused = true
+	}
+}
+
+// ResumeRebalance continues a paused run, or starts a new run over the
+// ranges a cancelled one left behind.
+func (c *Cluster) ResumeRebalance() {
+	if c.rebalance == nil {
+		return
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	r := c.rebalance
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.progress.Paused = false
+	r.cond.Broadcast()
+	if r.cur == nil && len(r.queue) > 0 {
+		r.start()
+	}
+}
+
+// CancelRebalance ends the current run after the batch it is moving. The
+// ranges it did not move stay unsettled: reads still fall back to their
+// previous holders, and the next membership change or ResumeRebalance moves
+// them in a new run.
+func (c *Cluster) CancelRebalance() {
+	if c.rebalance == nil {
+		return
+	}
+	r := c.rebalance
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cur == nil {
+		return
+	}
+	close(r.cur.cancel)
+	r.cur = nil
+	r.progress.Running = false
+	r.progress.Paused = false
+	r.progress.Cancelled = true
+	r.cond.Broadcast()
+}
+
+// WaitRebalance blocks until the current run completes or is cancelled and
+// returns its final progress.
+func (c *Cluster) WaitRebalance() RebalanceProgress {
+	if c.rebalance == nil {
+		return RebalanceProgress{}
+	}
+	r := c.rebalance
+	r.mu.Lock()
+	cur := r.cur
+	r.mu.Unlock()
+	if cur != nil {
+		select {
+		case <-cur.done:
+		case <-cur.cancel:
+		}
+	}
+	return c.RebalanceProgress()
+}
+
+// running reports whether a run is in progress.
+func (r *rebalancer) running() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cur != nil
+}
+
+// covers reports whether hash lies in an unsettled range.
+func (r *rebalancer) covers(hash uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.unsettled.contains(hash)
+}
+
+// enqueue adds spans to the ranges to move and starts a run if none is in
+// progress. The caller must hold Cluster.mu for writing.
+func (r *rebalancer) enqueue(spans spanSet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queue = append(r.queue, spans...)
+	r.unsettled = slices.Clone(spanSet(r.queue)).normalize()
+	if r.cur == nil {
+		r.start()
+		return
+	}
+	r.progress.RangesTotal += len(spans)
+	r.progress.KeysTotal += len(r.c.holders(spans))
+}
+
+// start begins a new run over the queued ranges. The caller must hold
+// Cluster.mu and r.mu.
+func (r *rebalancer) start() {
+	r.progress = RebalanceProgress{
+		Running:     true,
+		RangesTotal: len(r.queue),
+		KeysTotal:   len(r.c.holders(r.unsettled)),
+	}
+	r.started = time.Now()
+	r.cur = &run{done: make(chan struct{}), cancel: make(chan struct{})}
+	go r.run(r.cur)
+}
+
+// run moves the queued ranges until none are left or the run is cancelled.
+func (r *rebalancer) run(cur *run) {
+	defer close(cur.done)
+	for {
+		r.mu.Lock()
+		for r.cur == cur && r.progress.Paused {
+			r.cond.Wait()
+		}
+		if r.cur != cur {
+			r.mu.Unlock()
+			return
+		}
+		if len(r.queue) == 0 {
+			r.mu.Unlock()
+			if r.finish(cur) {
+				return
+			}
+			continue
+		}
+		sp := r.queue[0]
+		r.mu.Unlock()
+
+		if !r.moveRange(cur, sp) {
+			continue
+		}
+		r.mu.Lock()
+		if r.cur == cur {
+			r.queue = r.queue[1:]
+			r.unsettled = slices.Clone(spanSet(r.queue)).normalize()
+			r.progress.RangesDone++
+		}
+		r.mu.Unlock()
+	}
+}
+
+// finish ends the run once every range is moved and drops the removed
+// nodes. It returns false if a membership change queued more ranges in the
+// meantime.
+func (r *rebalancer) finish(cur *run) bool {
+	c := r.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cur != cur {
+		return true
+	}
+	if len(r.queue) > 0 {
+		return false
+	}
+	c.dropRetired()
+	r.cur = nil
+	r.progress.Running = false
+	return true
+}
+
+// moveRange moves the keys of sp to their replicas in throttled batches. It
+// returns false if the run was paused or cancelled before the range was
+// done, in which case the range stays queued and is moved again from the
+// start; keys already on their replicas are not copied twice.
+func (r *rebalancer) moveRange(cur *run, sp span) bool {
+	c := r.c
+	c.mu.RLock()
+	found := c.holders(spanSet{sp})
+	c.mu.RUnlock()
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+
+	for len(keys) > 0 {
+		batch := keys[:min(r.limit.BatchSize, len(keys))]
+		keys = keys[len(batch):]
+
+		c.mu.RLock()
+		evictionsBefore := c.totalEvictions()
+		moved, bytes := 0, 0
+		for _, key := range batch {
+			mu := c.keyLock(key)
+			mu.Lock()
+			copies, size := c.place(key, c.holdersOf(key), c.lookupReplicas(key))
+			mu.Unlock()
+			moved += copies
+			bytes += size
+		}
+		// evictions by concurrent writes are counted too
+		dropped := max(c.totalEvictions()-evictionsBefore, 0)
+		c.mu.RUnlock()
+
+		r.mu.Lock()
+		if r.cur != cur {
+			r.mu.Unlock()
+			return false
+		}
+		r.progress.KeysDone += len(batch)
+		r.progress.Bytes += bytes
+		r.progress.Moved += moved
+		r.progress.Dropped += dropped
+		wait := r.throttle()
+		r.mu.Unlock()
+
+		select {
+		case <-cur.cancel:
+			return false
+		case <-time.After(wait):
+		}
+		r.mu.Lock()
+		paused := r.progress.Paused
+		r.mu.Unlock()
+		if paused && len(keys) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// throttle returns how long the run must wait to get back within its
+// limits. The caller must hold r.mu.
+func (r *rebalancer) throttle() time.Duration {
+	return r.limit.wait(r.progress.KeysDone, r.progress.Bytes, r.started)
+}
+
+// wait returns how long a transfer that started at started and has moved
+// keys and bytes so far must wait to get back within the limits.
+func (l RebalanceLimit) wait(keys, bytes int, started time.Time) time.Duration {
+	var due time.Duration
+	if l.KeysPerSecond > 0 {
+		due = max(due, time.Duration(keys)*time.Second/time.Duration(l.KeysPerSecond))
+	}
+	if l.BytesPerSecond > 0 {
+		due = max(due, time.Duration(bytes)*time.Second/time.Duration(l.BytesPerSecond))
+	}
+	return max(due-time.Since(started), 0)
+}
@@ -0,0 +1,174 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newRebalancingCluster returns a cluster of three nodes holding numKeys keys
+// that rebalances in the background within limit.
+func newRebalancingCluster(t *testing.T, numKeys int, limit RebalanceLimit) *Cluster {
+	t.Helper()
+	return newTestCluster(t, 20, []string{"A", "B", "C"}, numKeys, WithRebalancer(limit))
+}
+
+// checkReadable fails unless every key reads back its value.
+func checkReadable(t *testing.T, c *Cluster, numKeys int) {
+	t.Helper()
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if v, _, ok := c.Get(key); !ok || v != "val-"+key {
+			t.Fatalf("Get(%s) = %q, %v", key, v, ok)
+		}
+	}
+}
+
+// checkSettled fails unless every key is stored only on its owner.
+func checkSettled(t *testing.T, c *Cluster, numKeys int) {
+	t.Helper()
+	owners := c.SnapshotKeyReplicas()
+	if len(owners) != numKeys {
+		t.Fatalf("cluster holds %d keys, want %d", len(owners), numKeys)
+	}
+	for key, holders := range owners {
+		want, _ := c.LookupKey(key)
+		if len(holders) != 1 || holders[0] != want {
+			t.Fatalf("key %s held by %v, want [%s]", key, holders, want)
+		}
+	}
+}
+
+func TestRebalancer(t *testing.T) {
+	const numKeys = 1000
+
+	t.Run("add node", func(t *testing.T) {
+		c := newRebalancingCluster(t, numKeys, RebalanceLimit{KeysPerSecond: 2000, BatchSize: 50})
+		if stats := c.AddNode("D"); stats != (MigrationStats{}) {
+			t.Fatalf("AddNode returned %+v; keys should move in the background", stats)
+		}
+		p := c.RebalanceProgress()
+		if !p.Running || p.RangesTotal == 0 || p.KeysTotal == 0 {
+			t.Fatalf("progress after AddNode %+v", p)
+		}
+		checkReadable(t, c, numKeys)
+
+		p = c.WaitRebalance()
+		if p.Running || p.RangesDone != p.RangesTotal || p.Moved == 0 || p.Bytes == 0 {
+			t.Fatalf("final progress %+v", p)
+		}
+		checkSettled(t, c, numKeys)
+		checkReadable(t, c, numKeys)
+		if c.KeyCounts()["D"] != p.Moved {
+			t.Fatalf("D holds %d keys, progress moved %d", c.KeyCounts()["D"], p.Moved)
+		}
+	})
+
+	t.Run("remove node", func(t *testing.T) {
+		c := newRebalancingCluster(t, numKeys, RebalanceLimit{KeysPerSecond: 2000, BatchSize: 50})
+		c.RemoveNode("B")
+		if _, held := c.KeyCounts()["B"]; held {
+			t.Fatalf("removed node still counted")
+		}
+		checkReadable(t, c, numKeys)
+		c.WaitRebalance()
+		checkSettled(t, c, numKeys)
+		c.mu.RLock()
+		retired := len(c.retired)
+		c.mu.RUnlock()
+		if retired != 0 {
+			t.Fatalf("%d removed nodes kept after the run", retired)
+		}
+	})
+
+	t.Run("throttled", func(t *testing.T) {
+		c := newRebalancingCluster(t, numKeys, RebalanceLimit{KeysPerSecond: 1000, BatchSize: 20})
+		start := time.Now()
+		c.AddNode("D")
+		time.Sleep(50 * time.Millisecond)
+		if p := c.RebalanceProgress(); p.ETA <= 0 {
+			t.Fatalf("no ETA while running: %+v", p)
+		}
+		p := c.WaitRebalance()
+		// every batch but the last waits for the limit
+		if min := time.Duration(p.KeysDone-20) * time.Second / 1000; time.Since(start) < min {
+			t.Fatalf("moved %d keys in %v; limit allows no less than %v", p.KeysDone, time.Since(start), min)
+		}
+	})
+
+	t.Run("pause and resume", func(t *testing.T) {
+		c := newRebalancingCluster(t, numKeys, RebalanceLimit{KeysPerSecond: 1000, BatchSize: 10})
+		c.AddNode("D")
+		c.PauseRebalance()
+		time.Sleep(50 * time.Millisecond)
+		done := c.RebalanceProgress().KeysDone
+		time.Sleep(100 * time.Millisecond)
+		p := c.RebalanceProgress()
+		if !p.Paused || !p.Running || p.KeysDone != done {
+			t.Fatalf("rebalancer kept moving while paused: %+v, %d keys before", p, done)
+		}
+		checkReadable(t, c, numKeys)
+
+		c.ResumeRebalance()
+		if p := c.WaitRebalance(); p.Paused || p.RangesDone != p.RangesTotal {
+			t.Fatalf("final progress %+v", p)
+		}
+		checkSettled(t, c, numKeys)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		c := newRebalancingCluster(t, numKeys, RebalanceLimit{KeysPerSecond: 1000, BatchSize: 10})
+		c.AddNode("D")
+		time.Sleep(20 * time.Millisecond)
+		c.CancelRebalance()
+		p := c.WaitRebalance()
+		if p.Running || !p.Cancelled || p.RangesDone == p.RangesTotal {
+			t.Fatalf("progress after cancel %+v", p)
+		}
+		// the ranges left behind are still readable, and writes to them win
+		checkReadable(t, c, numKeys)
+		c.Set("key-1", "val-key-1")
+
+		c.ResumeRebalance()
+		if p := c.WaitRebalance(); p.Cancelled || p.RangesDone != p.RangesTotal {
+			t.Fatalf("progress of the new run %+v", p)
+		}
+		checkSettled(t, c, numKeys)
+		checkReadable(t, c, numKeys)
+	})
+
+	t.Run("writes during a run", func(t *testing.T) {
+		c := newRebalancingCluster(t, numKeys, RebalanceLimit{KeysPerSecond: 1000, BatchSize: 10})
+		c.AddNode("D")
+		c.PauseRebalance()
+		for i := 0; i < numKeys; i += 2 {
+			if err := c.Delete(fmt.Sprintf("key-%d", i)); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+		}
+		for i := 1; i < numKeys; i += 2 {
+			key := fmt.Sprintf("key-%d", i)
+			if _, err := c.Incr(key+"-n", 1); err != ErrNotFound {
+				t.Fatalf("Incr of a missing key got %v", err)
+			}
+			c.Set(key, "new-"+key)
+		}
+		values := c.MultiGet([]string{"key-1", "key-2", "key-3"})
+		if len(values) != 2 || values["key-1"] != "new-key-1" {
+			t.Fatalf("MultiGet during the run got %v", values)
+		}
+
+		c.ResumeRebalance()
+		c.WaitRebalance()
+		for i := 0; i < numKeys; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			v, _, ok := c.Get(key)
+			if i%2 == 0 && ok {
+				t.Fatalf("deleted key %s came back as %q", key, v)
+			}
+			if i%2 == 1 && v != "new-"+key {
+				t.Fatalf("Get(%s) = %q, want the value written during the run", key, v)
+			}
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package cluster
+
+// NodeState is the health of a node, which decides how requests are routed
+// around it. Nodes are up unless set otherwise.
+type NodeState int
+
+const (
+	// StateUp nodes serve reads and writes.
+	StateUp NodeState = iota
+	// StateSuspect nodes may have failed without it being confirmed, such as
+	// after missed heartbeats. They keep serving reads and writes but hold
+	// no hints for other nodes.
+	StateSuspect
+	// StateDown nodes are skipped by reads and writes but keep their tokens,
+	// so no keys move during a short outage. With WithHintedHandoff their
+	// writes are kept as hints until they are up again.
+	StateDown
+	// StateDraining nodes are on their way out. Their ranges are served by
+	// the next nodes on the ring, which take the writes and receive the
+	// node's keys; until a key has moved, reads still find it on the
+	// draining node.
+	StateDraining
+)
+
+// String returns the name of the state.
+func (s NodeState) String() string {
+	switch s {
+	case StateUp:
+		return "up"
+	case StateSuspect:
+		return "suspect"
+	case StateDown:
+		return "down"
+	case StateDraining:
+		return "draining"
+	}
+	return "unknown"
+}
+
+// SetNodeState changes the state of a node. A node leaving StateDown gets
+// the hints held for it. Draining a node, or bringing it back from
+// draining, moves the keys of its ranges: before returning, or in the
+// background when a rebalancer is configured. Setting the state of a missing
+// node, or an unknown state, is a no-op, as is draining the last node that
+// is not draining, which would leave its keys without replicas.
+func (c *Cluster) SetNodeState(nodeID string, state NodeState) MigrationStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats, _ := c.setState(nodeID, state)
+	return stats
+}
+
+// NodeState returns the state of a node. ok is false if the node is not in
+// the cluster.
+func (c *Cluster) NodeState(nodeID string) (state NodeState, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, ok := c.nodes[nodeID]; !ok {
+		return StateUp, false
+	}
+	return c.states[nodeID], true
+}
+
+// NodeStates returns the state of every node.
+func (c *Cluster) NodeStates() map[string]NodeState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	states := make(map[string]NodeState, len(c.nodes))
+	for id := range c.nodes {
+		states[id] = c.states[id]
+	}
+	return states
+}
+
+// MarkDown sets a node to StateDown.
+func (c *Cluster) MarkDown(nodeID string) {
+	c.SetNodeState(nodeID, StateDown)
+}
+
+// MarkUp sets a node that is down to StateUp and returns the number of hints
+// delivered to it. Nodes in other states are left alone.
+func (c *Cluster) MarkUp(nodeID string) (delivered int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.isDown(nodeID) {
+		return 0
+	}
+	_, delivered = c.setState(nodeID, StateUp)
+	return delivered
+}
+
+// IsDown reports whether a node is in StateDown.
+func (c *Cluster) IsDown(nodeID string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.isDown(nodeID)
+}
+
+// setState implements SetNodeState and returns the number of hints
+// delivered. The caller must hold the write lock.
+func (c *Cluster) setState(nodeID string, state NodeState) (stats MigrationStats, delivered int) {
+	old := c.states[nodeID]
+	if _, exists := c.nodes[nodeID]; !exists || state == old || state < StateUp || state > StateDraining {
+		return MigrationStats{}, 0
+	}
+	if state == StateDraining && !c.othersServing(nodeID) {
+		return MigrationStats{}, 0
+	}
+	// the ranges whose replica sets gain or lose the node
+	var spans spanSet
+	if old == StateDraining || state == StateDraining {
+		spans = c.affectedSpans(nodeID, c.nodeTokens(nodeID))
+	}
+	if state == StateUp {
+		delete(c.states, nodeID)
+	} else {
+		c.states[nodeID] = state
+	}
+	if old == StateDown && c.handoff != nil {
+		delivered = c.deliverHints(nodeID)
+	}
+	if spans != nil {
+		stats = c.migrate(spans)
+		c.epoch++
+	}
+	return stats, delivered
+}
+
+// isDown reports whether nodeID is in StateDown. The caller must hold mu.
+func (c *Cluster) isDown(nodeID string) bool {
+	return c.states[nodeID] == StateDown
+}
+
+// draining returns the number of draining nodes. The caller must hold mu.
+func (c *Cluster) draining() int {
+	n := 0
+	for _, state := range c.states {
+		if state == StateDraining {
+			n++
+		}
+	}
+	return n
+}
+
+// othersServing reports whether any node other than nodeID is not draining,
+// so the ranges of nodeID have somewhere to go. The caller must hold mu.
+func (c *Cluster) othersServing(nodeID string) bool {
+	for id := range c.nodes {
+		if id != nodeID && c.states[id] != StateDraining {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutDraining removes the draining nodes from ids in place and returns
+// at most limit of the rest. The caller must hold mu.
+func (c *Cluster) withoutDraining(ids []string, limit int) []string {
+	kept := ids[:0]
+	for _, id := range ids {
+		if len(kept) < limit && c.states[id] != StateDraining {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
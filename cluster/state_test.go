@@ -0,0 +1,138 @@
+package cluster
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestNodeStates(t *testing.T) {
+	const numKeys = 1000
+
+	t.Run("names", func(t *testing.T) {
+		for state, want := range map[NodeState]string{StateUp: "up", StateSuspect: "suspect", StateDown: "down", StateDraining: "draining", 9: "unknown"} {
+			if got := state.String(); got != want {
+				t.Fatalf("NodeState(%d).String() = %q, want %q", int(state), got, want)
+			}
+		}
+	})
+
+	t.Run("down keeps tokens", func(t *testing.T) {
+		c := newTestCluster(t, 20, []string{"A", "B", "C", "D", "E"}, numKeys, WithReplication(3, 2, 2))
+		before := c.SnapshotKeyReplicas()
+		epoch := c.Epoch()
+		c.SetNodeState("B", StateDown)
+		if state, ok := c.NodeState("B"); !ok || state != StateDown || !c.IsDown("B") {
+			t.Fatalf("B in state %v, %v", state, ok)
+		}
+		if c.Epoch() != epoch || !slices.Contains(c.ListNodes(), "B") {
+			t.Fatalf("marking B down changed the membership")
+		}
+		for i := 0; i < numKeys; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			replicas := c.LookupReplicas(key)
+			primary, ok := c.LookupKey(key)
+			if !ok || primary == "B" {
+				t.Fatalf("LookupKey(%s) = %s, %v with B down", key, primary, ok)
+			}
+			if replicas[0] != "B" && primary != replicas[0] {
+				t.Fatalf("LookupKey(%s) = %s, want the primary %s", key, primary, replicas[0])
+			}
+			if v, nodeID, ok := c.Get(key); !ok || v != "val-"+key || nodeID == "B" {
+				t.Fatalf("Get(%s) = %q from %s, %v", key, v, nodeID, ok)
+			}
+		}
+		c.SetNodeState("B", StateUp)
+		if after := c.SnapshotKeyReplicas(); fmt.Sprint(after) != fmt.Sprint(before) {
+			t.Fatalf("keys moved during the outage")
+		}
+	})
+
+	t.Run("suspect holds no hints", func(t *testing.T) {
+		c := newTestCluster(t, 20, []string{"A", "B", "C", "D", "E"}, numKeys, WithReplication(3, 2, 2), WithHintedHandoff(HintedHandoff{}))
+		for _, id := range []string{"A", "C", "D", "E"} {
+			c.SetNodeState(id, StateSuspect)
+		}
+		c.SetNodeState("B", StateDown)
+		keys := keysOwnedBy(c, "B", 10)
+		for _, key := range keys {
+			// the suspect owners still take the write
+			if _, ok := c.Set(key, "new"); !ok {
+				t.Fatalf("Set(%s) failed with suspect replicas", key)
+			}
+		}
+		if stats := c.HintStats(); stats.Stored != 0 || stats.Dropped != len(keys) {
+			t.Fatalf("suspect nodes took hints: %+v", stats)
+		}
+		states := c.NodeStates()
+		if len(states) != 5 || states["A"] != StateSuspect || states["B"] != StateDown {
+			t.Fatalf("NodeStates() = %v", states)
+		}
+	})
+
+	t.Run("draining", func(t *testing.T) {
+		c := newTestCluster(t, 20, []string{"A", "B", "C", "D", "E"}, numKeys, WithReplication(3, 2, 2))
+		c.SetNodeState("B", StateDraining)
+		if got := c.KeyCounts()["B"]; got != 0 {
+			t.Fatalf("drained node holds %d keys", got)
+		}
+		checkReplicaPlacement(t, c, numKeys)
+		for i := 0; i < numKeys; i++ {
+			if replicas := c.LookupReplicas(fmt.Sprintf("key-%d", i)); len(replicas) != 3 || slices.Contains(replicas, "B") {
+				t.Fatalf("replicas %v of a key include the draining node", replicas)
+			}
+		}
+		c.Set("new", "val-new")
+		if _, held := c.nodes["B"].Get("new"); held {
+			t.Fatalf("draining node took a write")
+		}
+
+		c.SetNodeState("B", StateUp)
+		if c.KeyCounts()["B"] == 0 {
+			t.Fatalf("B got no keys back")
+		}
+		checkReplicaPlacement(t, c, numKeys+1)
+	})
+
+	t.Run("draining serves reads until keys move", func(t *testing.T) {
+		c := newRebalancingCluster(t, numKeys, RebalanceLimit{KeysPerSecond: 1000, BatchSize: 10})
+		held := c.KeyCounts()["B"]
+		c.SetNodeState("B", StateDraining)
+		c.PauseRebalance()
+		if got := c.KeyCounts()["B"]; got == 0 {
+			t.Fatalf("B holds none of its %d keys while paused", held)
+		}
+		checkReadable(t, c, numKeys)
+
+		c.ResumeRebalance()
+		c.WaitRebalance()
+		if got := c.KeyCounts()["B"]; got != 0 {
+			t.Fatalf("B holds %d keys after draining", got)
+		}
+		checkSettled(t, c, numKeys)
+		checkReadable(t, c, numKeys)
+	})
+
+	t.Run("draining the last node", func(t *testing.T) {
+		c := newTestCluster(t, 20, []string{"A"}, 100)
+		if stats := c.SetNodeState("A", StateDraining); stats != (MigrationStats{}) {
+			t.Fatalf("draining the only node moved keys: %+v", stats)
+		}
+		if state, _ := c.NodeState("A"); state != StateUp {
+			t.Fatalf("the only node went %v", state)
+		}
+		if got := c.KeyCounts()["A"]; got != 100 {
+			t.Fatalf("the only node holds %d of 100 keys", got)
+		}
+	})
+
+	t.Run("missing node", func(t *testing.T) {
+		c := newTestCluster(t, 20, []string{"A", "B", "C", "D", "E"}, numKeys, WithReplication(3, 2, 2))
+		if stats := c.SetNodeState("Z", StateDraining); stats != (MigrationStats{}) {
+			t.Fatalf("draining a missing node moved keys: %+v", stats)
+		}
+		if _, ok := c.NodeState("Z"); ok {
+			t.Fatalf("missing node has a state")
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"cache-ring/cluster"
+	"cache-ring/membership"
+	"cache-ring/server"
+)
+
+func main() {
+	var addr, id, policy, gossipAddr, join, dataDir string
+	var maxEntries, maxBytes int
+	var fsync bool
+	hostname, _ := os.Hostname()
+	flag.StringVar(&addr, "addr", ":11211", "TCP address to listen on")
+	flag.StringVar(&id, "id", hostname, "node identifier")
+	flag.IntVar(&maxEntries, "max-entries", 0, "most keys to hold before evicting; 0 is unlimited")
+	flag.IntVar(&maxBytes, "max-bytes", 0, "most bytes of keys plus values to hold before evicting; 0 is unlimited")
+	flag.StringVar(&policy, "policy", "lru", "eviction policy: lru, lfu or arc")
+	flag.StringVar(&gossipAddr, "gossip", "", "UDP address for membership gossip; empty disables it")
+	flag.StringVar(&join, "join", "", "comma-separated gossip addresses of members to join")
+	flag.StringVar(&dataDir, "data-dir", "", "directory to persist keys in and recover them from; empty keeps them in memory only")
+	flag.BoolVar(&fsync, "fsync", false, "sync the data log to disk after every write")
+	flag.Parse()
+
+	capacity := cluster.Capacity{MaxEntries: maxEntries, MaxBytes: maxBytes}
+	switch policy {
+	case "lru":
+		capacity.Policy = cluster.LRU
+	case "lfu":
+		capacity.Policy = cluster.LFU
+	case "arc":
+		capacity.Policy = cluster.ARC
+	default:
+		log.Fatalf("unknown eviction policy %q", policy)
+	}
+
+	var members *membership.Memberlist
+	if gossipAddr != "" {
+		var err error
+		members, err = membership.New(id, gossipAddr, membership.WithNotify(func(e membership.Event) {
+			log.Printf("member %s %s (%s)", e.Member.Name, e.Type, e.Member.Addr)
+		}))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if join != "" {
+			if err := members.Join(5*time.Second, strings.Split(join, ",")...); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	node := cluster.NewCacheNode(id, capacity)
+	if dataDir != "" {
+		var err error
+		node, err = cluster.OpenCacheNode(id, capacity, cluster.Persistence{Dir: dataDir, Fsync: fsync})
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("recovered %d keys from %s", node.Len(), dataDir)
+	}
+
+	srv := server.New(node)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		if members != nil {
+			members.Leave(time.Second)
+			members.Shutdown()
+		}
+		srv.Close()
+	}()
+
+	log.Printf("cache node %s listening on %s", id, addr)
+	if err := srv.ListenAndServe(addr); !errors.Is(err, server.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	if err := node.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -3,17 +3,24 @@ package main
 import (
 	"flag"
 	"fmt"
+	"math"
+	"os"
+	"sort"
 	"strings"
+	"text/tabwriter"
 
 	"cache-ring/cluster"
+	"cache-ring/hashring"
 )
 
 func main() {
 	var replicas int
+	var epsilon float64
 	flag.IntVar(&replicas, "replicas", 100, "number of virtual node replicas per node")
+	flag.Float64Var(&epsilon, "epsilon", 0, "bound node loads to (1+epsilon) times the average; 0 disables")
 	flag.Parse()
 
-	c := cluster.New(replicas)
+	c := cluster.New(replicas, cluster.WithBoundedLoad(epsilon))
 
 	nodes := []string{"node-a", "node-b", "node-c"}
 	for _, n := range nodes {
@@ -33,7 +40,7 @@ func main() {
 	for nodeID, count := range keyCounts {
 		fmt.Printf("%s: %d keys, %f%%\n", nodeID, count, float64(count)/float64(numKeys)*100)
 	}
-	before := c.SnapshotKeyOwners()
+	before, _ := c.RingSnapshot()
 	// add a new node
 	fmt.Printf("After adding a new node: %s", "node-d")
 	fmt.Println()
@@ -42,15 +49,8 @@ func main() {
 	for nodeID, count := range keyCounts {
 		fmt.Printf("%s: %d keys, %f%%\n", nodeID, count, float64(count)/float64(numKeys)*100)
 	}
-	after := c.SnapshotKeyOwners()
-	remappedKeys := 0
-	for key, nodeID := range after {
-		if nodeID != before[key] {
-			remappedKeys++
-		}
-	}
-	fmt.Printf("Number of remapped keys: %d\n", remappedKeys)
-	fmt.Printf("Remapped keys: %f%%\n", float64(remappedKeys)/float64(numKeys)*100)
+	after, _ := c.RingSnapshot()
+	printMoves(hashring.Diff(before, after))
 
 	// remove an existing node
 	fmt.Printf("After removing an existing node: %s", "node-b")
@@ -60,15 +60,15 @@ func main() {
 	for nodeID, count := range keyCounts {
 		fmt.Printf("%s: %d keys, %f%%\n", nodeID, count, float64(count)/float64(numKeys)*100)
 	}
-	after = c.SnapshotKeyOwners()
-	remappedKeys = 0
-	for key, nodeID := range after {
-		if nodeID != before[key] {
-			remappedKeys++
-		}
-	}
-	fmt.Printf("Number of remapped keys: %d\n", remappedKeys)
-	fmt.Printf("Remapped keys: %f%%\n", float64(remappedKeys)/float64(numKeys)*100)
+	before = after
+	after, _ = c.RingSnapshot()
+	printMoves(hashring.Diff(before, after))
+
+	fmt.Println()
+	compareStrategies(replicas, numKeys)
+
+	fmt.Println()
+	repairScenario(replicas, numKeys)
 
 	// keys := []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot"}
 	// fmt.Println("\nInitial mapping:")
@@ -85,3 +85,150 @@ func main() {
 	// 	fmt.Printf("%10s -> %s\n", k, n)
 	// }
 }
+
+// printMoves reports the hash ranges that changed owner and the share of the
+// hash space, and so of the keys, that flowed between each pair of nodes.
+func printMoves(moves []hashring.Move) {
+	type flow struct{ from, to string }
+	shares := make(map[flow]float64)
+	total := 0.0
+	for _, m := range moves {
+		shares[flow{m.From, m.To}] += m.Fraction()
+		total += m.Fraction()
+	}
+	fmt.Printf("Moved ranges: %d, remapped hash space: %.1f%%\n", len(moves), total*100)
+	flows := make([]flow, 0, len(shares))
+	for f := range shares {
+		flows = append(flows, f)
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		if flows[i].from != flows[j].from {
+			return flows[i].from < flows[j].from
+		}
+		return flows[i].to < flows[j].to
+	})
+	for _, f := range flows {
+		fmt.Printf("  %s -> %s: %.1f%%\n", f.from, f.to, shares[f]*100)
+	}
+}
+
+// compareStrategies runs the same add/remove scenario on every ring strategy
+// and prints the load spread and the share of keys that changed owner.
+func compareStrategies(replicas, numKeys int) {
+	strategies := []struct {
+		name    string
+		newRing func() hashring.Ring
+	}{
+		{"hashring", func() hashring.Ring { return hashring.New(replicas) }},
+		{"jump", func() hashring.Ring { return hashring.NewJump() }},
+		{"maglev", func() hashring.Ring { return hashring.NewMaglev(0) }},
+		{"rendezvous", func() hashring.Ring { return hashring.NewRendezvous() }},
+	}
+
+	fmt.Println("Strategy comparison:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "strategy\tmax/avg load\tload stddev\tremapped on add\tremapped on remove")
+	for _, s := range strategies {
+		c := cluster.New(replicas, cluster.WithRing(s.newRing()))
+		for _, n := range []string{"node-a", "node-b", "node-c"} {
+			c.AddNode(n)
+		}
+		for i := 0; i < numKeys; i++ {
+			c.Set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+		}
+		maxOverAvg, stddev := loadSpread(c.KeyCounts())
+
+		before := c.SnapshotKeyOwners()
+		c.AddNode("node-d")
+		afterAdd := c.SnapshotKeyOwners()
+		c.RemoveNode("node-b")
+		afterRemove := c.SnapshotKeyOwners()
+
+		fmt.Fprintf(w, "%s\t%.3f\t%.1f%%\t%.1f%%\t%.1f%%\n", s.name, maxOverAvg, stddev,
+			remappedPercent(before, afterAdd), remappedPercent(afterAdd, afterRemove))
+	}
+	w.Flush()
+}
+
+// repairScenario lets one replica of a three-way replicated cluster diverge,
+// by missing writes while it is down and by losing keys, and shows an
+// anti-entropy pass bringing it back in line with the others.
+func repairScenario(replicas, numKeys int) {
+	c := cluster.New(replicas, cluster.WithReplication(3, 2, 2))
+	for _, n := range []string{"node-a", "node-b", "node-c", "node-d"} {
+		c.AddNode(n)
+	}
+	for i := 0; i < numKeys; i++ {
+		c.Set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+	}
+
+	// node-b misses a round of updates, then loses some of its keys
+	c.MarkDown("node-b")
+	for i := 0; i < numKeys; i += 7 {
+		c.Set(fmt.Sprintf("key-%d", i), fmt.Sprintf("updated-%d", i))
+	}
+	c.MarkUp("node-b")
+	node, _ := c.Node("node-b")
+	for i := 0; i < numKeys; i += 11 {
+		node.Delete(fmt.Sprintf("key-%d", i))
+	}
+
+	fmt.Println("Anti-entropy repair of node-b:")
+	fmt.Printf("  before: %d keys differ from the other replicas\n", divergentKeys(c, numKeys))
+	stats, err := c.Repair()
+	if err != nil {
+		fmt.Println("  repair:", err)
+		return
+	}
+	fmt.Printf("  compared %d ranges, %d differed; streamed %d of %d keys, wrote %d copies (%d bytes)\n",
+		stats.Ranges, stats.Differing, stats.Keys, numKeys, stats.Repaired, stats.Bytes)
+	fmt.Printf("  after: %d keys differ from the other replicas\n", divergentKeys(c, numKeys))
+}
+
+// divergentKeys counts the keys whose replicas do not all hold the same
+// value.
+func divergentKeys(c *cluster.Cluster, numKeys int) int {
+	divergent := 0
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		values := make(map[string]bool)
+		for _, id := range c.LookupReplicas(key) {
+			node, _ := c.Node(id)
+			item, ok := node.Get(key)
+			values[fmt.Sprint(item.Value, ok)] = true
+		}
+		if len(values) > 1 {
+			divergent++
+		}
+	}
+	return divergent
+}
+
+// loadSpread returns the largest node's load relative to the average and the
+// standard deviation of the loads as a percentage of the average.
+func loadSpread(counts map[string]int) (maxOverAvg, stddevPercent float64) {
+	total, largest := 0, 0
+	for _, count := range counts {
+		total += count
+		largest = max(largest, count)
+	}
+	avg := float64(total) / float64(len(counts))
+	variance := 0.0
+	for _, count := range counts {
+		variance += (float64(count) - avg) * (float64(count) - avg)
+	}
+	variance /= float64(len(counts))
+	return float64(largest) / avg, math.Sqrt(variance) / avg * 100
+}
+
+// remappedPercent returns the share of keys whose owner differs between two
+// snapshots.
+func remappedPercent(before, after map[string]string) float64 {
+	remapped := 0
+	for key, nodeID := range after {
+		if nodeID != before[key] {
+			remapped++
+		}
+	}
+	return float64(remapped) / float64(len(after)) * 100
+}
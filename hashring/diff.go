@@ -0,0 +1,116 @@
+package hashring
+
+import (
+	"math"
+	"slices"
+	"sort"
+)
+
+// Move is a range of key hashes (Start, End] whose owner changed between two
+// ring layouts. A range with Start >= End wraps past the top of the hash
+// space, and Start == End covers the whole ring. From or To is empty when
+// the old or new ring had no nodes.
+type Move struct {
+	Start, End uint64
+	From, To   string
+}
+
+// Contains reports whether the key hash h falls in the range.
+func (m Move) Contains(h uint64) bool {
+	if m.Start < m.End {
+		return m.Start < h && h <= m.End
+	}
+	return h > m.Start || h <= m.End
+}
+
+// Fraction returns the share of the hash space the range covers, which is
+// the expected share of keys that move with it.
+func (m Move) Fraction() float64 {
+	if m.Start == m.End {
+		return 1
+	}
+	return float64(m.End-m.Start) / (math.MaxUint64 + 1.0)
+}
+
+// ownerTable is the owner of every token of a snapshot, sorted by token.
+type ownerTable struct {
+	tokens []uint64
+	owners []string
+}
+
+func newOwnerTable(s *Snapshot) ownerTable {
+	var t ownerTable
+	type point struct {
+		token uint64
+		owner string
+	}
+	var points []point
+	for _, n := range s.Nodes {
+		for _, token := range n.Tokens {
+			points = append(points, point{token, n.ID})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].token < points[j].token })
+	for _, p := range points {
+		t.tokens = append(t.tokens, p.token)
+		t.owners = append(t.owners, p.owner)
+	}
+	return t
+}
+
+// owner returns the node owning hash h, the owner of the first token at or
+// after h, like HashRing.GetNode.
+func (t ownerTable) owner(h uint64) string {
+	if len(t.tokens) == 0 {
+		return ""
+	}
+	idx := sort.Search(len(t.tokens), func(i int) bool { return t.tokens[i] >= h })
+	if idx == len(t.tokens) {
+		idx = 0
+	}
+	return t.owners[idx]
+}
+
+// Diff returns the hash ranges whose owner differs between the old and
+// updated layouts, in ascending order, with adjacent ranges between the same
+// pair of nodes merged. Both snapshots must come from rings that hash keys
+// the same way. Only the first owner of a key is compared; with replication
+// the later replicas of nearby ranges may change as well.
+//
+// The ranges are exact: a key moves if and only if its hash falls in one of
+// them, so a migration can be planned without looking at any key.
+func Diff(old, updated *Snapshot) []Move {
+	before, after := newOwnerTable(old), newOwnerTable(updated)
+
+	// every range between consecutive tokens of either ring has a single
+	// owner in each, namely the owner of the token that ends it
+	bounds := append(slices.Clone(before.tokens), after.tokens...)
+	slices.Sort(bounds)
+	bounds = slices.Compact(bounds)
+	if len(bounds) == 0 {
+		return nil
+	}
+
+	var moves []Move
+	prev := bounds[len(bounds)-1]
+	for _, end := range bounds {
+		from, to := before.owner(end), after.owner(end)
+		if from != to {
+			if n := len(moves); n > 0 && moves[n-1].End == prev && moves[n-1].From == from && moves[n-1].To == to {
+				moves[n-1].End = end
+			} else {
+				moves = append(moves, Move{Start: prev, End: end, From: from, To: to})
+			}
+		}
+		prev = end
+	}
+	// join the last range with the first when they meet at the wrap
+	if n := len(moves); n > 1 {
+		first, last := moves[0], moves[n-1]
+		if last.End == bounds[len(bounds)-1] && first.Start == last.End && first.From == last.From && first.To == last.To {
+			moves[0].Start = last.Start
+			moves = moves[:n-1]
+		}
+	}
+	return moves
+}
@@ -0,0 +1,110 @@
+package hashring
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// checkDiff fails unless the moves between two rings account for exactly the
+// keys whose owner changed.
+func checkDiff(t *testing.T, old, updated *HashRing) []Move {
+	t.Helper()
+	moves := Diff(old.Snapshot(), updated.Snapshot())
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		from, _ := old.GetNode(key)
+		to, _ := updated.GetNode(key)
+		h := old.HashKey(key)
+		var in []Move
+		for _, m := range moves {
+			if m.Contains(h) {
+				in = append(in, m)
+			}
+		}
+		switch {
+		case from == to && len(in) > 0:
+			t.Fatalf("key %s stays on %s but falls in move %+v", key, from, in[0])
+		case from != to && len(in) != 1:
+			t.Fatalf("key %s moves %s -> %s but falls in %d moves", key, from, to, len(in))
+		case from != to && (in[0].From != from || in[0].To != to):
+			t.Fatalf("key %s moves %s -> %s but its range says %s -> %s", key, from, to, in[0].From, in[0].To)
+		}
+	}
+	return moves
+}
+
+func TestDiff(t *testing.T) {
+	ring := func(weights map[string]int) *HashRing {
+		r := New(50)
+		for id, w := range weights {
+			r.AddNodeWithWeight(id, w)
+		}
+		return r
+	}
+	base := map[string]int{"a": 1, "b": 1, "c": 1}
+
+	t.Run("unchanged", func(t *testing.T) {
+		if moves := checkDiff(t, ring(base), ring(base)); len(moves) != 0 {
+			t.Fatalf("expected no moves, got %d", len(moves))
+		}
+	})
+
+	t.Run("add node", func(t *testing.T) {
+		moves := checkDiff(t, ring(base), ring(map[string]int{"a": 1, "b": 1, "c": 1, "d": 1}))
+		share := 0.0
+		for _, m := range moves {
+			if m.To != "d" {
+				t.Fatalf("range moved %s -> %s; only moves to d expected", m.From, m.To)
+			}
+			share += m.Fraction()
+		}
+		if share < 0.1 || share > 0.4 {
+			t.Fatalf("d took %.2f of the ring, want about a quarter", share)
+		}
+	})
+
+	t.Run("remove node", func(t *testing.T) {
+		for _, m := range checkDiff(t, ring(base), ring(map[string]int{"a": 1, "c": 1})) {
+			if m.From != "b" {
+				t.Fatalf("range moved %s -> %s; only moves off b expected", m.From, m.To)
+			}
+		}
+	})
+
+	t.Run("change weight", func(t *testing.T) {
+		for _, m := range checkDiff(t, ring(base), ring(map[string]int{"a": 1, "b": 3, "c": 1})) {
+			if m.To != "b" {
+				t.Fatalf("range moved %s -> %s; only moves to b expected", m.From, m.To)
+			}
+		}
+	})
+
+	t.Run("from empty", func(t *testing.T) {
+		moves := Diff(New(50).Snapshot(), ring(map[string]int{"a": 1}).Snapshot())
+		if len(moves) != 1 || moves[0].From != "" || moves[0].To != "a" || moves[0].Fraction() != 1 {
+			t.Fatalf("expected the whole ring to move to a, got %+v", moves)
+		}
+		if !moves[0].Contains(0) || !moves[0].Contains(math.MaxUint64) {
+			t.Fatalf("whole-ring move %+v does not contain the ends of the hash space", moves[0])
+		}
+	})
+
+	t.Run("replace node", func(t *testing.T) {
+		checkDiff(t, ring(base), ring(map[string]int{"a": 1, "b": 2, "d": 1}))
+	})
+}
+
+func TestMove(t *testing.T) {
+	m := Move{Start: 10, End: 20}
+	if m.Contains(10) || !m.Contains(11) || !m.Contains(20) || m.Contains(21) {
+		t.Fatalf("range (10, 20] contains the wrong hashes")
+	}
+	wrap := Move{Start: math.MaxUint64 - 1, End: 5}
+	if !wrap.Contains(math.MaxUint64) || !wrap.Contains(0) || !wrap.Contains(5) || wrap.Contains(6) {
+		t.Fatalf("wrapping range contains the wrong hashes")
+	}
+	if got, want := (Move{Start: 0, End: math.MaxUint64 / 2}).Fraction(), 0.5; math.Abs(got-want) > 1e-9 {
+		t.Fatalf("fraction got %f, want %f", got, want)
+	}
+}
@@ -0,0 +1,146 @@
+package hashring
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"hash/fnv"
+	"math/bits"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Hasher maps bytes to a position on the 64-bit hash circle.
+// Implementations must be safe for concurrent use.
+type Hasher interface {
+	Hash(b []byte) uint64
+}
+
+// HasherFunc adapts an ordinary function to the Hasher interface.
+type HasherFunc func(b []byte) uint64
+
+// Hash returns f(b).
+func (f HasherFunc) Hash(b []byte) uint64 {
+	return f(b)
+}
+
+var (
+	// XXHash is the default hasher, xxHash64 with seed 0.
+	XXHash Hasher = HasherFunc(xxhash.Sum64)
+	// FNV1a is the 64-bit FNV-1a hash.
+	FNV1a Hasher = HasherFunc(fnv1a)
+	// Murmur3 is the first half of MurmurHash3 x64_128 with seed 0.
+	Murmur3 Hasher = HasherFunc(murmur3)
+	// CRC32 is the IEEE CRC-32 checksum, as used by ketama clients configured
+	// with a crc32 key hash. Its values only cover the low 32 bits of the circle.
+	CRC32 Hasher = HasherFunc(func(b []byte) uint64 { return uint64(crc32.ChecksumIEEE(b)) })
+)
+
+func fnv1a(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+func murmur3(b []byte) uint64 {
+	const c1, c2 = 0x87c37b91114253d5, 0x4cf5ad432745937f
+	var h1, h2 uint64
+	n := len(b)
+
+	for ; len(b) >= 16; b = b[16:] {
+		k1 := binary.LittleEndian.Uint64(b)
+		k2 := binary.LittleEndian.Uint64(b[8:])
+		h1 ^= bits.RotateLeft64(k1*c1, 31) * c2
+		h1 = (bits.RotateLeft64(h1, 27)+h2)*5 + 0x52dce729
+		h2 ^= bits.RotateLeft64(k2*c2, 33) * c1
+		h2 = (bits.RotateLeft64(h2, 31)+h1)*5 + 0x38495ab5
+	}
+
+	var k1, k2 uint64
+	for i := len(b) - 1; i >= 8; i-- {
+		k2 |= uint64(b[i]) << ((i - 8) * 8)
+	}
+	if len(b) > 8 {
+		h2 ^= bits.RotateLeft64(k2*c2, 33) * c1
+	}
+	for i := min(len(b), 8) - 1; i >= 0; i-- {
+		k1 |= uint64(b[i]) << (i * 8)
+	}
+	if len(b) > 0 {
+		h1 ^= bits.RotateLeft64(k1*c1, 31) * c2
+	}
+
+	h1 ^= uint64(n)
+	h2 ^= uint64(n)
+	h1 += h2
+	h2 += h1
+	h1 = fmix64(h1)
+	h2 = fmix64(h2)
+	return h1 + h2
+}
+
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
+
+// sipHasher implements SipHash-2-4 with a secret key.
+type sipHasher struct {
+	k0, k1 uint64
+}
+
+// NewSipHash returns a SipHash-2-4 hasher keyed with key. Keeping the key
+// secret stops clients from choosing keys that all land on one node.
+func NewSipHash(key [16]byte) Hasher {
+	return sipHasher{
+		k0: binary.LittleEndian.Uint64(key[:8]),
+		k1: binary.LittleEndian.Uint64(key[8:]),
+	}
+}
+
+// Hash returns the SipHash-2-4 of b.
+func (s sipHasher) Hash(b []byte) uint64 {
+	v0 := s.k0 ^ 0x736f6d6570736575
+	v1 := s.k1 ^ 0x646f72616e646f6d
+	v2 := s.k0 ^ 0x6c7967656e657261
+	v3 := s.k1 ^ 0x7465646279746573
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13) ^ v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16) ^ v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21) ^ v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17) ^ v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	n := len(b)
+	for ; len(b) >= 8; b = b[8:] {
+		m := binary.LittleEndian.Uint64(b)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+	last := uint64(n) << 56
+	for i := len(b) - 1; i >= 0; i-- {
+		last |= uint64(b[i]) << (i * 8)
+	}
+	v3 ^= last
+	round()
+	round()
+	v0 ^= last
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
@@ -0,0 +1,38 @@
+package hashring
+
+import (
+	"testing"
+)
+
+func TestHashers(t *testing.T) {
+	sipKey := [16]byte{}
+	for i := range sipKey {
+		sipKey[i] = byte(i)
+	}
+	sipMsg := make([]byte, 15)
+	for i := range sipMsg {
+		sipMsg[i] = byte(i)
+	}
+
+	tests := []struct {
+		name   string
+		hasher Hasher
+		input  []byte
+		want   uint64
+	}{
+		{"xxhash empty", XXHash, nil, 0xef46db3751d8e999},
+		{"fnv1a empty", FNV1a, nil, 0xcbf29ce484222325},
+		{"fnv1a a", FNV1a, []byte("a"), 0xaf63dc4c8601ec8c},
+		{"murmur3 empty", Murmur3, nil, 0},
+		{"murmur3 hello", Murmur3, []byte("hello"), 0xcbd8a7b341bd9b02},
+		{"murmur3 long", Murmur3, []byte("The quick brown fox jumps over the lazy dog"), 0xe34bbc7bbc071b6c},
+		{"crc32 check", CRC32, []byte("123456789"), 0xcbf43926},
+		{"siphash empty", NewSipHash(sipKey), nil, 0x726fdb47dd0e0e31},
+		{"siphash 15 bytes", NewSipHash(sipKey), sipMsg, 0xa129ca6149be45e5},
+	}
+	for _, tt := range tests {
+		if got := tt.hasher.Hash(tt.input); got != tt.want {
+			t.Errorf("%s: got %#x, want %#x", tt.name, got, tt.want)
+		}
+	}
+}
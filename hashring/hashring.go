@@ -16,32 +16,77 @@ type HashRing struct {
 	numReplicas int
 	keyToNode   map[uint64]string
 	sortedKeys  []uint64
-	// set of real node IDs
+	// real node IDs mapped to their weight
 	// vNodes are not recorded here
-	nodeSet map[string]struct{}
-	mu      sync.RWMutex
+	nodeSet map[string]int
+	hasher  Hasher
+	// place tokens on the libketama continuum instead of hashing "id#replica"
+	ketama bool
+	// number of layout changes, see Epoch
+	epoch uint64
+	mu    sync.RWMutex
+}
+
+// Option configures a HashRing.
+type Option func(*HashRing)
+
+// WithHasher places tokens and keys with h instead of XXHash.
+func WithHasher(h Hasher) Option {
+	return func(r *HashRing) {
+		r.hasher = h
+	}
 }
 
 // New creates a HashRing with the given number of virtual node replicas per real node.
 // If numReplicas <= 0, a reasonable default of 100 is used.
-func New(numReplicas int) *HashRing {
+func New(numReplicas int, opts ...Option) *HashRing {
 	if numReplicas <= 0 {
 		numReplicas = 100
 	}
-	return &HashRing{
+	r := &HashRing{
 		numReplicas: numReplicas,
 		keyToNode:   make(map[uint64]string),
-		nodeSet:     make(map[string]struct{}),
+		nodeSet:     make(map[string]int),
+		hasher:      XXHash,
+	}
+	for _, opt := range opts {
+		opt(r)
 	}
+	return r
 }
 
+// HashBytes hashes b with the default hasher, XXHash.
 func HashBytes(b []byte) uint64 {
 	return xxhash.Sum64(b)
 }
 
+// HashKey returns the position of key on the ring using the configured hasher.
+func (r *HashRing) HashKey(key string) uint64 {
+	return r.hasher.Hash([]byte(key))
+}
+
+// token returns the position of the given replica of nodeID.
+func (r *HashRing) token(nodeID string, replica int) uint64 {
+	if r.ketama {
+		return ketamaToken(nodeID, replica)
+	}
+	return r.hasher.Hash([]byte(fmt.Sprintf("%s#%d", nodeID, replica)))
+}
+
 // AddNode adds a node to the ring with the configured number of replicas.
 // Adding an existing node is a no-op.
 func (r *HashRing) AddNode(nodeID string) {
+	r.AddNodeWithWeight(nodeID, 1)
+}
+
+// AddNodeWithWeight adds a node that owns weight times the configured number
+// of replicas, so a node of weight 2 takes roughly twice the share of a node
+// of weight 1. If weight <= 0, a weight of 1 is used.
+// Adding an existing node is a no-op; use SetWeight to change its weight.
+func (r *HashRing) AddNodeWithWeight(nodeID string, weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -49,13 +94,40 @@ func (r *HashRing) AddNode(nodeID string) {
 		return
 	}
 
-	for replica := 0; replica < r.numReplicas; replica++ {
-		key := HashBytes([]byte(fmt.Sprintf("%s#%d", nodeID, replica)))
-		r.keyToNode[key] = nodeID
-		r.sortedKeys = append(r.sortedKeys, key)
+	r.addTokens(nodeID, 0, weight*r.numReplicas)
+	r.nodeSet[nodeID] = weight
+	r.epoch++
+}
+
+// SetWeight changes the weight of an existing node. Tokens are added or
+// removed from the end of the node's replica sequence, so the tokens the node
+// keeps do not move. If weight <= 0, a weight of 1 is used.
+// Setting the weight of a missing node is a no-op.
+func (r *HashRing) SetWeight(nodeID string, weight int) {
+	if weight <= 0 {
+		weight = 1
 	}
-	sort.Slice(r.sortedKeys, func(i, j int) bool { return r.sortedKeys[i] < r.sortedKeys[j] })
-	r.nodeSet[nodeID] = struct{}{}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old, exists := r.nodeSet[nodeID]
+	if !exists || old == weight {
+		return
+	}
+	if weight > old {
+		r.addTokens(nodeID, old*r.numReplicas, weight*r.numReplicas)
+	} else {
+		r.removeTokens(nodeID, weight*r.numReplicas, old*r.numReplicas)
+	}
+	r.nodeSet[nodeID] = weight
+	r.epoch++
+}
+
+// Weight returns the weight of nodeID, or 0 if the node is not in the ring.
+func (r *HashRing) Weight(nodeID string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.nodeSet[nodeID]
 }
 
 // RemoveNode removes a node and all its replicas from the ring.
@@ -64,14 +136,45 @@ func (r *HashRing) RemoveNode(nodeID string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if _, exists := r.nodeSet[nodeID]; !exists {
+	weight, exists := r.nodeSet[nodeID]
+	if !exists {
 		return
 	}
 
-	// Remove all replicas for this node from the map
-	for replica := 0; replica < r.numReplicas; replica++ {
-		key := HashBytes([]byte(fmt.Sprintf("%s#%d", nodeID, replica)))
-		delete(r.keyToNode, key)
+	r.removeTokens(nodeID, 0, weight*r.numReplicas)
+	delete(r.nodeSet, nodeID)
+	r.epoch++
+}
+
+// Epoch returns the version of the ring layout. It starts at 0 and grows by
+// one with every change to the nodes or their weights, and is set by
+// Restore, so two rings with the same epoch from the same source agree.
+func (r *HashRing) Epoch() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.epoch
+}
+
+// addTokens places the replicas [lo, hi) of nodeID on the ring.
+// The caller must hold the write lock.
+func (r *HashRing) addTokens(nodeID string, lo, hi int) {
+	for replica := lo; replica < hi; replica++ {
+		key := r.token(nodeID, replica)
+		r.keyToNode[key] = nodeID
+		r.sortedKeys = append(r.sortedKeys, key)
+	}
+	sort.Slice(r.sortedKeys, func(i, j int) bool { return r.sortedKeys[i] < r.sortedKeys[j] })
+}
+
+// removeTokens takes the replicas [lo, hi) of nodeID off the ring.
+// The caller must hold the write lock.
+func (r *HashRing) removeTokens(nodeID string, lo, hi int) {
+	// Remove the replicas for this node from the map
+	for replica := lo; replica < hi; replica++ {
+		key := r.token(nodeID, replica)
+		if r.keyToNode[key] == nodeID {
+			delete(r.keyToNode, key)
+		}
 	}
 
 	// Rebuild sortedKeys to avoid O(n^2) deletions
@@ -80,7 +183,6 @@ func (r *HashRing) RemoveNode(nodeID string) {
 		r.sortedKeys = append(r.sortedKeys, key)
 	}
 	sort.Slice(r.sortedKeys, func(i, j int) bool { return r.sortedKeys[i] < r.sortedKeys[j] })
-	delete(r.nodeSet, nodeID)
 }
 
 // GetNode returns the nodeID responsible for the given key.
@@ -93,7 +195,7 @@ func (r *HashRing) GetNode(key string) (string, bool) {
 		return "", false
 	}
 
-	h := HashBytes([]byte(key))
+	h := r.HashKey(key)
 	// binary search to find the node ID where the hash of the key is the NEXT higher hash
 	idx := sort.Search(len(r.sortedKeys), func(i int) bool { return r.sortedKeys[i] >= h })
 	if idx == len(r.sortedKeys) {
@@ -116,17 +218,104 @@ func (r *HashRing) Nodes() []string {
 	return nodes
 }
 
+// TokensForNode returns the tokens nodeID owns at its current weight, in
+// replica order. A node that is not in the ring is treated as weight 1, so
+// callers can compute the tokens of a node before adding it.
 func (r *HashRing) TokensForNode(nodeID string) []uint64 {
-	tokens := make([]uint64, 0, r.numReplicas)
-	for replica := 0; replica < r.numReplicas; replica++ {
-		key := HashBytes([]byte(fmt.Sprintf("%s#%d", nodeID, replica)))
+	r.mu.RLock()
+	weight := r.nodeSet[nodeID]
+	r.mu.RUnlock()
+	if weight == 0 {
+		weight = 1
+	}
+	return r.TokensForWeight(nodeID, weight)
+}
+
+// TokensForWeight returns the tokens nodeID would own at the given weight, in
+// replica order. The tokens for a lower weight are always a prefix of the
+// tokens for a higher one.
+func (r *HashRing) TokensForWeight(nodeID string, weight int) []uint64 {
+	if weight <= 0 {
+		weight = 1
+	}
+	tokens := make([]uint64, 0, weight*r.numReplicas)
+	for replica := 0; replica < weight*r.numReplicas; replica++ {
+		key := r.token(nodeID, replica)
 		tokens = append(tokens, key)
 	}
 	return tokens
 }
 
+// GetNodes returns up to n distinct nodeIDs for the given key, starting with
+// the owner returned by GetNode and walking clockwise from the key's hash.
+// Virtual nodes whose physical node was already picked are skipped, so the
+// result can be used as a replica set. Fewer than n nodes are returned if the
+// ring holds fewer than n nodes, and none if the ring is empty or n <= 0.
+func (r *HashRing) GetNodes(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.sortedKeys) == 0 || n <= 0 {
+		return nil
+	}
+	if n > len(r.nodeSet) {
+		n = len(r.nodeSet)
+	}
+
+	nodes := make([]string, 0, n)
+	seen := make(map[string]struct{}, n)
+	// The first token at or after the key's hash is the successor of hash-1,
+	// which also wraps correctly for a hash of 0.
+	token := r.successor(r.HashKey(key) - 1)
+	for walked := 0; len(nodes) < n && walked < len(r.sortedKeys); walked++ {
+		nodeID := r.ownerOfToken(token)
+		if _, dup := seen[nodeID]; !dup {
+			seen[nodeID] = struct{}{}
+			nodes = append(nodes, nodeID)
+		}
+		token = r.successor(token)
+	}
+	return nodes
+}
+
+// GetNodeBounded returns the owner of key under bounded loads. It walks
+// clockwise from the key's hash like GetNode, but skips nodes whose load has
+// reached BoundedCapacity for the total load plus the key being placed.
+// loads maps nodeIDs to their current number of keys; missing nodes count as
+// empty. The second return value is false if the ring is empty.
+func (r *HashRing) GetNodeBounded(key string, loads map[string]int, epsilon float64) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.sortedKeys) == 0 {
+		return "", false
+	}
+	total := 1
+	for nodeID := range r.nodeSet {
+		total += loads[nodeID]
+	}
+	capacity := BoundedCapacity(total, len(r.nodeSet), epsilon)
+
+	token := r.successor(r.HashKey(key) - 1)
+	for walked := 0; walked < len(r.sortedKeys); walked++ {
+		nodeID := r.ownerOfToken(token)
+		if loads[nodeID] < capacity {
+			return nodeID, true
+		}
+		token = r.successor(token)
+	}
+	// unreachable while epsilon >= 0: some node is always below capacity
+	return r.ownerOfToken(r.successor(r.HashKey(key) - 1)), true
+}
+
 // Returns the predecessor of the given token in the sorted list of tokens.
 func (r *HashRing) Predecessor(token uint64) uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.predecessor(token)
+}
+
+func (r *HashRing) predecessor(token uint64) uint64 {
 	n := len(r.sortedKeys)
 	if n == 0 {
 		return 0
@@ -140,6 +329,12 @@ func (r *HashRing) Predecessor(token uint64) uint64 {
 
 // Returns the successor of the given token in the sorted list of tokens.
 func (r *HashRing) Successor(token uint64) uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.successor(token)
+}
+
+func (r *HashRing) successor(token uint64) uint64 {
 	n := len(r.sortedKeys)
 	if n == 0 {
 		return 0
@@ -154,5 +349,11 @@ func (r *HashRing) Successor(token uint64) uint64 {
 // Returns the nodeID responsible for the given token.
 // Or the physical nodeID that owns the virtual node.
 func (r *HashRing) OwnerOfToken(token uint64) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ownerOfToken(token)
+}
+
+func (r *HashRing) ownerOfToken(token uint64) string {
 	return r.keyToNode[token]
 }
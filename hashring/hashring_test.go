@@ -1,6 +1,8 @@
 package hashring
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 )
 
@@ -158,3 +160,202 @@ func TestRemoveNode(t *testing.T) {
 		}
 	})
 }
+
+func TestWeightedNodes(t *testing.T) {
+	const replicas = 4
+	ring := New(replicas)
+	ring.AddNodeWithWeight("nodeA", 1)
+	ring.AddNodeWithWeight("nodeB", 3)
+
+	t.Run("weight scales replicas", func(t *testing.T) {
+		if got, want := len(ring.sortedKeys), 4*replicas; got != want {
+			t.Fatalf("unexpected sortedKeys size: got %d, want %d", got, want)
+		}
+		if got, want := ring.Weight("nodeB"), 3; got != want {
+			t.Fatalf("unexpected weight for nodeB: got %d, want %d", got, want)
+		}
+		if got, want := len(ring.TokensForNode("nodeB")), 3*replicas; got != want {
+			t.Fatalf("unexpected token count for nodeB: got %d, want %d", got, want)
+		}
+		if got := ring.Weight("missing"); got != 0 {
+			t.Fatalf("expected weight 0 for missing node, got %d", got)
+		}
+	})
+
+	t.Run("lower weight tokens are a prefix", func(t *testing.T) {
+		low := ring.TokensForWeight("nodeB", 1)
+		high := ring.TokensForWeight("nodeB", 3)
+		for i := range low {
+			if low[i] != high[i] {
+				t.Fatalf("token %d differs between weights: %d != %d", i, low[i], high[i])
+			}
+		}
+	})
+
+	t.Run("set weight adds and removes tokens", func(t *testing.T) {
+		before := ring.TokensForNode("nodeB")
+
+		ring.SetWeight("nodeB", 1)
+		if got, want := len(ring.sortedKeys), 2*replicas; got != want {
+			t.Fatalf("unexpected sortedKeys size after lowering weight: got %d, want %d", got, want)
+		}
+		for _, token := range before[:replicas] {
+			if ring.keyToNode[token] != "nodeB" {
+				t.Fatalf("kept token %d no longer maps to nodeB", token)
+			}
+		}
+		for _, token := range before[replicas:] {
+			if _, exists := ring.keyToNode[token]; exists {
+				t.Fatalf("dropped token %d still on the ring", token)
+			}
+		}
+
+		ring.SetWeight("nodeB", 2)
+		if got, want := len(ring.sortedKeys), 3*replicas; got != want {
+			t.Fatalf("unexpected sortedKeys size after raising weight: got %d, want %d", got, want)
+		}
+		for i := 1; i < len(ring.sortedKeys); i++ {
+			if ring.sortedKeys[i-1] > ring.sortedKeys[i] {
+				t.Fatalf("sortedKeys not sorted at %d: %d > %d", i, ring.sortedKeys[i-1], ring.sortedKeys[i])
+			}
+		}
+	})
+
+	t.Run("set weight on missing node is no-op", func(t *testing.T) {
+		beforeKeys := len(ring.sortedKeys)
+		ring.SetWeight("missing", 5)
+		if len(ring.sortedKeys) != beforeKeys {
+			t.Fatalf("sortedKeys size changed on missing node: got %d, want %d", len(ring.sortedKeys), beforeKeys)
+		}
+		if _, exists := ring.nodeSet["missing"]; exists {
+			t.Fatalf("SetWeight must not add missing node")
+		}
+	})
+}
+
+func TestGetNodes(t *testing.T) {
+	ring := New(10)
+	if got := ring.GetNodes("any-key", 2); len(got) != 0 {
+		t.Fatalf("expected no nodes from empty ring, got %v", got)
+	}
+	ring.AddNode("nodeA")
+	ring.AddNode("nodeB")
+	ring.AddNode("nodeC")
+
+	t.Run("first node matches GetNode and nodes are distinct", func(t *testing.T) {
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			nodes := ring.GetNodes(key, 2)
+			if len(nodes) != 2 {
+				t.Fatalf("GetNodes(%q, 2) returned %v", key, nodes)
+			}
+			owner, _ := ring.GetNode(key)
+			if nodes[0] != owner {
+				t.Fatalf("GetNodes(%q)[0] = %q; GetNode = %q", key, nodes[0], owner)
+			}
+			if nodes[0] == nodes[1] {
+				t.Fatalf("GetNodes(%q) returned duplicate node %q", key, nodes[0])
+			}
+		}
+	})
+
+	t.Run("second node is the next distinct owner clockwise", func(t *testing.T) {
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			nodes := ring.GetNodes(key, 2)
+			token := ring.Successor(HashBytes([]byte(key)) - 1)
+			for ring.OwnerOfToken(token) == nodes[0] {
+				token = ring.Successor(token)
+			}
+			if want := ring.OwnerOfToken(token); nodes[1] != want {
+				t.Fatalf("GetNodes(%q)[1] = %q; want %q", key, nodes[1], want)
+			}
+		}
+	})
+
+	t.Run("n is capped at the number of nodes", func(t *testing.T) {
+		if got := ring.GetNodes("key", 10); len(got) != 3 {
+			t.Fatalf("expected 3 nodes, got %v", got)
+		}
+		if got := ring.GetNodes("key", 0); len(got) != 0 {
+			t.Fatalf("expected no nodes for n=0, got %v", got)
+		}
+	})
+
+	t.Run("safe for concurrent use", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					ring.GetNodes(fmt.Sprintf("key-%d-%d", w, i), 2)
+				}
+			}(w)
+		}
+		for i := 0; i < 20; i++ {
+			ring.AddNode(fmt.Sprintf("extra-%d", i))
+			ring.RemoveNode(fmt.Sprintf("extra-%d", i))
+		}
+		wg.Wait()
+	})
+}
+
+func TestGetNodeBounded(t *testing.T) {
+	ring := New(10)
+	if _, ok := ring.GetNodeBounded("any-key", nil, 0.25); ok {
+		t.Fatalf("GetNodeBounded should report false when ring is empty")
+	}
+	ring.AddNode("nodeA")
+	ring.AddNode("nodeB")
+	ring.AddNode("nodeC")
+
+	if got, want := BoundedCapacity(100, 3, 0.25), 42; got != want {
+		t.Fatalf("BoundedCapacity(100, 3, 0.25) = %d; want %d", got, want)
+	}
+
+	owner, _ := ring.GetNode("key")
+	t.Run("matches GetNode below capacity", func(t *testing.T) {
+		loads := map[string]int{"nodeA": 10, "nodeB": 10, "nodeC": 10}
+		if got, _ := ring.GetNodeBounded("key", loads, 0.25); got != owner {
+			t.Fatalf("GetNodeBounded = %s; want %s", got, owner)
+		}
+	})
+
+	t.Run("skips a full owner clockwise", func(t *testing.T) {
+		loads := map[string]int{owner: 20}
+		next := ring.GetNodes("key", 2)[1]
+		got, ok := ring.GetNodeBounded("key", loads, 0.25)
+		if !ok || got != next {
+			t.Fatalf("GetNodeBounded = (%s, %v); want (%s, true)", got, ok, next)
+		}
+	})
+}
+
+func TestWithHasher(t *testing.T) {
+	ring := New(5, WithHasher(FNV1a))
+	ring.AddNode("nodeA")
+	ring.AddNode("nodeB")
+
+	for _, token := range ring.TokensForNode("nodeA") {
+		if ring.keyToNode[token] != "nodeA" {
+			t.Fatalf("token %d not mapped to nodeA", token)
+		}
+	}
+	if got, want := ring.TokensForNode("nodeA")[0], FNV1a.Hash([]byte("nodeA#0")); got != want {
+		t.Fatalf("first token of nodeA = %d; want FNV-1a of nodeA#0 = %d", got, want)
+	}
+	if got, want := ring.HashKey("key"), FNV1a.Hash([]byte("key")); got != want {
+		t.Fatalf("HashKey = %d; want %d", got, want)
+	}
+
+	// GetNode must route by the configured hasher.
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		h := FNV1a.Hash([]byte(key))
+		want := ring.OwnerOfToken(ring.Successor(h - 1))
+		if got, _ := ring.GetNode(key); got != want {
+			t.Fatalf("GetNode(%q) = %s; want %s", key, got, want)
+		}
+	}
+}
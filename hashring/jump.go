@@ -0,0 +1,111 @@
+package hashring
+
+import (
+	"sort"
+	"sync"
+)
+
+// Jump implements Jump Consistent Hash (Lamping & Veach). It needs no token
+// table and spreads keys almost perfectly evenly, but it maps keys to bucket
+// numbers, so nodes live in numbered slots.
+// Removing the last slot only moves that slot's keys; removing any other node
+// moves the last node into the freed slot, which also moves the last node's
+// keys. The ring is safe for concurrent use.
+type Jump struct {
+	// slots[i] is the node that owns bucket i
+	slots []string
+	mu    sync.RWMutex
+}
+
+// NewJump creates an empty Jump ring.
+func NewJump() *Jump {
+	return &Jump{}
+}
+
+// jumpHash returns the bucket in [0, buckets) for key.
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// AddNode appends a node as the next bucket.
+// Adding an existing node is a no-op.
+func (j *Jump) AddNode(nodeID string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.slot(nodeID) >= 0 {
+		return
+	}
+	j.slots = append(j.slots, nodeID)
+}
+
+// RemoveNode removes a node, moving the last node into its bucket.
+// Removing a missing node is a no-op.
+func (j *Jump) RemoveNode(nodeID string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	idx := j.slot(nodeID)
+	if idx < 0 {
+		return
+	}
+	last := len(j.slots) - 1
+	j.slots[idx] = j.slots[last]
+	j.slots = j.slots[:last]
+}
+
+// slot returns the bucket of nodeID or -1. The caller must hold the lock.
+func (j *Jump) slot(nodeID string) int {
+	for i, id := range j.slots {
+		if id == nodeID {
+			return i
+		}
+	}
+	return -1
+}
+
+// GetNode returns the nodeID responsible for the given key.
+// The second return value is false if the ring is empty.
+func (j *Jump) GetNode(key string) (string, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	if len(j.slots) == 0 {
+		return "", false
+	}
+	return j.slots[jumpHash(HashBytes([]byte(key)), len(j.slots))], true
+}
+
+// GetNodes returns up to n distinct nodeIDs for the given key: the owner of
+// the key's bucket followed by the owners of the next buckets.
+func (j *Jump) GetNodes(key string, n int) []string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	if len(j.slots) == 0 || n <= 0 {
+		return nil
+	}
+	n = min(n, len(j.slots))
+	first := jumpHash(HashBytes([]byte(key)), len(j.slots))
+	nodes := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		nodes = append(nodes, j.slots[(first+i)%len(j.slots)])
+	}
+	return nodes
+}
+
+// Nodes returns a stable-sorted list of node identifiers present in the ring.
+func (j *Jump) Nodes() []string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	nodes := append([]string(nil), j.slots...)
+	sort.Strings(nodes)
+	return nodes
+}
@@ -0,0 +1,89 @@
+package hashring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestJump(t *testing.T) {
+	ring := NewJump()
+	if _, ok := ring.GetNode("any-key"); ok {
+		t.Fatalf("GetNode should report false when ring is empty")
+	}
+	for i := 0; i < 4; i++ {
+		ring.AddNode(fmt.Sprintf("node%d", i))
+	}
+
+	const numKeys = 10000
+	owners := make(map[string]string, numKeys)
+	counts := make(map[string]int)
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owner, ok := ring.GetNode(key)
+		if !ok {
+			t.Fatalf("GetNode(%q) failed", key)
+		}
+		owners[key] = owner
+		counts[owner]++
+	}
+
+	t.Run("spreads keys evenly", func(t *testing.T) {
+		for nodeID, count := range counts {
+			if count < numKeys/4*9/10 || count > numKeys/4*11/10 {
+				t.Fatalf("node %s holds %d keys; want about %d", nodeID, count, numKeys/4)
+			}
+		}
+	})
+
+	t.Run("adding a node only moves keys to it", func(t *testing.T) {
+		ring.AddNode("node4")
+		moved := 0
+		for key, before := range owners {
+			after, _ := ring.GetNode(key)
+			if after != before {
+				if after != "node4" {
+					t.Fatalf("key %q moved from %s to %s; only moves to node4 expected", key, before, after)
+				}
+				moved++
+			}
+		}
+		if moved > numKeys/4 {
+			t.Fatalf("moved %d keys; want about %d", moved, numKeys/5)
+		}
+		ring.RemoveNode("node4")
+		for key, before := range owners {
+			if after, _ := ring.GetNode(key); after != before {
+				t.Fatalf("key %q owned by %s after removing last node; want %s", key, after, before)
+			}
+		}
+	})
+
+	t.Run("removing a middle node moves the last node into its slot", func(t *testing.T) {
+		ring.RemoveNode("node1")
+		if got := ring.Nodes(); len(got) != 3 {
+			t.Fatalf("expected 3 nodes, got %v", got)
+		}
+		for key, before := range owners {
+			after, _ := ring.GetNode(key)
+			if before == "node1" && after != "node3" {
+				t.Fatalf("key %q from removed node1 moved to %s; want node3", key, after)
+			}
+			if before != "node1" && before != "node3" && after != before {
+				t.Fatalf("key %q moved from %s to %s", key, before, after)
+			}
+		}
+	})
+
+	t.Run("GetNodes returns distinct nodes", func(t *testing.T) {
+		nodes := ring.GetNodes("key", 5)
+		if len(nodes) != 3 {
+			t.Fatalf("expected 3 nodes, got %v", nodes)
+		}
+		if owner, _ := ring.GetNode("key"); nodes[0] != owner {
+			t.Fatalf("GetNodes[0] = %s; GetNode = %s", nodes[0], owner)
+		}
+		if nodes[0] == nodes[1] || nodes[1] == nodes[2] || nodes[0] == nodes[2] {
+			t.Fatalf("GetNodes returned duplicates: %v", nodes)
+		}
+	})
+}
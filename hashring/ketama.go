@@ -0,0 +1,45 @@
+package hashring
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+)
+
+// KetamaPointsPerWeight is the number of points WithKetama places on the
+// continuum for each unit of a node's weight. It is the 160 points per
+// server that libketama places when all weights are equal.
+const KetamaPointsPerWeight = 160
+
+// Ketama hashes keys like libketama: the first four bytes of the MD5 digest
+// read as a little-endian uint32.
+var Ketama Hasher = HasherFunc(func(b []byte) uint64 {
+	digest := md5.Sum(b)
+	return uint64(binary.LittleEndian.Uint32(digest[:4]))
+})
+
+// WithKetama lays tokens out like libketama and libmemcached's ketama mode,
+// so that a ring whose node IDs are "host:port" strings routes every key to
+// the same server as those clients. Each MD5 digest of "host:port-N" yields
+// four points and every unit of weight adds KetamaPointsPerWeight points;
+// keys are hashed with Ketama. The numReplicas passed to New is ignored.
+//
+// Only rings whose nodes all have the same weight are compatible. libketama
+// gives a server floor(weight / total weight * 40 * servers) digests, a
+// share of the total, where this ring keeps a fixed count per unit so that
+// a weight change moves no other node's points. With unequal weights some
+// keys route to a different server than libketama's.
+func WithKetama() Option {
+	return func(r *HashRing) {
+		r.numReplicas = KetamaPointsPerWeight
+		r.hasher = Ketama
+		r.ketama = true
+	}
+}
+
+// ketamaToken returns the given point of nodeID on the ketama continuum.
+func ketamaToken(nodeID string, replica int) uint64 {
+	digest := md5.Sum([]byte(fmt.Sprintf("%s-%d", nodeID, replica/4)))
+	h := replica % 4
+	return uint64(binary.LittleEndian.Uint32(digest[h*4:]))
+}
@@ -0,0 +1,70 @@
+package hashring
+
+import (
+	"testing"
+)
+
+// Golden vectors computed with a C transcription of libketama's
+// ketama_create_continuum and ketama_get_server for servers of equal weight.
+func TestKetamaGoldenVectors(t *testing.T) {
+	t.Run("points", func(t *testing.T) {
+		ring := New(0, WithKetama())
+		tokens := ring.TokensForNode("10.0.1.1:11211")
+		if got := len(tokens); got != KetamaPointsPerWeight {
+			t.Fatalf("expected %d points, got %d", KetamaPointsPerWeight, got)
+		}
+		want := []uint64{0x90ed8713, 0xf5ce3b03, 0x060386a6, 0xa22b367d}
+		for i, w := range want {
+			if tokens[i] != w {
+				t.Fatalf("point %d = %#x; want %#x", i, tokens[i], w)
+			}
+		}
+		if got, want := ring.HashKey("foo"), uint64(0xdb18bdac); got != want {
+			t.Fatalf("HashKey(foo) = %#x; want %#x", got, want)
+		}
+	})
+
+	t.Run("equal weights", func(t *testing.T) {
+		ring := New(0, WithKetama())
+		ring.AddNode("10.0.1.1:11211")
+		ring.AddNode("10.0.1.2:11211")
+		ring.AddNode("10.0.1.3:11211")
+		golden := map[string]string{
+			"foo":            "10.0.1.2:11211",
+			"bar":            "10.0.1.1:11211",
+			"baz":            "10.0.1.2:11211",
+			"user:1":         "10.0.1.1:11211",
+			"user:2":         "10.0.1.3:11211",
+			"session:abcdef": "10.0.1.2:11211",
+			"":               "10.0.1.3:11211",
+			"memcached":      "10.0.1.3:11211",
+			"ketama":         "10.0.1.3:11211",
+			"cache-ring":     "10.0.1.3:11211",
+		}
+		for key, want := range golden {
+			if got, _ := ring.GetNode(key); got != want {
+				t.Errorf("GetNode(%q) = %s; want %s", key, got, want)
+			}
+		}
+	})
+
+	// Weighted rings are not libketama-compatible: libketama would give these
+	// two servers 316 points between them. Here each unit of weight adds
+	// its own points.
+	t.Run("weighted", func(t *testing.T) {
+		ring := New(0, WithKetama())
+		ring.AddNode("10.0.1.1:11211")
+		ring.AddNodeWithWeight("10.0.1.2:11211", 2)
+		if got := len(ring.sortedKeys); got != 3*KetamaPointsPerWeight {
+			t.Fatalf("expected %d points, got %d", 3*KetamaPointsPerWeight, got)
+		}
+		low := ring.TokensForNode("10.0.1.1:11211")
+		high := ring.TokensForNode("10.0.1.2:11211")
+		if len(high) != 2*KetamaPointsPerWeight || high[0] != ketamaToken("10.0.1.2:11211", 0) {
+			t.Fatalf("weight 2 node has %d points starting at %#x", len(high), high[0])
+		}
+		if len(low) != KetamaPointsPerWeight {
+			t.Fatalf("weight 1 node has %d points", len(low))
+		}
+	})
+}
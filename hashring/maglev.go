@@ -0,0 +1,159 @@
+package hashring
+
+import (
+	"sort"
+	"sync"
+)
+
+// DefaultMaglevTableSize is the lookup table size used when none is given.
+// It must be prime and should be much larger than the number of nodes.
+const DefaultMaglevTableSize = 65537
+
+// Maglev implements the Maglev lookup table (Eisenbud et al.). Every node
+// fills table slots following its own permutation until the table is full,
+// which gives each node an almost equal share and makes lookups a single
+// array index. Membership changes rebuild the table and move slightly more
+// keys than the minimum. The ring is safe for concurrent use.
+type Maglev struct {
+	size  uint64
+	nodes []string
+	// table[i] indexes into nodes; -1 while the table is empty
+	table []int
+	mu    sync.RWMutex
+}
+
+// NewMaglev creates an empty Maglev ring whose lookup table has at least
+// tableSize slots, rounded up to a prime.
+// If tableSize <= 0, DefaultMaglevTableSize is used.
+func NewMaglev(tableSize int) *Maglev {
+	if tableSize <= 0 {
+		tableSize = DefaultMaglevTableSize
+	}
+	size := uint64(tableSize)
+	for !isPrime(size) {
+		size++
+	}
+	return &Maglev{size: size}
+}
+
+func isPrime(n uint64) bool {
+	if n < 2 {
+		return false
+	}
+	for d := uint64(2); d*d <= n; d++ {
+		if n%d == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// AddNode adds a node and rebuilds the lookup table.
+// Adding an existing node is a no-op.
+func (m *Maglev) AddNode(nodeID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	idx := sort.SearchStrings(m.nodes, nodeID)
+	if idx < len(m.nodes) && m.nodes[idx] == nodeID {
+		return
+	}
+	m.nodes = append(m.nodes, "")
+	copy(m.nodes[idx+1:], m.nodes[idx:])
+	m.nodes[idx] = nodeID
+	m.populate()
+}
+
+// RemoveNode removes a node and rebuilds the lookup table.
+// Removing a missing node is a no-op.
+func (m *Maglev) RemoveNode(nodeID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	idx := sort.SearchStrings(m.nodes, nodeID)
+	if idx == len(m.nodes) || m.nodes[idx] != nodeID {
+		return
+	}
+	m.nodes = append(m.nodes[:idx], m.nodes[idx+1:]...)
+	m.populate()
+}
+
+// populate rebuilds the lookup table from the sorted node list.
+// The caller must hold the write lock.
+func (m *Maglev) populate() {
+	if len(m.nodes) == 0 {
+		m.table = nil
+		return
+	}
+	offsets := make([]uint64, len(m.nodes))
+	skips := make([]uint64, len(m.nodes))
+	next := make([]uint64, len(m.nodes))
+	for i, nodeID := range m.nodes {
+		offsets[i] = HashBytes([]byte(nodeID+"#offset")) % m.size
+		skips[i] = HashBytes([]byte(nodeID+"#skip"))%(m.size-1) + 1
+	}
+
+	m.table = make([]int, m.size)
+	for i := range m.table {
+		m.table[i] = -1
+	}
+	for filled := uint64(0); ; {
+		for i := range m.nodes {
+			// take the next free slot in node i's permutation
+			slot := (offsets[i] + next[i]*skips[i]) % m.size
+			for m.table[slot] >= 0 {
+				next[i]++
+				slot = (offsets[i] + next[i]*skips[i]) % m.size
+			}
+			m.table[slot] = i
+			next[i]++
+			filled++
+			if filled == m.size {
+				return
+			}
+		}
+	}
+}
+
+// GetNode returns the nodeID responsible for the given key.
+// The second return value is false if the ring is empty.
+func (m *Maglev) GetNode(key string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.table) == 0 {
+		return "", false
+	}
+	return m.nodes[m.table[HashBytes([]byte(key))%m.size]], true
+}
+
+// GetNodes returns up to n distinct nodeIDs for the given key by walking the
+// lookup table forward from the key's slot.
+func (m *Maglev) GetNodes(key string, n int) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.table) == 0 || n <= 0 {
+		return nil
+	}
+	n = min(n, len(m.nodes))
+	nodes := make([]string, 0, n)
+	seen := make(map[int]struct{}, n)
+	slot := HashBytes([]byte(key)) % m.size
+	for walked := uint64(0); len(nodes) < n && walked < m.size; walked++ {
+		idx := m.table[(slot+walked)%m.size]
+		if _, dup := seen[idx]; !dup {
+			seen[idx] = struct{}{}
+			nodes = append(nodes, m.nodes[idx])
+		}
+	}
+	return nodes
+}
+
+// Nodes returns a stable-sorted list of node identifiers present in the ring.
+func (m *Maglev) Nodes() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]string(nil), m.nodes...)
+}
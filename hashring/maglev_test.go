@@ -0,0 +1,75 @@
+package hashring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMaglev(t *testing.T) {
+	ring := NewMaglev(1000)
+	if got := ring.size; got != 1009 {
+		t.Fatalf("expected table size rounded up to prime 1009, got %d", got)
+	}
+	if _, ok := ring.GetNode("any-key"); ok {
+		t.Fatalf("GetNode should report false when ring is empty")
+	}
+	for i := 0; i < 5; i++ {
+		ring.AddNode(fmt.Sprintf("node%d", i))
+	}
+
+	t.Run("table slots are split evenly", func(t *testing.T) {
+		counts := make(map[int]int)
+		for _, idx := range ring.table {
+			if idx < 0 {
+				t.Fatalf("table has an empty slot")
+			}
+			counts[idx]++
+		}
+		for idx, count := range counts {
+			// every node fills at most one slot more than any other
+			if count < int(ring.size)/5 || count > int(ring.size)/5+1 {
+				t.Fatalf("node %s owns %d slots; want about %d", ring.nodes[idx], count, ring.size/5)
+			}
+		}
+	})
+
+	t.Run("removing a node moves few other keys", func(t *testing.T) {
+		const numKeys = 10000
+		owners := make(map[string]string, numKeys)
+		for i := 0; i < numKeys; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			owners[key], _ = ring.GetNode(key)
+		}
+		ring.RemoveNode("node2")
+		disrupted := 0
+		for key, before := range owners {
+			after, _ := ring.GetNode(key)
+			if after == "node2" {
+				t.Fatalf("key %q still maps to removed node", key)
+			}
+			if before != "node2" && after != before {
+				disrupted++
+			}
+		}
+		if disrupted > numKeys/20 {
+			t.Fatalf("%d keys of surviving nodes moved; want under %d", disrupted, numKeys/20)
+		}
+		ring.RemoveNode("node2")
+		if got := len(ring.Nodes()); got != 4 {
+			t.Fatalf("expected 4 nodes after removing twice, got %d", got)
+		}
+	})
+
+	t.Run("GetNodes returns distinct nodes", func(t *testing.T) {
+		nodes := ring.GetNodes("key", 3)
+		if len(nodes) != 3 {
+			t.Fatalf("expected 3 nodes, got %v", nodes)
+		}
+		if owner, _ := ring.GetNode("key"); nodes[0] != owner {
+			t.Fatalf("GetNodes[0] = %s; GetNode = %s", nodes[0], owner)
+		}
+		if nodes[0] == nodes[1] || nodes[1] == nodes[2] || nodes[0] == nodes[2] {
+			t.Fatalf("GetNodes returned duplicates: %v", nodes)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package hashring
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// Rendezvous implements weighted highest-random-weight hashing. Every node
+// scores every key and the highest score wins, so lookups need no token
+// table and removing a node only moves the keys it owned. Lookups cost
+// O(nodes), which suits small node sets. The ring is safe for concurrent use.
+type Rendezvous struct {
+	// node IDs mapped to their weight
+	weights map[string]int
+	// node hashes, precomputed so scoring a key only mixes two hashes
+	nodeHashes map[string]uint64
+	mu         sync.RWMutex
+}
+
+// NewRendezvous creates an empty Rendezvous ring.
+func NewRendezvous() *Rendezvous {
+	return &Rendezvous{
+		weights:    make(map[string]int),
+		nodeHashes: make(map[string]uint64),
+	}
+}
+
+// AddNode adds a node with weight 1.
+// Adding an existing node is a no-op.
+func (r *Rendezvous) AddNode(nodeID string) {
+	r.AddNodeWithWeight(nodeID, 1)
+}
+
+// AddNodeWithWeight adds a node whose expected share of keys is proportional
+// to weight. If weight <= 0, a weight of 1 is used.
+// Adding an existing node is a no-op; use SetWeight to change its weight.
+func (r *Rendezvous) AddNodeWithWeight(nodeID string, weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.weights[nodeID]; exists {
+		return
+	}
+	r.weights[nodeID] = weight
+	r.nodeHashes[nodeID] = HashBytes([]byte(nodeID))
+}
+
+// SetWeight changes the weight of an existing node. Raising a weight only
+// moves keys to the node and lowering it only moves keys away from it.
+// If weight <= 0, a weight of 1 is used.
+// Setting the weight of a missing node is a no-op.
+func (r *Rendezvous) SetWeight(nodeID string, weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.weights[nodeID]; exists {
+		r.weights[nodeID] = weight
+	}
+}
+
+// Weight returns the weight of nodeID, or 0 if the node is not in the ring.
+func (r *Rendezvous) Weight(nodeID string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.weights[nodeID]
+}
+
+// RemoveNode removes a node from the ring.
+// Removing a missing node is a no-op.
+func (r *Rendezvous) RemoveNode(nodeID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.weights, nodeID)
+	delete(r.nodeHashes, nodeID)
+}
+
+// score returns the weighted score of a node for a key hash, using the
+// logarithmic method so that each node wins with probability proportional to
+// its weight. The caller must hold the lock.
+func (r *Rendezvous) score(keyHash uint64, nodeID string) float64 {
+	// splitmix64 finalizer over the combined hashes
+	x := keyHash ^ r.nodeHashes[nodeID]
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	// map to the open interval (0, 1)
+	u := (float64(x>>11) + 0.5) / (1 << 53)
+	return -float64(r.weights[nodeID]) / math.Log(u)
+}
+
+// GetNode returns the nodeID with the highest score for the given key.
+// The second return value is false if the ring is empty.
+func (r *Rendezvous) GetNode(key string) (string, bool) {
+	nodes := r.GetNodes(key, 1)
+	if len(nodes) == 0 {
+		return "", false
+	}
+	return nodes[0], true
+}
+
+// GetNodes returns up to n distinct nodeIDs for the given key, ordered by
+// descending score.
+func (r *Rendezvous) GetNodes(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.weights) == 0 || n <= 0 {
+		return nil
+	}
+	keyHash := HashBytes([]byte(key))
+	nodes := make([]string, 0, len(r.weights))
+	scores := make(map[string]float64, len(r.weights))
+	for nodeID := range r.weights {
+		nodes = append(nodes, nodeID)
+		scores[nodeID] = r.score(keyHash, nodeID)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if scores[nodes[i]] != scores[nodes[j]] {
+			return scores[nodes[i]] > scores[nodes[j]]
+		}
+		return nodes[i] < nodes[j]
+	})
+	return nodes[:min(n, len(nodes))]
+}
+
+// Nodes returns a stable-sorted list of node identifiers present in the ring.
+func (r *Rendezvous) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	nodes := make([]string, 0, len(r.weights))
+	for nodeID := range r.weights {
+		nodes = append(nodes, nodeID)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
@@ -0,0 +1,115 @@
+package hashring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRendezvousAddAndRemoveNode(t *testing.T) {
+	ring := NewRendezvous()
+	if _, ok := ring.GetNode("any-key"); ok {
+		t.Fatalf("GetNode should report false when ring is empty")
+	}
+
+	ring.AddNode("nodeA")
+	ring.AddNode("nodeA")
+	if got := ring.Nodes(); len(got) != 1 || got[0] != "nodeA" {
+		t.Fatalf("expected nodes [nodeA] after duplicate add, got %v", got)
+	}
+	if got := ring.Weight("nodeA"); got != 1 {
+		t.Fatalf("expected default weight 1, got %d", got)
+	}
+
+	ring.RemoveNode("does-not-exist")
+	ring.RemoveNode("nodeA")
+	if got := ring.Nodes(); len(got) != 0 {
+		t.Fatalf("expected empty ring, got %v", got)
+	}
+	if _, ok := ring.GetNode("any-key"); ok {
+		t.Fatalf("GetNode should report false when ring is empty")
+	}
+}
+
+func TestRendezvousRemapping(t *testing.T) {
+	ring := NewRendezvous()
+	for i := 0; i < 4; i++ {
+		ring.AddNode(fmt.Sprintf("node%d", i))
+	}
+
+	const numKeys = 10000
+	owners := make(map[string]string, numKeys)
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owners[key], _ = ring.GetNode(key)
+	}
+
+	t.Run("adding a node only moves keys to it", func(t *testing.T) {
+		ring.AddNode("node4")
+		moved := 0
+		for key, before := range owners {
+			after, _ := ring.GetNode(key)
+			if after != before {
+				if after != "node4" {
+					t.Fatalf("key %q moved from %s to %s; only moves to node4 expected", key, before, after)
+				}
+				moved++
+			}
+		}
+		if moved < numKeys/5*8/10 || moved > numKeys/5*12/10 {
+			t.Fatalf("moved %d keys; want about %d", moved, numKeys/5)
+		}
+		ring.RemoveNode("node4")
+	})
+
+	t.Run("removing a node only moves its keys", func(t *testing.T) {
+		ring.RemoveNode("node1")
+		for key, before := range owners {
+			after, _ := ring.GetNode(key)
+			if before != "node1" && after != before {
+				t.Fatalf("key %q moved from %s to %s", key, before, after)
+			}
+			if after == "node1" {
+				t.Fatalf("key %q still maps to removed node", key)
+			}
+		}
+		ring.AddNode("node1")
+	})
+
+	t.Run("weights scale the share of keys", func(t *testing.T) {
+		ring.SetWeight("node0", 4)
+		counts := make(map[string]int)
+		for key, before := range owners {
+			after, _ := ring.GetNode(key)
+			if after != before && after != "node0" {
+				t.Fatalf("key %q moved from %s to %s; only moves to node0 expected", key, before, after)
+			}
+			counts[after]++
+		}
+		// node0 should take 4 of 7 shares
+		want := numKeys * 4 / 7
+		if got := counts["node0"]; got < want*9/10 || got > want*11/10 {
+			t.Fatalf("node0 holds %d keys; want about %d", got, want)
+		}
+		ring.SetWeight("node0", 1)
+		for key, before := range owners {
+			if after, _ := ring.GetNode(key); after != before {
+				t.Fatalf("key %q owned by %s after restoring weight; want %s", key, after, before)
+			}
+		}
+	})
+
+	t.Run("GetNodes orders distinct nodes by score", func(t *testing.T) {
+		nodes := ring.GetNodes("key", 10)
+		if len(nodes) != 4 {
+			t.Fatalf("expected 4 nodes, got %v", nodes)
+		}
+		if owner, _ := ring.GetNode("key"); nodes[0] != owner {
+			t.Fatalf("GetNodes[0] = %s; GetNode = %s", nodes[0], owner)
+		}
+		// removing the top node promotes the second one
+		ring.RemoveNode(nodes[0])
+		if owner, _ := ring.GetNode("key"); owner != nodes[1] {
+			t.Fatalf("after removing %s, GetNode = %s; want %s", nodes[0], owner, nodes[1])
+		}
+	})
+}
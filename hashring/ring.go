@@ -0,0 +1,44 @@
+package hashring
+
+import "math"
+
+// Ring maps keys to nodes. HashRing, Jump, Maglev and Rendezvous implement it with
+// different trade-offs between lookup cost, load spread and how many keys
+// move when membership changes.
+type Ring interface {
+	// AddNode adds a node. Adding an existing node is a no-op.
+	AddNode(nodeID string)
+	// RemoveNode removes a node. Removing a missing node is a no-op.
+	RemoveNode(nodeID string)
+	// GetNode returns the node responsible for key, or false if the ring is empty.
+	GetNode(key string) (string, bool)
+	// GetNodes returns up to n distinct nodes for key, starting with GetNode's.
+	GetNodes(key string, n int) []string
+	// Nodes returns the node identifiers in stable-sorted order.
+	Nodes() []string
+}
+
+// WeightedRing is a Ring whose nodes can take unequal shares of the keys.
+type WeightedRing interface {
+	Ring
+	AddNodeWithWeight(nodeID string, weight int)
+	SetWeight(nodeID string, weight int)
+	Weight(nodeID string) int
+}
+
+var (
+	_ WeightedRing = (*HashRing)(nil)
+	_ Ring         = (*Jump)(nil)
+	_ Ring         = (*Maglev)(nil)
+	_ WeightedRing = (*Rendezvous)(nil)
+)
+
+// BoundedCapacity returns the most keys a node may hold under consistent
+// hashing with bounded loads (Mirrokni et al.): ceil((1+epsilon) * keys / nodes).
+// It returns 0 if there are no nodes.
+func BoundedCapacity(keys, nodes int, epsilon float64) int {
+	if nodes <= 0 {
+		return 0
+	}
+	return int(math.Ceil((1 + epsilon) * float64(keys) / float64(nodes)))
+}
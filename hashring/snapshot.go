@@ -0,0 +1,257 @@
+package hashring
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// SnapshotFormat is the version of the snapshot encoding written by
+// MarshalBinary and Snapshot. Decoders reject other versions.
+const SnapshotFormat = 1
+
+// snapshotMagic starts every binary snapshot.
+var snapshotMagic = []byte("CRNG")
+
+var (
+	// ErrStaleSnapshot means a snapshot is older than the ring it is
+	// restored into.
+	ErrStaleSnapshot = errors.New("hashring: snapshot is older than the ring")
+	// ErrSnapshotMismatch means a snapshot was taken from a ring configured
+	// differently: another replica count, placement or hasher.
+	ErrSnapshotMismatch = errors.New("hashring: snapshot does not match the ring configuration")
+	// ErrMalformedSnapshot means a snapshot could not be decoded or is
+	// inconsistent.
+	ErrMalformedSnapshot = errors.New("hashring: malformed snapshot")
+)
+
+// Snapshot is the serializable state of a HashRing at one epoch. It encodes
+// to JSON through its field tags and to a compact binary form through
+// MarshalBinary.
+type Snapshot struct {
+	Format      int            `json:"format"`
+	Epoch       uint64         `json:"epoch"`
+	NumReplicas int            `json:"num_replicas"`
+	Ketama      bool           `json:"ketama,omitempty"`
+	Nodes       []SnapshotNode `json:"nodes"`
+}
+
+// SnapshotNode is one node of a Snapshot.
+type SnapshotNode struct {
+	ID     string `json:"id"`
+	Weight int    `json:"weight"`
+	// Tokens are the ring positions the node owns, in ascending order. A
+	// token two nodes hash to belongs to only one of them.
+	Tokens []uint64 `json:"tokens"`
+}
+
+// Snapshot returns the current state of the ring, with nodes sorted by ID.
+func (r *HashRing) Snapshot() *Snapshot {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	s := &Snapshot{
+		Format:      SnapshotFormat,
+		Epoch:       r.epoch,
+		NumReplicas: r.numReplicas,
+		Ketama:      r.ketama,
+		Nodes:       make([]SnapshotNode, 0, len(r.nodeSet)),
+	}
+	index := make(map[string]int, len(r.nodeSet))
+	for nodeID, weight := range r.nodeSet {
+		s.Nodes = append(s.Nodes, SnapshotNode{ID: nodeID, Weight: weight})
+	}
+	sort.Slice(s.Nodes, func(i, j int) bool { return s.Nodes[i].ID < s.Nodes[j].ID })
+	for i, n := range s.Nodes {
+		index[n.ID] = i
+	}
+	// sortedKeys is ascending, so every node's tokens come out ascending
+	for _, token := range r.sortedKeys {
+		i := index[r.keyToNode[token]]
+		s.Nodes[i].Tokens = append(s.Nodes[i].Tokens, token)
+	}
+	return s
+}
+
+// Restore replaces the nodes, weights and tokens of the ring with those of s
+// and takes its epoch. Lookups see either the old layout or the new one,
+// never a mix. Restoring a snapshot with the ring's own epoch is allowed, so
+// restoring twice is harmless; an older epoch returns ErrStaleSnapshot.
+//
+// The ring must be configured like the one the snapshot was taken from. The
+// tokens of every node are checked against the ring's hasher, and a
+// difference returns ErrSnapshotMismatch. On error the ring is unchanged.
+func (r *HashRing) Restore(s *Snapshot) error {
+	if s.Format != SnapshotFormat {
+		return fmt.Errorf("%w: format %d", ErrMalformedSnapshot, s.Format)
+	}
+	if s.NumReplicas != r.numReplicas || s.Ketama != r.ketama {
+		return ErrSnapshotMismatch
+	}
+
+	// compute and check the new layout before taking the lock
+	keyToNode := make(map[uint64]string)
+	nodeSet := make(map[string]int, len(s.Nodes))
+	for _, n := range s.Nodes {
+		if _, dup := nodeSet[n.ID]; dup || n.Weight <= 0 {
+			return fmt.Errorf("%w: node %q", ErrMalformedSnapshot, n.ID)
+		}
+		nodeSet[n.ID] = n.Weight
+		own := r.TokensForWeight(n.ID, n.Weight)
+		slices.Sort(own)
+		for _, token := range n.Tokens {
+			if _, found := slices.BinarySearch(own, token); !found {
+				return fmt.Errorf("%w: token %d of node %q", ErrSnapshotMismatch, token, n.ID)
+			}
+			if _, dup := keyToNode[token]; dup {
+				return fmt.Errorf("%w: token %d owned twice", ErrMalformedSnapshot, token)
+			}
+			keyToNode[token] = n.ID
+		}
+	}
+	sortedKeys := make([]uint64, 0, len(keyToNode))
+	for token := range keyToNode {
+		sortedKeys = append(sortedKeys, token)
+	}
+	slices.Sort(sortedKeys)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s.Epoch < r.epoch {
+		return ErrStaleSnapshot
+	}
+	r.keyToNode = keyToNode
+	r.sortedKeys = sortedKeys
+	r.nodeSet = nodeSet
+	r.epoch = s.Epoch
+	return nil
+}
+
+// MarshalBinary encodes s as the magic "CRNG", the format byte, then the
+// epoch, replica count, ketama flag and node count, followed by every node
+// as its ID, weight and token count and the gaps between its ascending
+// tokens. All integers are uvarints.
+func (s *Snapshot) MarshalBinary() ([]byte, error) {
+	buf := append([]byte(nil), snapshotMagic...)
+	buf = append(buf, SnapshotFormat)
+	buf = binary.AppendUvarint(buf, s.Epoch)
+	buf = binary.AppendUvarint(buf, uint64(s.NumReplicas))
+	if s.Ketama {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(s.Nodes)))
+	for _, n := range s.Nodes {
+		if !slices.IsSorted(n.Tokens) {
+			return nil, fmt.Errorf("%w: tokens of node %q are not sorted", ErrMalformedSnapshot, n.ID)
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(n.ID)))
+		buf = append(buf, n.ID...)
+		buf = binary.AppendUvarint(buf, uint64(n.Weight))
+		buf = binary.AppendUvarint(buf, uint64(len(n.Tokens)))
+		var prev uint64
+		for _, token := range n.Tokens {
+			buf = binary.AppendUvarint(buf, token-prev)
+			prev = token
+		}
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a snapshot written by MarshalBinary.
+func (s *Snapshot) UnmarshalBinary(data []byte) error {
+	if len(data) < len(snapshotMagic) || string(data[:len(snapshotMagic)]) != string(snapshotMagic) {
+		return fmt.Errorf("%w: bad magic", ErrMalformedSnapshot)
+	}
+	d := decoder{data: data[len(snapshotMagic):]}
+	if format := d.readByte(); format != SnapshotFormat {
+		return fmt.Errorf("%w: format %d", ErrMalformedSnapshot, format)
+	}
+	out := Snapshot{Format: SnapshotFormat}
+	out.Epoch = d.uvarint()
+	out.NumReplicas = d.int()
+	out.Ketama = d.readByte() == 1
+	count := d.int()
+	for i := 0; i < count && d.err == nil; i++ {
+		var n SnapshotNode
+		n.ID = string(d.bytes(d.int()))
+		n.Weight = d.int()
+		tokens := d.int()
+		if tokens > len(d.data) {
+			// every token takes at least one byte
+			d.fail()
+			break
+		}
+		n.Tokens = make([]uint64, 0, tokens)
+		var prev uint64
+		for j := 0; j < tokens && d.err == nil; j++ {
+			prev += d.uvarint()
+			n.Tokens = append(n.Tokens, prev)
+		}
+		out.Nodes = append(out.Nodes, n)
+	}
+	if d.err == nil && len(d.data) > 0 {
+		d.fail()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	*s = out
+	return nil
+}
+
+// decoder reads the fields of a binary snapshot, remembering the first error.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: truncated or trailing data", ErrMalformedSnapshot)
+	}
+	d.data = nil
+}
+
+func (d *decoder) readByte() byte {
+	if len(d.data) < 1 {
+		d.fail()
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// int reads a uvarint that must fit in an int.
+func (d *decoder) int() int {
+	v := d.uvarint()
+	if v > uint64(int(^uint(0)>>1)) {
+		d.fail()
+		return 0
+	}
+	return int(v)
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if n > len(d.data) {
+		d.fail()
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
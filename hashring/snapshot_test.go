@@ -0,0 +1,172 @@
+package hashring
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// sameRouting fails unless a and b send every test key to the same node.
+func sameRouting(t *testing.T, a, b *HashRing) {
+	t.Helper()
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		want, _ := a.GetNode(key)
+		if got, _ := b.GetNode(key); got != want {
+			t.Fatalf("key %s routed to %s, want %s", key, got, want)
+		}
+	}
+}
+
+func TestEpoch(t *testing.T) {
+	ring := New(10)
+	ring.AddNode("a")
+	ring.AddNodeWithWeight("b", 2)
+	ring.AddNode("a") // no-op
+	ring.SetWeight("b", 3)
+	ring.SetWeight("missing", 2) // no-op
+	ring.RemoveNode("a")
+	ring.RemoveNode("a") // no-op
+	if got := ring.Epoch(); got != 4 {
+		t.Fatalf("epoch got %d, want %d", got, 4)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	src := New(50)
+	src.AddNode("a")
+	src.AddNodeWithWeight("b", 3)
+	src.AddNode("c")
+	src.SetWeight("c", 2)
+
+	t.Run("snapshot", func(t *testing.T) {
+		s := src.Snapshot()
+		if s.Epoch != src.Epoch() || s.NumReplicas != 50 {
+			t.Fatalf("snapshot epoch %d replicas %d, want %d and 50", s.Epoch, s.NumReplicas, src.Epoch())
+		}
+		var ids []string
+		total := 0
+		for _, n := range s.Nodes {
+			ids = append(ids, n.ID)
+			if !slices.IsSorted(n.Tokens) {
+				t.Fatalf("tokens of %s are not sorted", n.ID)
+			}
+			total += len(n.Tokens)
+		}
+		if !slices.Equal(ids, []string{"a", "b", "c"}) {
+			t.Fatalf("snapshot nodes %v", ids)
+		}
+		if total != 6*50 {
+			t.Fatalf("snapshot tokens got %d, want %d", total, 6*50)
+		}
+	})
+
+	t.Run("json round trip", func(t *testing.T) {
+		data, err := json.Marshal(src.Snapshot())
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		var s Snapshot
+		if err := json.Unmarshal(data, &s); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		dst := New(50)
+		if err := dst.Restore(&s); err != nil {
+			t.Fatalf("Restore: %v", err)
+		}
+		if dst.Epoch() != src.Epoch() || dst.Weight("b") != 3 || dst.Weight("c") != 2 {
+			t.Fatalf("restored epoch %d weights %d %d", dst.Epoch(), dst.Weight("b"), dst.Weight("c"))
+		}
+		sameRouting(t, src, dst)
+	})
+
+	t.Run("binary round trip", func(t *testing.T) {
+		data, err := src.Snapshot().MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary: %v", err)
+		}
+		js, _ := json.Marshal(src.Snapshot())
+		if len(data) >= len(js)/2 {
+			t.Fatalf("binary snapshot is %d bytes, JSON %d", len(data), len(js))
+		}
+		var s Snapshot
+		if err := s.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary: %v", err)
+		}
+		dst := New(50)
+		dst.AddNode("stale")
+		if err := dst.Restore(&s); err != nil {
+			t.Fatalf("Restore: %v", err)
+		}
+		if !slices.Equal(dst.Nodes(), []string{"a", "b", "c"}) {
+			t.Fatalf("restored nodes %v", dst.Nodes())
+		}
+		sameRouting(t, src, dst)
+
+		// the restored ring keeps working like the source
+		src.AddNode("d")
+		dst.AddNode("d")
+		sameRouting(t, src, dst)
+		if dst.Epoch() != src.Epoch() {
+			t.Fatalf("epoch got %d, want %d", dst.Epoch(), src.Epoch())
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		old := src.Snapshot()
+		src.AddNode("e")
+		dst := New(50)
+		if err := dst.Restore(src.Snapshot()); err != nil {
+			t.Fatalf("Restore: %v", err)
+		}
+		if err := dst.Restore(old); !errors.Is(err, ErrStaleSnapshot) {
+			t.Fatalf("Restore of older snapshot got %v, want ErrStaleSnapshot", err)
+		}
+		if err := dst.Restore(src.Snapshot()); err != nil {
+			t.Fatalf("Restore of same epoch: %v", err)
+		}
+		sameRouting(t, src, dst)
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		s := src.Snapshot()
+		for name, ring := range map[string]*HashRing{
+			"replicas": New(10),
+			"ketama":   New(50, WithKetama()),
+			"hasher":   New(50, WithHasher(FNV1a)),
+		} {
+			ring.AddNode("x")
+			if err := ring.Restore(s); !errors.Is(err, ErrSnapshotMismatch) {
+				t.Fatalf("%s: Restore got %v, want ErrSnapshotMismatch", name, err)
+			}
+			if !slices.Equal(ring.Nodes(), []string{"x"}) {
+				t.Fatalf("%s: ring changed by failed Restore: %v", name, ring.Nodes())
+			}
+		}
+	})
+}
+
+func TestUnmarshalBinaryMalformed(t *testing.T) {
+	ring := New(5)
+	ring.AddNode("a")
+	ring.AddNode("b")
+	data, err := ring.Snapshot().MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	cases := map[string][]byte{
+		"empty":     nil,
+		"magic":     append([]byte("XXXX"), data[4:]...),
+		"format":    append(append([]byte("CRNG"), 9), data[5:]...),
+		"truncated": data[:len(data)-1],
+		"trailing":  append(slices.Clone(data), 0),
+	}
+	for name, b := range cases {
+		var s Snapshot
+		if err := s.UnmarshalBinary(b); !errors.Is(err, ErrMalformedSnapshot) {
+			t.Fatalf("%s: got %v, want ErrMalformedSnapshot", name, err)
+		}
+	}
+}
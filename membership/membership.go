@@ -0,0 +1,465 @@
+// Package membership tracks the members of a cache-ring cluster with the
+// SWIM gossip protocol over UDP.
+//
+// Every member periodically probes one other member. If the probe is not
+// acknowledged in time, k other members are asked to probe it indirectly,
+// and if that fails too the member is suspected. A suspect that does not
+// refute the suspicion within the suspicion timeout is declared dead.
+// Joins, leaves, suspicions and failures spread by piggybacking on the probe
+// traffic. Since piggybacked updates are sent a bounded number of times,
+// members also periodically exchange their whole view with a random member
+// (push-pull), which joining members do with their seeds as well.
+//
+// Members that join, leave or fail are added to and removed from a local
+// hashring.Ring, so routing follows membership without manual AddNode and
+// RemoveNode calls.
+package membership
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"cache-ring/hashring"
+)
+
+// Defaults for the membership options, tuned for a local network.
+const (
+	DefaultProbeInterval    = time.Second
+	DefaultProbeTimeout     = 200 * time.Millisecond
+	DefaultSuspicionTimeout = 5 * time.Second
+	DefaultPushPullInterval = 30 * time.Second
+	DefaultIndirectChecks   = 3
+	// DefaultRetransmitMult scales how often an update is piggybacked,
+	// which is this times log10 of the cluster size, rounded up.
+	DefaultRetransmitMult = 4
+)
+
+// ErrJoinFailed is returned by Join when no seed answered.
+var ErrJoinFailed = errors.New("membership: no seed answered")
+
+// State is the state of a member as seen locally.
+type State int
+
+const (
+	// Alive members answer probes.
+	Alive State = iota
+	// Suspect members missed a probe and are declared dead unless they
+	// refute the suspicion in time.
+	Suspect
+	// Dead members failed to refute a suspicion.
+	Dead
+	// Left members left the cluster gracefully.
+	Left
+)
+
+// String returns the state name.
+func (s State) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	case Left:
+		return "left"
+	}
+	return "unknown"
+}
+
+// Member is a member as seen locally.
+type Member struct {
+	Name string
+	// Addr is the UDP address the member gossips on.
+	Addr  string
+	State State
+	// Incarnation orders the updates about a member. Only the member itself
+	// raises it, to refute a suspicion.
+	Incarnation uint64
+}
+
+// EventType is the kind of a membership change.
+type EventType int
+
+const (
+	// EventJoin reports a member that became alive.
+	EventJoin EventType = iota
+	// EventLeave reports a member that left gracefully.
+	EventLeave
+	// EventFail reports a member that was declared dead.
+	EventFail
+)
+
+// String returns the event name.
+func (t EventType) String() string {
+	switch t {
+	case EventJoin:
+		return "join"
+	case EventLeave:
+		return "leave"
+	case EventFail:
+		return "fail"
+	}
+	return "unknown"
+}
+
+// Event is a membership change. Events are delivered in order, one at a
+// time, outside of any lock, so handlers may call back into the Memberlist.
+type Event struct {
+	Type   EventType
+	Member Member
+}
+
+// Memberlist is the local view of the cluster membership. It is safe for
+// concurrent use.
+type Memberlist struct {
+	name string
+	conn *net.UDPConn
+
+	probeInterval    time.Duration
+	probeTimeout     time.Duration
+	suspicionTimeout time.Duration
+	pushPullInterval time.Duration
+	indirectChecks   int
+	retransmitMult   int
+	// fraction of outgoing packets dropped, to simulate a lossy network
+	dropRate float64
+	ring     hashring.Ring
+	notify   func(Event)
+
+	mu          sync.Mutex
+	incarnation uint64
+	members     map[string]*member
+	// members in probe order, reshuffled after every round
+	probeOrder []string
+	probeIndex int
+	queue      broadcastQueue
+	seq        uint64
+	// sequence number -> callback run when its ack arrives
+	ackHandlers map[uint64]func()
+	leaving     bool
+
+	events *dispatcher
+	stop   chan struct{}
+	wg     sync.WaitGroup
+	closed bool
+}
+
+// member is the local record of a member.
+type member struct {
+	Member
+	addr *net.UDPAddr
+	// when the member entered its current state
+	since time.Time
+}
+
+// Option configures a Memberlist.
+type Option func(*Memberlist)
+
+// WithProbeInterval sets how often a member is probed.
+func WithProbeInterval(d time.Duration) Option {
+	return func(m *Memberlist) {
+		m.probeInterval = d
+	}
+}
+
+// WithProbeTimeout sets how long a direct probe waits for its ack before
+// indirect probes are sent. It must be shorter than the probe interval.
+func WithProbeTimeout(d time.Duration) Option {
+	return func(m *Memberlist) {
+		m.probeTimeout = d
+	}
+}
+
+// WithSuspicionTimeout sets how long a suspect has to refute the suspicion
+// before it is declared dead.
+func WithSuspicionTimeout(d time.Duration) Option {
+	return func(m *Memberlist) {
+		m.suspicionTimeout = d
+	}
+}
+
+// WithPushPullInterval sets how often the whole membership is exchanged
+// with a random member, which repairs views that missed some gossip.
+func WithPushPullInterval(d time.Duration) Option {
+	return func(m *Memberlist) {
+		m.pushPullInterval = d
+	}
+}
+
+// WithIndirectChecks sets the number of members asked to probe a member
+// that missed a direct probe.
+func WithIndirectChecks(k int) Option {
+	return func(m *Memberlist) {
+		m.indirectChecks = max(k, 0)
+	}
+}
+
+// WithPacketLoss drops the given fraction of outgoing packets at random. It
+// exists to test the protocol against an unreliable network.
+func WithPacketLoss(rate float64) Option {
+	return func(m *Memberlist) {
+		m.dropRate = rate
+	}
+}
+
+// WithRing keeps ring in sync with the membership: the local member and
+// every member that joins are added, and members that leave or fail are
+// removed.
+func WithRing(ring hashring.Ring) Option {
+	return func(m *Memberlist) {
+		m.ring = ring
+	}
+}
+
+// WithNotify calls fn for every membership change.
+func WithNotify(fn func(Event)) Option {
+	return func(m *Memberlist) {
+		m.notify = fn
+	}
+}
+
+// New starts a member called name gossiping on the UDP address bindAddr.
+// It knows only itself until Join is called.
+func New(name, bindAddr string, opts ...Option) (*Memberlist, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", bindAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	m := &Memberlist{
+		name:             name,
+		conn:             conn,
+		probeInterval:    DefaultProbeInterval,
+		probeTimeout:     DefaultProbeTimeout,
+		suspicionTimeout: DefaultSuspicionTimeout,
+		pushPullInterval: DefaultPushPullInterval,
+		indirectChecks:   DefaultIndirectChecks,
+		retransmitMult:   DefaultRetransmitMult,
+		members:          make(map[string]*member),
+		ackHandlers:      make(map[uint64]func()),
+		stop:             make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.events = newDispatcher(m.handleEvent)
+
+	local := conn.LocalAddr().(*net.UDPAddr)
+	m.members[name] = &member{
+		Member: Member{Name: name, Addr: local.String(), State: Alive},
+		addr:   local,
+		since:  time.Now(),
+	}
+	m.events.push(Event{Type: EventJoin, Member: m.members[name].Member})
+
+	m.wg.Add(2)
+	go m.receiveLoop()
+	go m.probeLoop()
+	return m, nil
+}
+
+// Name returns the name of the local member.
+func (m *Memberlist) Name() string { return m.name }
+
+// Addr returns the UDP address the local member gossips on.
+func (m *Memberlist) Addr() string { return m.conn.LocalAddr().String() }
+
+// Members returns the members that are alive or suspect, sorted by name.
+func (m *Memberlist) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var members []Member
+	for _, mb := range m.members {
+		if mb.State == Alive || mb.State == Suspect {
+			members = append(members, mb.Member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+// Member returns the local view of the member called name.
+func (m *Memberlist) Member(name string) (Member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mb, ok := m.members[name]
+	if !ok {
+		return Member{}, false
+	}
+	return mb.Member, true
+}
+
+// Join exchanges the whole membership with the seeds, given as UDP
+// addresses, and returns once the first answers within timeout. The seeds
+// then spread the news of the local member. It returns ErrJoinFailed if no seed
+// answered.
+func (m *Memberlist) Join(timeout time.Duration, seeds ...string) error {
+	var addrs []*net.UDPAddr
+	for _, seed := range seeds {
+		addr, err := net.ResolveUDPAddr("udp", seed)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+	}
+	seq, acked := m.expectAck()
+	defer m.forgetAck(seq)
+
+	deadline := time.After(timeout)
+	// retry, since a join or its answer may be lost
+	retry := time.NewTicker(max(m.probeTimeout, time.Millisecond))
+	defer retry.Stop()
+	for {
+		for _, addr := range addrs {
+			m.send(addr, &message{Type: msgPushPull, Seq: seq, Updates: m.state()})
+		}
+		select {
+		case <-acked:
+			return nil
+		case <-deadline:
+			return ErrJoinFailed
+		case <-m.stop:
+			return ErrJoinFailed
+		case <-retry.C:
+		}
+	}
+}
+
+// Leave announces that the local member leaves, and gives the announcement
+// the given time to spread before returning. The member stops answering
+// probes; call Shutdown afterwards.
+func (m *Memberlist) Leave(timeout time.Duration) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return fmt.Errorf("membership: %s is shut down", m.name)
+	}
+	m.leaving = true
+	self := m.members[m.name]
+	self.State = Left
+	self.since = time.Now()
+	leave := toUpdate(self.Member)
+	m.queue.push(leave)
+	var peers []*net.UDPAddr
+	for _, mb := range m.members {
+		if mb.Name != m.name && (mb.State == Alive || mb.State == Suspect) {
+			peers = append(peers, mb.addr)
+		}
+	}
+	m.mu.Unlock()
+
+	// tell every peer directly instead of waiting for a probe to carry it
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, addr := range peers {
+			m.send(addr, &message{Type: msgGossip, Updates: []update{leave}})
+		}
+		time.Sleep(min(m.probeInterval, time.Until(deadline)))
+	}
+	return nil
+}
+
+// Shutdown stops gossiping and closes the socket without telling anyone;
+// to the other members it looks like a failure unless Leave was called.
+func (m *Memberlist) Shutdown() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	m.mu.Unlock()
+	close(m.stop)
+	err := m.conn.Close()
+	m.wg.Wait()
+	m.events.close()
+	return err
+}
+
+// handleEvent applies an event to the ring and passes it on.
+func (m *Memberlist) handleEvent(e Event) {
+	if m.ring != nil {
+		switch e.Type {
+		case EventJoin:
+			m.ring.AddNode(e.Member.Name)
+		case EventLeave, EventFail:
+			m.ring.RemoveNode(e.Member.Name)
+		}
+	}
+	if m.notify != nil {
+		m.notify(e)
+	}
+}
+
+// dispatcher delivers events in order on its own goroutine through an
+// unbounded queue, so the protocol never blocks on a slow handler.
+type dispatcher struct {
+	handle func(Event)
+	mu     sync.Mutex
+	queue  []Event
+	wake   chan struct{}
+	done   chan struct{}
+	closed bool
+}
+
+func newDispatcher(handle func(Event)) *dispatcher {
+	d := &dispatcher{handle: handle, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	go d.run()
+	return d
+}
+
+func (d *dispatcher) push(e Event) {
+	d.mu.Lock()
+	d.queue = append(d.queue, e)
+	d.mu.Unlock()
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *dispatcher) run() {
+	defer close(d.done)
+	for {
+		d.mu.Lock()
+		events, closed := d.queue, d.closed
+		d.queue = nil
+		d.mu.Unlock()
+		for _, e := range events {
+			d.handle(e)
+		}
+		if closed && len(events) == 0 {
+			return
+		}
+		if len(events) == 0 {
+			<-d.wake
+		}
+	}
+}
+
+// close delivers the queued events and stops the dispatcher.
+func (d *dispatcher) close() {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	<-d.done
+}
+
+// shuffle returns names in random order.
+func shuffle(names []string) []string {
+	rand.Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
+	return names
+}
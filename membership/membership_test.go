@@ -0,0 +1,218 @@
+package membership
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"cache-ring/hashring"
+)
+
+// testMember is a member with its ring and the events it saw.
+type testMember struct {
+	*Memberlist
+	ring *hashring.HashRing
+
+	mu     sync.Mutex
+	events []Event
+}
+
+func (tm *testMember) seen(typ EventType, name string) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return slices.ContainsFunc(tm.events, func(e Event) bool { return e.Type == typ && e.Member.Name == name })
+}
+
+// startMembers starts n members on localhost that drop the given fraction
+// of their packets and joins them through the first.
+func startMembers(t *testing.T, n int, loss float64) []*testMember {
+	t.Helper()
+	var members []*testMember
+	for i := 0; i < n; i++ {
+		tm := &testMember{ring: hashring.New(10)}
+		m, err := New(fmt.Sprintf("node-%d", i), "127.0.0.1:0",
+			WithProbeInterval(50*time.Millisecond),
+			WithProbeTimeout(20*time.Millisecond),
+			WithSuspicionTimeout(500*time.Millisecond),
+			WithPushPullInterval(200*time.Millisecond),
+			WithPacketLoss(loss),
+			WithRing(tm.ring),
+			WithNotify(func(e Event) {
+				tm.mu.Lock()
+				tm.events = append(tm.events, e)
+				tm.mu.Unlock()
+			}),
+		)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		tm.Memberlist = m
+		t.Cleanup(func() { m.Shutdown() })
+		members = append(members, tm)
+	}
+	for _, tm := range members[1:] {
+		if err := tm.Join(2*time.Second, members[0].Addr()); err != nil {
+			t.Fatalf("%s failed to join: %v", tm.Name(), err)
+		}
+	}
+	return members
+}
+
+// waitFor polls cond until it holds or the timeout expires.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// names returns the names of members.
+func names(members []Member) []string {
+	var out []string
+	for _, mb := range members {
+		out = append(out, mb.Name)
+	}
+	return out
+}
+
+func TestMembershipUnderPacketLoss(t *testing.T) {
+	members := startMembers(t, 5, 0.1)
+	all := []string{"node-0", "node-1", "node-2", "node-3", "node-4"}
+
+	t.Run("joins converge", func(t *testing.T) {
+		for _, tm := range members {
+			waitFor(t, 5*time.Second, tm.Name()+" to see every member", func() bool {
+				return slices.Equal(names(tm.Members()), all) && slices.Equal(tm.ring.Nodes(), all)
+			})
+		}
+	})
+
+	t.Run("leave is gossiped", func(t *testing.T) {
+		leaver := members[4]
+		if err := leaver.Leave(200 * time.Millisecond); err != nil {
+			t.Fatalf("Leave: %v", err)
+		}
+		leaver.Shutdown()
+		for _, tm := range members[:4] {
+			waitFor(t, 5*time.Second, tm.Name()+" to drop node-4", func() bool {
+				mb, _ := tm.Member("node-4")
+				return mb.State == Left && !slices.Contains(tm.ring.Nodes(), "node-4") && tm.seen(EventLeave, "node-4")
+			})
+		}
+	})
+
+	t.Run("failures are detected", func(t *testing.T) {
+		members[3].Shutdown()
+		for _, tm := range members[:3] {
+			waitFor(t, 10*time.Second, tm.Name()+" to declare node-3 dead", func() bool {
+				mb, _ := tm.Member("node-3")
+				return mb.State == Dead && !slices.Contains(tm.ring.Nodes(), "node-3") && tm.seen(EventFail, "node-3")
+			})
+		}
+		// the survivors must not have declared each other dead
+		for _, tm := range members[:3] {
+			if got := names(tm.Members()); !slices.Equal(got, all[:3]) {
+				t.Fatalf("%s sees members %v; want %v", tm.Name(), got, all[:3])
+			}
+		}
+	})
+}
+
+func TestRefuteSuspicion(t *testing.T) {
+	members := startMembers(t, 3, 0)
+	for _, tm := range members {
+		waitFor(t, 5*time.Second, tm.Name()+" to see every member", func() bool {
+			return len(tm.Members()) == 3
+		})
+	}
+	// spread a false rumour that node-1 is suspect
+	mb, _ := members[0].Member("node-1")
+	members[0].apply(update{Name: mb.Name, Addr: mb.Addr, State: Suspect, Incarnation: mb.Incarnation})
+
+	waitFor(t, 5*time.Second, "node-1 to refute the suspicion", func() bool {
+		mb, _ := members[0].Member("node-1")
+		return mb.State == Alive && mb.Incarnation > 0
+	})
+	if members[0].seen(EventFail, "node-1") {
+		t.Fatalf("node-1 was declared dead despite refuting")
+	}
+}
+
+func TestRejoinAfterFailure(t *testing.T) {
+	members := startMembers(t, 2, 0)
+	waitFor(t, 5*time.Second, "node-0 to see node-1", func() bool {
+		return len(members[0].Members()) == 2
+	})
+	// node-0 wrongly believes node-1 died; node-1 must outbid the rumour
+	mb, _ := members[0].Member("node-1")
+	members[0].apply(update{Name: mb.Name, Addr: mb.Addr, State: Dead, Incarnation: mb.Incarnation})
+	waitFor(t, time.Second, "node-1 to leave node-0's ring", func() bool {
+		return !slices.Contains(members[0].ring.Nodes(), "node-1")
+	})
+	if err := members[1].Join(2*time.Second, members[0].Addr()); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+	waitFor(t, 5*time.Second, "node-1 to be alive again", func() bool {
+		mb, _ := members[0].Member("node-1")
+		return mb.State == Alive && slices.Contains(members[0].ring.Nodes(), "node-1")
+	})
+}
+
+func TestRejoinAfterLeave(t *testing.T) {
+	members := startMembers(t, 2, 0)
+	waitFor(t, 5*time.Second, "node-0 to see node-1", func() bool {
+		return len(members[0].Members()) == 2
+	})
+	if err := members[1].Leave(100 * time.Millisecond); err != nil {
+		t.Fatalf("Leave: %v", err)
+	}
+	members[1].Shutdown()
+	waitFor(t, 5*time.Second, "node-0 to see node-1 leave", func() bool {
+		mb, _ := members[0].Member("node-1")
+		return mb.State == Left
+	})
+
+	// node-1 restarts under the same name with a fresh incarnation
+	restarted, err := New("node-1", "127.0.0.1:0",
+		WithProbeInterval(50*time.Millisecond),
+		WithProbeTimeout(20*time.Millisecond),
+		WithPushPullInterval(200*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { restarted.Shutdown() })
+	if err := restarted.Join(2*time.Second, members[0].Addr()); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+	waitFor(t, 5*time.Second, "node-1 to be alive again", func() bool {
+		mb, _ := members[0].Member("node-1")
+		return mb.State == Alive && mb.Addr == restarted.Addr() && slices.Contains(members[0].ring.Nodes(), "node-1")
+	})
+}
+
+func TestSupersedes(t *testing.T) {
+	cur := Member{Name: "a", State: Suspect, Incarnation: 2}
+	tests := []struct {
+		u    update
+		want bool
+	}{
+		{update{State: Alive, Incarnation: 2}, false},
+		{update{State: Alive, Incarnation: 3}, true},
+		{update{State: Suspect, Incarnation: 2}, false},
+		{update{State: Dead, Incarnation: 2}, true},
+		{update{State: Dead, Incarnation: 1}, false},
+		{update{State: Left, Incarnation: 2}, true},
+	}
+	for _, tt := range tests {
+		if got := supersedes(tt.u, cur); got != tt.want {
+			t.Fatalf("supersedes(%v %d) = %v, want %v", tt.u.State, tt.u.Incarnation, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package membership
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sort"
+	"time"
+)
+
+// msgType is the kind of a protocol message.
+type msgType int
+
+const (
+	// msgPing asks Target to answer with an ack carrying Seq.
+	msgPing msgType = iota
+	// msgAck answers a ping, directly or relayed for a ping-req.
+	msgAck
+	// msgPingReq asks the receiver to ping Target at TargetAddr and relay
+	// the ack.
+	msgPingReq
+	// msgPushPull carries the sender's whole membership. The receiver
+	// merges it and answers with msgSync. Joins use it too.
+	msgPushPull
+	// msgSync carries the sender's whole membership and acks a push-pull.
+	msgSync
+	// msgGossip only carries updates.
+	msgGossip
+)
+
+// message is one UDP packet. Every message piggybacks pending updates.
+type message struct {
+	Type       msgType  `json:"type"`
+	Seq        uint64   `json:"seq,omitempty"`
+	From       string   `json:"from"`
+	Target     string   `json:"target,omitempty"`
+	TargetAddr string   `json:"target_addr,omitempty"`
+	Updates    []update `json:"updates,omitempty"`
+}
+
+// update is the gossiped state of one member.
+type update struct {
+	Name        string `json:"name"`
+	Addr        string `json:"addr"`
+	State       State  `json:"state"`
+	Incarnation uint64 `json:"incarnation"`
+}
+
+func toUpdate(mb Member) update {
+	return update{Name: mb.Name, Addr: mb.Addr, State: mb.State, Incarnation: mb.Incarnation}
+}
+
+// maxPiggyback bounds the updates attached to one message, which keeps
+// packets well below the usual MTU-safe UDP payload.
+const maxPiggyback = 8
+
+// broadcastQueue holds the updates still to be piggybacked, at most one per
+// member, each with the number of times it was sent.
+type broadcastQueue struct {
+	items []queued
+}
+
+type queued struct {
+	update
+	transmits int
+}
+
+// push queues u, replacing any older update about the same member.
+func (q *broadcastQueue) push(u update) {
+	q.items = slices.DeleteFunc(q.items, func(it queued) bool { return it.Name == u.Name })
+	q.items = append(q.items, queued{update: u})
+}
+
+// take returns up to n of the least sent updates and drops the updates that
+// have been sent limit times.
+func (q *broadcastQueue) take(n, limit int) []update {
+	sort.SliceStable(q.items, func(i, j int) bool { return q.items[i].transmits < q.items[j].transmits })
+	var out []update
+	for i := 0; i < len(q.items) && len(out) < n; i++ {
+		out = append(out, q.items[i].update)
+		q.items[i].transmits++
+	}
+	q.items = slices.DeleteFunc(q.items, func(it queued) bool { return it.transmits >= limit })
+	return out
+}
+
+// retransmitLimit returns how often an update is piggybacked. The caller
+// must hold mu.
+func (m *Memberlist) retransmitLimit() int {
+	return m.retransmitMult * int(math.Ceil(math.Log10(float64(len(m.members)+1))))
+}
+
+// send piggybacks pending updates on msg and sends it to addr, unless the
+// simulated packet loss drops it.
+func (m *Memberlist) send(addr *net.UDPAddr, msg *message) {
+	m.mu.Lock()
+	msg.From = m.name
+	if msg.Type != msgSync && msg.Type != msgPushPull {
+		msg.Updates = append(msg.Updates, m.queue.take(maxPiggyback, m.retransmitLimit())...)
+	}
+	m.mu.Unlock()
+	if m.dropRate > 0 && rand.Float64() < m.dropRate {
+		return
+	}
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	m.conn.WriteToUDP(buf, addr)
+}
+
+// receiveLoop handles packets until the socket is closed.
+func (m *Memberlist) receiveLoop() {
+	defer m.wg.Done()
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-m.stop:
+				return
+			default:
+				continue
+			}
+		}
+		var msg message
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			continue
+		}
+		m.handle(&msg, from)
+	}
+}
+
+// handle processes one message from the UDP address from.
+func (m *Memberlist) handle(msg *message, from *net.UDPAddr) {
+	for _, u := range msg.Updates {
+		m.apply(u)
+	}
+	m.mu.Lock()
+	leaving := m.leaving
+	m.mu.Unlock()
+
+	switch msg.Type {
+	case msgPing:
+		// a member that left no longer answers, and a ping meant for an
+		// earlier member on this address is ignored
+		if !leaving && msg.Target == m.name {
+			m.send(from, &message{Type: msgAck, Seq: msg.Seq})
+		}
+	case msgAck, msgSync:
+		m.mu.Lock()
+		handler := m.ackHandlers[msg.Seq]
+		m.mu.Unlock()
+		if handler != nil {
+			handler()
+		}
+	case msgPingReq:
+		target, err := net.ResolveUDPAddr("udp", msg.TargetAddr)
+		if err != nil || leaving {
+			return
+		}
+		origin := msg.Seq
+		seq := m.onAck(func() {
+			m.send(from, &message{Type: msgAck, Seq: origin})
+		})
+		time.AfterFunc(m.probeInterval, func() { m.forgetAck(seq) })
+		m.send(target, &message{Type: msgPing, Seq: seq, Target: msg.Target})
+	case msgPushPull:
+		m.send(from, &message{Type: msgSync, Seq: msg.Seq, Updates: m.state()})
+	}
+}
+
+// state returns an update for every known member.
+func (m *Memberlist) state() []update {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	updates := make([]update, 0, len(m.members))
+	for _, mb := range m.members {
+		updates = append(updates, toUpdate(mb.Member))
+	}
+	return updates
+}
+
+// pushPull exchanges the whole membership with a random member. Piggybacked
+// gossip is sent a bounded number of times and may be lost; these periodic
+// full exchanges make every view converge regardless.
+func (m *Memberlist) pushPull() {
+	peers := m.randomPeers(1, "")
+	if len(peers) == 0 {
+		return
+	}
+	m.send(peers[0].addr, &message{Type: msgPushPull, Updates: m.state()})
+}
+
+// apply merges an update into the local view by the SWIM precedence rules:
+// a higher incarnation always wins, and at the same incarnation suspect
+// overrides alive and dead or left override both. Accepted updates are
+// queued for further gossip.
+func (m *Memberlist) apply(u update) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u.Name == m.name {
+		// refute rumours of our suspicion or death by outbidding them, and
+		// news of our leaving from before a restart under the same name
+		if u.State != Alive && !m.leaving && u.Incarnation >= m.incarnation {
+			m.incarnation = u.Incarnation + 1
+			self := m.members[m.name]
+			self.Incarnation = m.incarnation
+			m.queue.push(toUpdate(self.Member))
+		}
+		return
+	}
+
+	cur, known := m.members[u.Name]
+	if known && !supersedes(u, cur.Member) {
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", u.Addr)
+	if err != nil {
+		return
+	}
+	// unknown members that are already dead or left are still recorded, so
+	// a stale alive update cannot resurrect them
+	wasAlive := known && (cur.State == Alive || cur.State == Suspect)
+	mb := &member{
+		Member: Member{Name: u.Name, Addr: u.Addr, State: u.State, Incarnation: u.Incarnation},
+		addr:   addr,
+		since:  time.Now(),
+	}
+	m.members[u.Name] = mb
+	m.queue.push(u)
+
+	switch isAlive := u.State == Alive || u.State == Suspect; {
+	case isAlive && !wasAlive:
+		m.events.push(Event{Type: EventJoin, Member: mb.Member})
+	case !isAlive && wasAlive && u.State == Left:
+		m.events.push(Event{Type: EventLeave, Member: mb.Member})
+	case !isAlive && wasAlive:
+		m.events.push(Event{Type: EventFail, Member: mb.Member})
+	}
+}
+
+// supersedes reports whether u overrides the current view cur.
+func supersedes(u update, cur Member) bool {
+	if u.Incarnation != cur.Incarnation {
+		return u.Incarnation > cur.Incarnation
+	}
+	return rank(u.State) > rank(cur.State)
+}
+
+// rank orders states at the same incarnation.
+func rank(s State) int {
+	switch s {
+	case Alive:
+		return 0
+	case Suspect:
+		return 1
+	}
+	return 2
+}
+
+// onAck registers fn to run when an ack with the returned sequence number
+// arrives.
+func (m *Memberlist) onAck(fn func()) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	m.ackHandlers[m.seq] = fn
+	return m.seq
+}
+
+// expectAck returns a fresh sequence number and a channel that receives
+// once its ack arrives.
+func (m *Memberlist) expectAck() (uint64, <-chan struct{}) {
+	acked := make(chan struct{}, 1)
+	seq := m.onAck(func() {
+		select {
+		case acked <- struct{}{}:
+		default:
+		}
+	})
+	return seq, acked
+}
+
+func (m *Memberlist) forgetAck(seq uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.ackHandlers, seq)
+}
+
+// probeLoop probes one member per probe interval and exchanges the whole
+// membership with one per push-pull interval, until shutdown.
+func (m *Memberlist) probeLoop() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.probeInterval)
+	defer ticker.Stop()
+	pushPull := time.NewTicker(m.pushPullInterval)
+	defer pushPull.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.expireSuspects()
+			m.probe()
+		case <-pushPull.C:
+			m.pushPull()
+		}
+	}
+}
+
+// expireSuspects declares dead the suspects whose suspicion timed out.
+func (m *Memberlist) expireSuspects() {
+	m.mu.Lock()
+	var expired []update
+	for _, mb := range m.members {
+		if mb.State == Suspect && time.Since(mb.since) >= m.suspicionTimeout {
+			u := toUpdate(mb.Member)
+			u.State = Dead
+			expired = append(expired, u)
+		}
+	}
+	m.mu.Unlock()
+	for _, u := range expired {
+		m.apply(u)
+	}
+}
+
+// nextTarget returns the next member to probe. Members are probed in a
+// random order that is reshuffled after every full round, which bounds the
+// time until a failed member is probed.
+func (m *Memberlist) nextTarget() (*member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for tries := 0; tries <= len(m.members); tries++ {
+		if m.probeIndex >= len(m.probeOrder) {
+			m.probeOrder = m.probeOrder[:0]
+			for name := range m.members {
+				m.probeOrder = append(m.probeOrder, name)
+			}
+			m.probeOrder = shuffle(m.probeOrder)
+			m.probeIndex = 0
+		}
+		name := m.probeOrder[m.probeIndex]
+		m.probeIndex++
+		if mb, ok := m.members[name]; ok && name != m.name && (mb.State == Alive || mb.State == Suspect) {
+			return mb, true
+		}
+	}
+	return nil, false
+}
+
+// probe runs one SWIM probe: a direct ping, then indirect pings through
+// other members, and a suspicion if neither is acknowledged in time.
+func (m *Memberlist) probe() {
+	m.mu.Lock()
+	leaving := m.leaving
+	m.mu.Unlock()
+	if leaving {
+		return
+	}
+	target, ok := m.nextTarget()
+	if !ok {
+		return
+	}
+	seq, acked := m.expectAck()
+	defer m.forgetAck(seq)
+
+	m.send(target.addr, &message{Type: msgPing, Seq: seq, Target: target.Name})
+	select {
+	case <-acked:
+		return
+	case <-m.stop:
+		return
+	case <-time.After(m.probeTimeout):
+	}
+
+	for _, peer := range m.randomPeers(m.indirectChecks, target.Name) {
+		m.send(peer.addr, &message{Type: msgPingReq, Seq: seq, Target: target.Name, TargetAddr: target.Addr})
+	}
+	select {
+	case <-acked:
+		return
+	case <-m.stop:
+		return
+	case <-time.After(m.probeInterval - m.probeTimeout):
+	}
+
+	m.mu.Lock()
+	cur := m.members[target.Name]
+	m.mu.Unlock()
+	if cur.State == Alive && cur.Incarnation == target.Incarnation {
+		u := toUpdate(cur.Member)
+		u.State = Suspect
+		m.apply(u)
+	}
+}
+
+// randomPeers returns up to k random alive members other than the local
+// member and exclude.
+func (m *Memberlist) randomPeers(k int, exclude string) []*member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name, mb := range m.members {
+		if name != m.name && name != exclude && mb.State == Alive {
+			names = append(names, name)
+		}
+	}
+	names = shuffle(names)
+	peers := make([]*member, 0, k)
+	for _, name := range names[:min(k, len(names))] {
+		peers = append(peers, m.members[name])
+	}
+	return peers
+}
@@ -0,0 +1,521 @@
+// Package server serves a single cluster.CacheNode over TCP using the
+// memcached text protocol, so stock memcached clients and tools such as nc
+// can talk to it.
+//
+// Supported commands are get, gets, set, add, replace, cas, delete, incr,
+// decr, stats, version and quit.
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cache-ring/cluster"
+)
+
+// Version is reported by the version command and in stats.
+const Version = "cache-ring-1.0"
+
+const (
+	// MaxKeyLength is the longest key the protocol allows.
+	MaxKeyLength = 250
+	// MaxValueSize is the largest value a storage command accepts.
+	MaxValueSize = 1 << 20
+	// MaxGetKeys is the most keys one get or gets command may ask for.
+	MaxGetKeys = 10000
+	// relativeExpiryLimit is the largest exptime read as seconds from now;
+	// larger values are absolute unix times, as in memcached.
+	relativeExpiryLimit = 60 * 60 * 24 * 30
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close.
+var ErrServerClosed = errors.New("server: closed")
+
+// Server serves one CacheNode to any number of connections.
+type Server struct {
+	node    *cluster.CacheNode
+	started time.Time
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+
+	stats counters
+}
+
+// counters are the server side statistics reported by the stats command.
+type counters struct {
+	currConnections  atomic.Int64
+	totalConnections atomic.Uint64
+	cmdGet           atomic.Uint64
+	cmdSet           atomic.Uint64
+	getHits          atomic.Uint64
+	getMisses        atomic.Uint64
+	deleteHits       atomic.Uint64
+	deleteMisses     atomic.Uint64
+	incrHits         atomic.Uint64
+	incrMisses       atomic.Uint64
+	decrHits         atomic.Uint64
+	decrMisses       atomic.Uint64
+	casHits          atomic.Uint64
+	casMisses        atomic.Uint64
+	casBadval        atomic.Uint64
+}
+
+// New returns a server for node.
+func New(node *cluster.CacheNode) *Server {
+	return &Server{
+		node:      node,
+		started:   time.Now(),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and calls Serve.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and handles each in its own goroutine. It
+// returns ErrServerClosed once Close is called, or the accept error.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(l)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.trackConn(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.untrackConn(conn)
+			s.handle(conn)
+		}()
+	}
+}
+
+// Close stops all listeners, closes every connection and waits for their
+// handlers to return.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) track(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(l net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+}
+
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	s.stats.currConnections.Add(1)
+	s.stats.totalConnections.Add(1)
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	conn.Close()
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.stats.currConnections.Add(-1)
+	s.wg.Done()
+}
+
+// handle runs the command loop of one connection until the client quits,
+// the connection fails or a response cannot be written.
+func (s *Server) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			if errors.Is(err, errLineTooLong) {
+				w.WriteString("CLIENT_ERROR line too long\r\n")
+				w.Flush()
+			}
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			w.WriteString("ERROR\r\n")
+		} else if fields[0] == "quit" {
+			return
+		} else if err := s.dispatch(r, w, fields); err != nil {
+			return
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// dispatch runs one command. It returns an error only if the connection is
+// no longer usable.
+func (s *Server) dispatch(r *bufio.Reader, w *bufio.Writer, fields []string) error {
+	switch cmd, args := fields[0], fields[1:]; cmd {
+	case "get", "gets":
+		s.get(w, args, cmd == "gets")
+	case "set", "add", "replace", "cas":
+		return s.storage(r, w, cmd, args)
+	case "delete":
+		s.delete(w, args)
+	case "incr", "decr":
+		s.delta(w, cmd, args)
+	case "stats":
+		s.writeStats(w, args)
+	case "version":
+		fmt.Fprintf(w, "VERSION %s\r\n", Version)
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+	return nil
+}
+
+// get handles get <key>* and gets <key>*.
+func (s *Server) get(w *bufio.Writer, keys []string, withCAS bool) {
+	if len(keys) == 0 {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	if len(keys) > MaxGetKeys {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	for _, key := range keys {
+		if !validKey(key) {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return
+		}
+	}
+	for _, key := range keys {
+		s.stats.cmdGet.Add(1)
+		item, ok := s.node.Get(key)
+		if !ok {
+			s.stats.getMisses.Add(1)
+			continue
+		}
+		s.stats.getHits.Add(1)
+		if withCAS {
+			fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", key, item.Flags, len(item.Value), item.CAS)
+		} else {
+			fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, item.Flags, len(item.Value))
+		}
+		w.WriteString(item.Value)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("END\r\n")
+}
+
+// storage handles
+//
+//	set|add|replace <key> <flags> <exptime> <bytes> [noreply]
+//	cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+//
+// followed by a data block of <bytes> bytes.
+func (s *Server) storage(r *bufio.Reader, w *bufio.Writer, cmd string, args []string) error {
+	want := 4
+	if cmd == "cas" {
+		want = 5
+	}
+	noreply := len(args) == want+1 && args[want] == "noreply"
+	if len(args) != want && !noreply {
+		w.WriteString("ERROR\r\n")
+		return nil
+	}
+	key := args[0]
+	flags, errFlags := strconv.ParseUint(args[1], 10, 32)
+	exptime, errExp := strconv.ParseInt(args[2], 10, 64)
+	size, errSize := strconv.Atoi(args[3])
+	var cas uint64
+	var errCAS error
+	if cmd == "cas" {
+		cas, errCAS = strconv.ParseUint(args[4], 10, 64)
+	}
+	if !validKey(key) || errFlags != nil || errExp != nil || errSize != nil || errCAS != nil || size < 0 {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return nil
+	}
+	if size > MaxValueSize {
+		// skip the data block so the connection stays in sync
+		if _, err := io.CopyN(io.Discard, r, int64(size)+2); err != nil {
+			return err
+		}
+		w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return nil
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if string(data[size:]) != "\r\n" {
+		// the block ran past <bytes>; skip the rest of its line
+		if data[size+1] != '\n' {
+			if _, err := readLine(r); err != nil {
+				return err
+			}
+		}
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return nil
+	}
+
+	s.stats.cmdSet.Add(1)
+	item := cluster.Item{Value: string(data[:size]), Flags: uint32(flags), Expires: expiry(exptime, time.Now())}
+	var err error
+	switch cmd {
+	case "set":
+		s.node.Set(key, item)
+	case "add":
+		err = s.node.Add(key, item)
+	case "replace":
+		err = s.node.Replace(key, item)
+	case "cas":
+		err = s.node.CompareAndSwap(key, item, cas)
+		switch {
+		case err == nil:
+			s.stats.casHits.Add(1)
+		case errors.Is(err, cluster.ErrExists):
+			s.stats.casBadval.Add(1)
+		default:
+			s.stats.casMisses.Add(1)
+		}
+	}
+	if noreply {
+		return nil
+	}
+	switch {
+	case err == nil:
+		w.WriteString("STORED\r\n")
+	case errors.Is(err, cluster.ErrExists):
+		w.WriteString("EXISTS\r\n")
+	case errors.Is(err, cluster.ErrNotFound):
+		w.WriteString("NOT_FOUND\r\n")
+	default:
+		w.WriteString("NOT_STORED\r\n")
+	}
+	return nil
+}
+
+// delete handles delete <key> [noreply].
+func (s *Server) delete(w *bufio.Writer, args []string) {
+	noreply := len(args) == 2 && args[1] == "noreply"
+	if len(args) != 1 && !noreply {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	if !validKey(args[0]) {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	err := s.node.Delete(args[0])
+	if err == nil {
+		s.stats.deleteHits.Add(1)
+	} else {
+		s.stats.deleteMisses.Add(1)
+	}
+	if noreply {
+		return
+	}
+	if err == nil {
+		w.WriteString("DELETED\r\n")
+	} else {
+		w.WriteString("NOT_FOUND\r\n")
+	}
+}
+
+// delta handles incr|decr <key> <value> [noreply].
+func (s *Server) delta(w *bufio.Writer, cmd string, args []string) {
+	noreply := len(args) == 3 && args[2] == "noreply"
+	if len(args) != 2 && !noreply {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if !validKey(args[0]) || err != nil {
+		w.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+		return
+	}
+	var n uint64
+	hits, misses := &s.stats.incrHits, &s.stats.incrMisses
+	if cmd == "incr" {
+		n, err = s.node.Incr(args[0], delta)
+	} else {
+		n, err = s.node.Decr(args[0], delta)
+		hits, misses = &s.stats.decrHits, &s.stats.decrMisses
+	}
+	if errors.Is(err, cluster.ErrNotFound) {
+		misses.Add(1)
+	} else {
+		hits.Add(1)
+	}
+	if noreply {
+		return
+	}
+	switch {
+	case err == nil:
+		fmt.Fprintf(w, "%d\r\n", n)
+	case errors.Is(err, cluster.ErrNotNumber):
+		w.WriteString("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+	default:
+		w.WriteString("NOT_FOUND\r\n")
+	}
+}
+
+// writeStats handles stats. Only the general statistics group is supported.
+func (s *Server) writeStats(w *bufio.Writer, args []string) {
+	if len(args) > 0 {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	now := time.Now()
+	stat := func(name string, value any) {
+		fmt.Fprintf(w, "STAT %s %v\r\n", name, value)
+	}
+	stat("pid", os.Getpid())
+	stat("uptime", int64(now.Sub(s.started).Seconds()))
+	stat("time", now.Unix())
+	stat("version", Version)
+	stat("curr_connections", s.stats.currConnections.Load())
+	stat("total_connections", s.stats.totalConnections.Load())
+	stat("cmd_get", s.stats.cmdGet.Load())
+	stat("cmd_set", s.stats.cmdSet.Load())
+	stat("get_hits", s.stats.getHits.Load())
+	stat("get_misses", s.stats.getMisses.Load())
+	stat("delete_hits", s.stats.deleteHits.Load())
+	stat("delete_misses", s.stats.deleteMisses.Load())
+	stat("incr_hits", s.stats.incrHits.Load())
+	stat("incr_misses", s.stats.incrMisses.Load())
+	stat("decr_hits", s.stats.decrHits.Load())
+	stat("decr_misses", s.stats.decrMisses.Load())
+	stat("cas_hits", s.stats.casHits.Load())
+	stat("cas_misses", s.stats.casMisses.Load())
+	stat("cas_badval", s.stats.casBadval.Load())
+	stat("curr_items", s.node.Len())
+	stat("bytes", s.node.Bytes())
+	stat("evictions", s.node.Evictions())
+	w.WriteString("END\r\n")
+}
+
+// expiry converts a memcached exptime to an absolute expiration time. 0
+// never expires, a negative value has already expired, values up to 30 days
+// are relative to now and larger ones are unix times.
+func expiry(exptime int64, now time.Time) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return now
+	case exptime <= relativeExpiryLimit:
+		return now.Add(time.Duration(exptime) * time.Second)
+	default:
+		return time.Unix(exptime, 0)
+	}
+}
+
+// validKey reports whether key is a legal memcached key: at most
+// MaxKeyLength bytes without spaces or control characters.
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > MaxKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Bounds on the length of a command line. A get or gets line holds up to
+// MaxGetKeys keys of up to MaxKeyLength bytes each; every other command fits
+// in a few hundred bytes, well below maxLineLength.
+const (
+	maxLineLength    = 8 << 10
+	maxGetLineLength = len("gets") + MaxGetKeys*(1+MaxKeyLength)
+)
+
+var errLineTooLong = errors.New("server: line too long")
+
+// readLine reads one command line and strips the trailing \r\n or \n.
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxLineLength && (!isGet(line) || len(line) > maxGetLineLength) {
+			return "", errLineTooLong
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// isGet reports whether line is a get or gets command.
+func isGet(line []byte) bool {
+	line = bytes.TrimLeft(line, " \t")
+	return bytes.HasPrefix(line, []byte("get ")) || bytes.HasPrefix(line, []byte("gets "))
+}
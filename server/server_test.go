@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cache-ring/cluster"
+)
+
+// startServer serves a fresh node on a local port and returns its address.
+func startServer(t *testing.T, capacity cluster.Capacity) (*Server, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := New(cluster.NewCacheNode("test", capacity))
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(l) }()
+	t.Cleanup(func() {
+		srv.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve returned %v; want ErrServerClosed", err)
+		}
+	})
+	return srv, l.Addr().String()
+}
+
+// session is a raw protocol connection, the way nc would talk to the server.
+type session struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *session {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &session{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// send writes raw protocol text.
+func (s *session) send(t *testing.T, text string) {
+	t.Helper()
+	if _, err := io.WriteString(s.conn, text); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+// expect reads len(want) lines and compares them with want.
+func (s *session) expect(t *testing.T, want ...string) {
+	t.Helper()
+	for _, line := range want {
+		got, err := s.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read: %v; want %q", err, line)
+		}
+		if got != line+"\r\n" {
+			t.Fatalf("got %q, want %q", strings.TrimRight(got, "\r\n"), line)
+		}
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	_, addr := startServer(t, cluster.Capacity{})
+	s := dial(t, addr)
+
+	t.Run("set and get", func(t *testing.T) {
+		s.send(t, "set foo 5 0 3\r\nbar\r\n")
+		s.expect(t, "STORED")
+		s.send(t, "get foo missing\r\n")
+		s.expect(t, "VALUE foo 5 3", "bar", "END")
+		s.send(t, "set bin 0 0 4\r\na\r\nb\r\n")
+		s.expect(t, "STORED")
+		s.send(t, "get bin\r\n")
+		s.expect(t, "VALUE bin 0 4", "a", "b", "END")
+	})
+
+	t.Run("add and replace", func(t *testing.T) {
+		s.send(t, "add foo 0 0 1\r\nx\r\n")
+		s.expect(t, "NOT_STORED")
+		s.send(t, "add new 0 0 1\r\nx\r\n")
+		s.expect(t, "STORED")
+		s.send(t, "replace nope 0 0 1\r\nx\r\n")
+		s.expect(t, "NOT_STORED")
+		s.send(t, "replace new 0 0 1\r\ny\r\n")
+		s.expect(t, "STORED")
+	})
+
+	t.Run("gets and cas", func(t *testing.T) {
+		s.send(t, "set c 0 0 1\r\n1\r\n")
+		s.expect(t, "STORED")
+		s.send(t, "gets c\r\n")
+		line, _ := s.r.ReadString('\n')
+		var cas uint64
+		if _, err := fmt.Sscanf(line, "VALUE c 0 1 %d\r\n", &cas); err != nil {
+			t.Fatalf("bad gets response %q", line)
+		}
+		s.expect(t, "1", "END")
+		s.send(t, fmt.Sprintf("cas c 0 0 1 %d\r\n2\r\n", cas))
+		s.expect(t, "STORED")
+		s.send(t, fmt.Sprintf("cas c 0 0 1 %d\r\n3\r\n", cas))
+		s.expect(t, "EXISTS")
+		s.send(t, "cas missing 0 0 1 1\r\n3\r\n")
+		s.expect(t, "NOT_FOUND")
+		s.send(t, "get c\r\n")
+		s.expect(t, "VALUE c 0 1", "2", "END")
+	})
+
+	t.Run("incr and decr", func(t *testing.T) {
+		s.send(t, "set n 0 0 2\r\n10\r\n")
+		s.expect(t, "STORED")
+		s.send(t, "incr n 5\r\n")
+		s.expect(t, "15")
+		s.send(t, "decr n 100\r\n")
+		s.expect(t, "0")
+		s.send(t, "incr missing 1\r\n")
+		s.expect(t, "NOT_FOUND")
+		s.send(t, "incr foo 1\r\n")
+		s.expect(t, "CLIENT_ERROR cannot increment or decrement non-numeric value")
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		s.send(t, "delete foo\r\n")
+		s.expect(t, "DELETED")
+		s.send(t, "delete foo\r\n")
+		s.expect(t, "NOT_FOUND")
+		s.send(t, "get foo\r\n")
+		s.expect(t, "END")
+	})
+
+	t.Run("noreply and pipelining", func(t *testing.T) {
+		s.send(t, "set a 0 0 1 noreply\r\n1\r\nset b 0 0 1 noreply\r\n2\r\ndelete a noreply\r\nget a b\r\n")
+		s.expect(t, "VALUE b 0 1", "2", "END")
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		s.send(t, "set gone 0 -1 1\r\nx\r\n")
+		s.expect(t, "STORED")
+		s.send(t, "get gone\r\n")
+		s.expect(t, "END")
+		s.send(t, fmt.Sprintf("set later 0 %d 1\r\nx\r\n", time.Now().Add(time.Hour).Unix()))
+		s.expect(t, "STORED")
+		s.send(t, "get later\r\n")
+		s.expect(t, "VALUE later 0 1", "x", "END")
+	})
+
+	t.Run("long multi-key get", func(t *testing.T) {
+		keys := make([]string, 2000)
+		for i := range keys {
+			keys[i] = fmt.Sprintf("%s-%d", strings.Repeat("k", 40), i)
+		}
+		s.send(t, "set "+keys[len(keys)-1]+" 0 0 1\r\nv\r\n")
+		s.expect(t, "STORED")
+		s.send(t, "get "+strings.Join(keys, " ")+"\r\n")
+		s.expect(t, "VALUE "+keys[len(keys)-1]+" 0 1", "v", "END")
+		s.send(t, "gets"+strings.Repeat(" k", MaxGetKeys+1)+"\r\n")
+		s.expect(t, "CLIENT_ERROR bad command line format")
+
+		// other commands are held to the short limit
+		long := dial(t, addr)
+		long.send(t, "set "+strings.Repeat("k", maxLineLength)+" 0 0 1\r\n")
+		long.expect(t, "CLIENT_ERROR line too long")
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		s.send(t, "bogus\r\n")
+		s.expect(t, "ERROR")
+		s.send(t, "set k 0 0\r\n")
+		s.expect(t, "ERROR")
+		s.send(t, "set k x 0 1\r\n")
+		s.expect(t, "CLIENT_ERROR bad command line format")
+		s.send(t, "set k 0 0 1\r\nxyz\r\n")
+		s.expect(t, "CLIENT_ERROR bad data chunk")
+		s.send(t, fmt.Sprintf("get %s\r\n", strings.Repeat("k", MaxKeyLength+1)))
+		s.expect(t, "CLIENT_ERROR bad command line format")
+		s.send(t, fmt.Sprintf("set big 0 0 %d\r\n%s\r\n", MaxValueSize+1, strings.Repeat("x", MaxValueSize+1)))
+		s.expect(t, "SERVER_ERROR object too large for cache")
+		s.send(t, "version\r\n")
+		s.expect(t, "VERSION "+Version)
+	})
+}
+
+func TestStats(t *testing.T) {
+	_, addr := startServer(t, cluster.Capacity{MaxEntries: 2})
+	s := dial(t, addr)
+	s.send(t, "set a 0 0 1\r\n1\r\nset b 0 0 1\r\n2\r\nset c 0 0 1\r\n3\r\nget a c\r\n")
+	s.expect(t, "STORED", "STORED", "STORED", "VALUE c 0 1", "3", "END")
+
+	s.send(t, "stats\r\n")
+	stats := make(map[string]string)
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if line == "END\r\n" {
+			break
+		}
+		var name, value string
+		fmt.Sscanf(line, "STAT %s %s\r\n", &name, &value)
+		stats[name] = value
+	}
+	want := map[string]string{
+		"cmd_set":          "3",
+		"cmd_get":          "2",
+		"get_hits":         "1",
+		"get_misses":       "1",
+		"curr_items":       "2",
+		"evictions":        "1",
+		"curr_connections": "1",
+		"version":          Version,
+	}
+	for name, value := range want {
+		if stats[name] != value {
+			t.Fatalf("stat %s is %q; want %q", name, stats[name], value)
+		}
+	}
+}
+
+func TestQuitAndClose(t *testing.T) {
+	srv, addr := startServer(t, cluster.Capacity{})
+	s := dial(t, addr)
+	s.send(t, "quit\r\n")
+	if _, err := s.r.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the server to close the connection after quit, got %v", err)
+	}
+
+	// Close disconnects clients that are still connected.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		s := dial(t, addr)
+		s.send(t, "version\r\n")
+		s.expect(t, "VERSION "+Version)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.r.ReadByte(); err == nil {
+				t.Errorf("expected the connection to be closed")
+			}
+		}()
+	}
+	srv.Close()
+	wg.Wait()
+}